@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	cleanerRunsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "jaeger_postgresql",
+		Name:      "cleaner_runs_total",
+		Help:      "The total number of cleaner runs",
+	}, []string{"mode", "result"})
+
+	cleanerRunHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "jaeger_postgresql",
+		Name:      "cleaner_run_seconds",
+		Help:      "The duration of the cleaner runs in seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+	}, []string{"mode"})
+
+	cleanerRowsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "jaeger_postgresql",
+		Name:      "cleaner_rows_total",
+		Help:      "The total number of rows deleted by the cleaner, or written in the dependencies mode",
+	}, []string{"mode"})
+
+	cleanerPrunedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "jaeger_postgresql",
+		Name:      "cleaner_pruned_total",
+		Help:      "The total number of services and operations pruned by the cleaner",
+	}, []string{"kind"})
+
+	cleanerLastRunRowsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "jaeger_postgresql",
+		Name:      "cleaner_last_run_rows",
+		Help:      "The number of rows deleted by the last successful cleaner run, or written in the dependencies mode",
+	}, []string{"mode"})
+
+	cleanerLastSuccessGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "jaeger_postgresql",
+		Name:      "cleaner_last_success_timestamp_seconds",
+		Help:      "The unix timestamp of the end of the last successful cleaner run",
+	}, []string{"mode"})
+
+	cleanerLockCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "jaeger_postgresql",
+		Name:      "cleaner_lock_total",
+		Help:      "The total number of attempts to take the cleaner lock, by outcome",
+	}, []string{"mode", "result"})
+)
+
+// errRunSkipped is returned by a run that did not do anything because another
+// cleaner was already running. It is not a failure, the run is only reported as
+// skipped.
+var errRunSkipped = errors.New("run skipped")
+
+// runFunc performs a single cleaner run, and returns the number of rows that
+// were affected.
+type runFunc func(ctx context.Context) (int64, error)
+
+// instrument returns a runFunc that records the metrics of every run.
+func instrument(mode string, run runFunc) runFunc {
+	return func(ctx context.Context) (int64, error) {
+		start := time.Now()
+		defer func() {
+			cleanerRunHistogram.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+		}()
+
+		// a failed run may still have affected rows before failing.
+		rows, err := run(ctx)
+		cleanerRowsCounter.WithLabelValues(mode).Add(float64(rows))
+		if errors.Is(err, errRunSkipped) {
+			cleanerRunsCounter.WithLabelValues(mode, "skipped").Inc()
+			return 0, err
+		} else if err != nil {
+			cleanerRunsCounter.WithLabelValues(mode, "failure").Inc()
+			return rows, err
+		}
+
+		cleanerRunsCounter.WithLabelValues(mode, "success").Inc()
+		cleanerLastRunRowsGauge.WithLabelValues(mode).Set(float64(rows))
+		cleanerLastSuccessGauge.WithLabelValues(mode).SetToCurrentTime()
+
+		return rows, nil
+	}
+}
+
+// parseSchedule returns the schedule of the daemon. The cron expression takes
+// precedence over the interval when both are given.
+func parseSchedule(expression string, interval time.Duration) (cron.Schedule, error) {
+	if expression != "" {
+		schedule, err := cron.ParseStandard(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid daemon.schedule given: %w", err)
+		}
+
+		return schedule, nil
+	}
+
+	if interval < time.Second {
+		return nil, fmt.Errorf("invalid daemon.interval given: %s", interval)
+	}
+
+	return cron.Every(interval), nil
+}
+
+// withTimeout returns a context canceled after timeout, or only when ctx is
+// canceled when timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// daemon runs the cleaner on a schedule until it is stopped.
+type daemon struct {
+	logger   *slog.Logger
+	mode     string
+	schedule cron.Schedule
+	timeout  time.Duration
+	run      runFunc
+
+	// ctx is canceled to interrupt the run in progress.
+	ctx      context.Context
+	cancelFn context.CancelFunc
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newDaemon returns a new daemon. Start must be called for it to run.
+func newDaemon(logger *slog.Logger, mode string, schedule cron.Schedule, timeout time.Duration, run runFunc) *daemon {
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	return &daemon{
+		logger:   logger,
+		mode:     mode,
+		schedule: schedule,
+		timeout:  timeout,
+		run:      run,
+		ctx:      ctx,
+		cancelFn: cancelFn,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start starts running the cleaner in the background.
+func (d *daemon) Start(ctx context.Context) error {
+	go d.loop()
+	return nil
+}
+
+// Stop waits for the current run to finish, and stops the daemon. The current
+// run is only canceled when ctx expires first, so that a graceful shutdown
+// never interrupts a run.
+func (d *daemon) Stop(ctx context.Context) error {
+	close(d.stop)
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		d.cancelFn()
+		<-d.done
+		return ctx.Err()
+	}
+}
+
+func (d *daemon) loop() {
+	defer close(d.done)
+	defer d.cancelFn()
+
+	for {
+		next := d.schedule.Next(time.Now())
+		d.logger.Info("scheduled next cleaner run", "mode", d.mode, "at", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-d.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		runCtx, runCancelFn := withTimeout(d.ctx, d.timeout)
+		rows, err := d.run(runCtx)
+		runCancelFn()
+
+		if errors.Is(err, errRunSkipped) {
+			d.logger.Info("cleaner run skipped, another cleaner holds the lock", "mode", d.mode)
+			continue
+		} else if err != nil {
+			d.logger.Error("cleaner run failed", "mode", d.mode, "err", err)
+			continue
+		}
+
+		d.logger.Info("cleaner run succeeded", "mode", d.mode, "rows", rows)
+	}
+}
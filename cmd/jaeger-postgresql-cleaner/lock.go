@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+)
+
+// lockKey returns the key of the advisory lock taken by the cleaner in the
+// given mode. The modes deleting spans share a lock, so that they never fight
+// over the same rows, while aggregating dependencies only excludes itself.
+func lockKey(mode string) int64 {
+	name := "jaeger-postgresql-cleaner:spans"
+	if mode == modeDependencies {
+		name = "jaeger-postgresql-cleaner:dependencies"
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// withLock returns a runFunc that only runs while holding the advisory lock of
+// the mode. When another cleaner holds the lock, the run is skipped, or waits
+// for the lock to be released when wait is true.
+func withLock(pool *pgxpool.Pool, logger *slog.Logger, mode string, wait bool, run runFunc) runFunc {
+	key := lockKey(mode)
+
+	return func(ctx context.Context) (int64, error) {
+		// session level advisory locks belong to a connection, so the lock is
+		// held on a connection dedicated to it for the duration of the run.
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			cleanerLockCounter.WithLabelValues(mode, "failure").Inc()
+			return 0, fmt.Errorf("failed to acquire connection for the cleaner lock: %w", err)
+		}
+		defer conn.Release()
+
+		q := sql.New(conn)
+
+		locked, err := q.TryAdvisoryLock(ctx, key)
+		if err != nil {
+			cleanerLockCounter.WithLabelValues(mode, "failure").Inc()
+			return 0, fmt.Errorf("failed to take the cleaner lock: %w", err)
+		}
+
+		if !locked && !wait {
+			cleanerLockCounter.WithLabelValues(mode, "skipped").Inc()
+			return 0, errRunSkipped
+		}
+
+		if !locked {
+			logger.Info("waiting for another cleaner to release the lock", "mode", mode)
+
+			start := time.Now()
+			if err := q.AdvisoryLock(ctx, key); err != nil {
+				cleanerLockCounter.WithLabelValues(mode, "failure").Inc()
+				return 0, fmt.Errorf("failed to wait for the cleaner lock: %w", err)
+			}
+
+			cleanerLockCounter.WithLabelValues(mode, "waited").Inc()
+			logger.Info("took the cleaner lock", "mode", mode, "waited", time.Since(start))
+		} else {
+			cleanerLockCounter.WithLabelValues(mode, "acquired").Inc()
+			logger.Debug("took the cleaner lock", "mode", mode)
+		}
+
+		defer func() {
+			// the lock is released even when the run was canceled.
+			ctx, cancelFn := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancelFn()
+
+			if _, err := q.AdvisoryUnlock(ctx, key); err != nil {
+				// the lock is released with the connection when it is closed.
+				logger.Error("failed to release the cleaner lock", "mode", mode, "err", err)
+				conn.Conn().Close(ctx)
+			}
+		}()
+
+		return run(ctx)
+	}
+}
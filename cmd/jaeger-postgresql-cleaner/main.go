@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
+	"net"
+	"net/http"
+	"os"
 	"strings"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robbert229/jaeger-postgresql/internal/logger"
 	"github.com/robbert229/jaeger-postgresql/internal/sql"
+	"github.com/robbert229/jaeger-postgresql/internal/store"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"go.uber.org/fx"
@@ -80,17 +85,328 @@ func ProvidePgxPool() any {
 	}
 }
 
-// clean purges the old roles from the database
-func clean(ctx context.Context, pool *pgxpool.Pool, maxAge time.Duration) (int64, error) {
+// clean purges the spans that outlived the retention policy from the database
+// in batches.
+func clean(ctx context.Context, pool *pgxpool.Pool, logger *slog.Logger, policy store.RetentionPolicy, opts store.CleanOptions) (int64, error) {
 	q := sql.New(pool)
-	result, err := q.CleanSpans(ctx, pgtype.Timestamp{Time: time.Now().Add(-1 * maxAge), Valid: true})
+	return store.CleanSpansByRetention(ctx, q, logger, time.Now(), policy, opts)
+}
+
+// withPrune returns a runFunc that prunes the services and operations left
+// without spans after a successful run.
+func withPrune(pool *pgxpool.Pool, logger *slog.Logger, run runFunc) runFunc {
+	return func(ctx context.Context) (int64, error) {
+		count, err := run(ctx)
+		if err != nil {
+			return count, err
+		}
+
+		q := sql.New(pool)
+		report, err := store.PruneUnused(ctx, q, logger)
+		cleanerPrunedCounter.WithLabelValues("services").Add(float64(report.Services))
+		cleanerPrunedCounter.WithLabelValues("operations").Add(float64(report.Operations))
+		if err != nil {
+			return count, fmt.Errorf("failed to prune services and operations: %w", err)
+		}
+
+		logger.Info("successfully pruned services and operations", "services", report.Services, "operations", report.Operations)
+		return count, nil
+	}
+}
+
+// report returns, per service and in total, the spans that outlived the
+// retention policy without deleting them.
+func report(ctx context.Context, pool *pgxpool.Pool, policy store.RetentionPolicy) ([]store.RetentionReport, store.RetentionReport, error) {
+	q := sql.New(pool)
+	return store.ReportSpansByRetention(ctx, q, time.Now(), policy)
+}
+
+// cleanToBudget purges the oldest spans from the database until the spans
+// table fits in the disk budget.
+func cleanToBudget(ctx context.Context, pool *pgxpool.Pool, logger *slog.Logger, budget store.DiskBudget, opts store.CleanOptions) (store.DiskBudgetReport, error) {
+	q := sql.New(pool)
+	return store.CleanSpansToBudget(ctx, q, logger, time.Now(), budget, opts)
+}
+
+// aggregateDependencies precomputes the dependency links for the spans started
+// within the lookback window.
+func aggregateDependencies(ctx context.Context, pool *pgxpool.Pool, lookback time.Duration) (int64, error) {
+	q := sql.New(pool)
+	now := time.Now()
+	return store.AggregateDependencies(ctx, q, now.Add(-1*lookback), now)
+}
+
+// dropPartitions drops the partitions of the spans table that only hold spans
+// older than the max age.
+func dropPartitions(ctx context.Context, pool *pgxpool.Pool, maxAge time.Duration) ([]string, error) {
+	q := sql.New(pool)
+	return store.DropPartitions(ctx, q, time.Now().Add(-1*maxAge))
+}
+
+// verify checks that the spans can still be decoded and reference a consistent
+// service and operation.
+func verify(ctx context.Context, pool *pgxpool.Pool, logger *slog.Logger, opts store.VerifyOptions) (store.VerifyReport, error) {
+	q := sql.New(pool)
+	return store.VerifySpans(ctx, q, logger, opts)
+}
+
+// newVerifyOptions returns the options of the verify mode of the
+// configuration.
+func newVerifyOptions(cfg Config) (store.VerifyOptions, error) {
+	opts := store.VerifyOptions{
+		Service:    cfg.Verify.Service,
+		Quarantine: cfg.Verify.Quarantine,
+		BatchSize:  cfg.Verify.BatchSize,
+	}
+
+	if cfg.Verify.StartTimeMin != "" {
+		t, err := time.Parse(time.RFC3339, cfg.Verify.StartTimeMin)
+		if err != nil {
+			return opts, fmt.Errorf("invalid verify.start-time-min given: %w", err)
+		}
+
+		opts.StartTimeMin = t.UTC()
+	}
+
+	if cfg.Verify.StartTimeMax != "" {
+		t, err := time.Parse(time.RFC3339, cfg.Verify.StartTimeMax)
+		if err != nil {
+			return opts, fmt.Errorf("invalid verify.start-time-max given: %w", err)
+		}
+
+		opts.StartTimeMax = t.UTC()
+	}
+
+	return opts, nil
+}
+
+// newRetentionPolicy returns the retention policy of the configuration, where
+// the max span age is the default retention.
+func newRetentionPolicy(cfg Config) store.RetentionPolicy {
+	policy := store.RetentionPolicy{Default: cfg.MaxSpanAge}
+	for _, rule := range cfg.Retention.Rules {
+		policy.Rules = append(policy.Rules, store.RetentionRule{
+			Service:   rule.Service,
+			Operation: rule.Operation,
+			Tag:       rule.Tag,
+			MaxAge:    rule.MaxAge,
+		})
+	}
+
+	return policy
+}
+
+// newRun returns the function performing a single run of the cleaner in the
+// configured mode.
+func newRun(cfg Config, pool *pgxpool.Pool, logger *slog.Logger) (runFunc, error) {
+	policy := newRetentionPolicy(cfg)
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.DryRun {
+		if cfg.Mode != modeSpans {
+			return nil, fmt.Errorf("dry-run is only supported by the %s mode", modeSpans)
+		}
+
+		if cfg.Report.Format != reportFormatTable && cfg.Report.Format != reportFormatJSON {
+			return nil, fmt.Errorf("invalid report.format given: %s", cfg.Report.Format)
+		}
+
+		return func(ctx context.Context) (int64, error) {
+			reports, total, err := report(ctx, pool, policy)
+			if err != nil {
+				return 0, fmt.Errorf("failed to report expired spans: %w", err)
+			}
+
+			return 0, printReport(os.Stdout, cfg.Report.Format, reports, total)
+		}, nil
+	}
+
+	var run runFunc
+	switch cfg.Mode {
+	case modeSpans:
+		run = func(ctx context.Context) (int64, error) {
+			count, err := clean(ctx, pool, logger, policy, store.CleanOptions{
+				BatchSize: cfg.Clean.BatchSize,
+				Pause:     cfg.Clean.BatchPause,
+			})
+			if err != nil {
+				return count, fmt.Errorf("failed to clean database: %w", err)
+			}
+
+			logger.Info("successfully cleaned database", "spans", count)
+			return count, nil
+		}
+	case modePartitions:
+		run = func(ctx context.Context) (int64, error) {
+			// whole partitions are dropped, so they are kept for as long as
+			// the longest retention requires.
+			dropped, err := dropPartitions(ctx, pool, policy.MaxAge())
+			if err != nil {
+				return 0, err
+			}
+
+			logger.Info("successfully dropped partitions", "partitions", dropped)
+			return int64(len(dropped)), nil
+		}
+	case modeBytes:
+		run = func(ctx context.Context) (int64, error) {
+			report, err := cleanToBudget(ctx, pool, logger, store.DiskBudget{
+				MaxBytes:    cfg.MaxBytes,
+				TargetBytes: cfg.TargetBytes,
+				MinAge:      cfg.MinSpanAge,
+			}, store.CleanOptions{
+				BatchSize: cfg.Clean.BatchSize,
+				Pause:     cfg.Clean.BatchPause,
+			})
+			if err != nil {
+				return report.Spans, fmt.Errorf("failed to clean database to its disk budget: %w", err)
+			}
+
+			logger.Info(
+				"successfully cleaned database to its disk budget",
+				"size", report.SizeBytes,
+				"max_bytes", cfg.MaxBytes,
+				"target_bytes", cfg.TargetBytes,
+				"spans", report.Spans,
+				"estimated_bytes", report.EstimatedBytes,
+				"oldest_span", report.OldestSpan,
+			)
+			return report.Spans, nil
+		}
+	case modeDependencies:
+		run = func(ctx context.Context) (int64, error) {
+			count, err := aggregateDependencies(ctx, pool, cfg.Dependencies.Lookback)
+			if err != nil {
+				return 0, fmt.Errorf("failed to aggregate dependencies: %w", err)
+			}
+
+			logger.Info("successfully aggregated dependencies", "links", count)
+			return count, nil
+		}
+	case modeVerify:
+		if cfg.Report.Format != reportFormatTable && cfg.Report.Format != reportFormatJSON {
+			return nil, fmt.Errorf("invalid report.format given: %s", cfg.Report.Format)
+		}
+
+		opts, err := newVerifyOptions(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		run = func(ctx context.Context) (int64, error) {
+			report, err := verify(ctx, pool, logger, opts)
+			quarantined := report.Quarantined()
+			if err != nil {
+				return quarantined, fmt.Errorf("failed to verify spans: %w", err)
+			}
+
+			if err := printVerifyReport(os.Stdout, cfg.Report.Format, report); err != nil {
+				return quarantined, err
+			}
+
+			// the corrupt spans that were quarantined no longer fail their
+			// traces, so only the ones left behind fail the run.
+			if left := int64(len(report.Corrupt)) - quarantined; left > 0 {
+				return quarantined, fmt.Errorf("found %d corrupt spans", left)
+			}
+
+			logger.Info("successfully verified spans", "spans", report.Spans, "quarantined", quarantined)
+			return quarantined, nil
+		}
+	default:
+		return nil, fmt.Errorf("invalid mode given: %s", cfg.Mode)
+	}
+
+	if cfg.Prune {
+		if cfg.Mode == modeDependencies {
+			return nil, fmt.Errorf("prune is not supported by the %s mode", modeDependencies)
+		}
+
+		run = withPrune(pool, logger, run)
+	}
+
+	// the lock holds a connection of the pool for the duration of the run,
+	// which would wait forever for another one if the pool had no other.
+	if maxConns := pool.Config().MaxConns; maxConns < 2 {
+		return nil, fmt.Errorf("invalid database.max-conns given: %d, the cleaner lock needs a connection of its own", maxConns)
+	}
+
+	run = withLock(pool, logger, cfg.Mode, cfg.Lock.Wait, run)
+
+	return instrument(cfg.Mode, run), nil
+}
+
+// startAdminServer starts the admin http server of the daemon, exposing the
+// metrics and the health check.
+func startAdminServer(lc fx.Lifecycle, cfg Config, pool *pgxpool.Pool, logger *slog.Logger) error {
+	if cfg.Admin.HTTP.HostPort == "" {
+		return fmt.Errorf("invalid admin.http.host-port given: %s", cfg.Admin.HTTP.HostPort)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancelFn := context.WithTimeout(r.Context(), time.Second*5)
+		defer cancelFn()
+
+		err := pool.Ping(ctx)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	srv := http.Server{
+		Handler: mux,
+	}
+
+	lis, err := net.Listen("tcp", cfg.Admin.HTTP.HostPort)
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("failed to listen: %w", err)
 	}
 
-	return result, nil
+	logger.Info("admin server started", "addr", lis.Addr())
+
+	lc.Append(fx.StartStopHook(
+		func(ctx context.Context) error {
+			go srv.Serve(lis)
+			return nil
+		},
+
+		func(ctx context.Context) error {
+			return srv.Shutdown(ctx)
+		},
+	))
+
+	return nil
 }
 
+const (
+	// modeSpans deletes the spans that are older than max-span-age.
+	modeSpans = "spans"
+
+	// modePartitions drops the partitions of the spans table that only hold
+	// spans older than max-span-age.
+	modePartitions = "partitions"
+
+	// modeBytes deletes the oldest spans once the spans table is over
+	// max-bytes, down to target-bytes, keeping the spans younger than
+	// min-span-age.
+	modeBytes = "bytes"
+
+	// modeVerify checks that the spans can still be decoded, and optionally
+	// quarantines the corrupt ones.
+	modeVerify = "verify"
+
+	// modeDependencies aggregates the spans of the dependencies lookback
+	// window into the dependency_links table.
+	modeDependencies = "dependencies"
+)
+
 type Config struct {
 	Database struct {
 		URL      string `mapstructure:"url"`
@@ -100,14 +416,101 @@ type Config struct {
 	LogLevel string `mapstructure:"log-level"`
 
 	MaxSpanAge time.Duration `mapstructure:"max-span-age"`
+
+	MaxBytes    int64         `mapstructure:"max-bytes"`
+	TargetBytes int64         `mapstructure:"target-bytes"`
+	MinSpanAge  time.Duration `mapstructure:"min-span-age"`
+
+	Mode string `mapstructure:"mode"`
+
+	// Retention overrides the max span age of the spans matched by its rules.
+	// The rules can only be set in the configuration file, the first rule
+	// matching a span decides its max age.
+	Retention struct {
+		Rules []struct {
+			Service   string        `mapstructure:"service"`
+			Operation string        `mapstructure:"operation"`
+			Tag       string        `mapstructure:"tag"`
+			MaxAge    time.Duration `mapstructure:"max-age"`
+		} `mapstructure:"rules"`
+	} `mapstructure:"retention"`
+
+	Dependencies struct {
+		Lookback time.Duration `mapstructure:"lookback"`
+	} `mapstructure:"dependencies"`
+
+	Clean struct {
+		BatchSize  int           `mapstructure:"batch-size"`
+		BatchPause time.Duration `mapstructure:"batch-pause"`
+	} `mapstructure:"clean"`
+
+	Verify struct {
+		StartTimeMin string `mapstructure:"start-time-min"`
+		StartTimeMax string `mapstructure:"start-time-max"`
+		Service      string `mapstructure:"service"`
+		Quarantine   bool   `mapstructure:"quarantine"`
+		BatchSize    int    `mapstructure:"batch-size"`
+	} `mapstructure:"verify"`
+
+	Prune bool `mapstructure:"prune"`
+
+	DryRun bool `mapstructure:"dry-run"`
+
+	Report struct {
+		Format string `mapstructure:"format"`
+	} `mapstructure:"report"`
+
+	// Timeout bounds the duration of a single run, it is unlimited when zero.
+	// Cleanups delete the spans in batches of clean.batch-size separated by
+	// clean.batch-pause, and every batch is committed on its own, so a run
+	// interrupted by the timeout keeps what it deleted and the next run picks
+	// up from there.
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	Lock struct {
+		Wait bool `mapstructure:"wait"`
+	} `mapstructure:"lock"`
+
+	Daemon struct {
+		Enabled  bool          `mapstructure:"enabled"`
+		Interval time.Duration `mapstructure:"interval"`
+		Schedule string        `mapstructure:"schedule"`
+	} `mapstructure:"daemon"`
+
+	Admin struct {
+		HTTP struct {
+			HostPort string `mapstructure:"host-port"`
+		}
+	}
 }
 
 func ProvideConfig() func() (Config, error) {
 	return func() (Config, error) {
 		pflag.String("database.url", "", "the postgres connection url to use to connect to the database")
-		pflag.Int("database.max-conns", 20, "Max number of database connections of which the plugin will try to maintain at any given time")
+		pflag.Int("database.max-conns", 20, "Max number of database connections of which the plugin will try to maintain at any given time, at least 2 as the cleaner lock holds one")
 		pflag.String("log-level", "warn", "Minimal allowed log level")
 		pflag.Duration("max-span-age", time.Hour*24, "Maximum age of a span before it will be cleaned")
+		pflag.Int64("max-bytes", 0, "Disk size in bytes of the spans table, including its partitions and indexes, above which the bytes mode deletes the oldest spans")
+		pflag.Int64("target-bytes", 0, "Disk size in bytes the bytes mode brings the spans table down to once it exceeds max-bytes, 90% of max-bytes when zero")
+		pflag.Duration("min-span-age", time.Hour, "Minimum age of a span before it can be deleted by the bytes mode")
+		pflag.String("mode", modeSpans, "What the cleaner should do, either 'spans' to delete old spans, 'partitions' to drop the partitions holding old spans, 'bytes' to delete the oldest spans once the spans table exceeds max-bytes, 'dependencies' to precompute the dependency links, or 'verify' to report the spans that can no longer be decoded")
+		pflag.Duration("dependencies.lookback", time.Hour*2, "How far back the dependencies mode aggregates spans into dependency links")
+		pflag.Int("clean.batch-size", 10000, "Maximum number of spans deleted by a single statement in the spans mode")
+		pflag.Duration("clean.batch-pause", time.Millisecond*100, "How long the spans mode pauses between two batches, leaving room for the writers")
+		pflag.String("verify.start-time-min", "", "An RFC 3339 timestamp, when set the verify mode only checks the spans started at or after it")
+		pflag.String("verify.start-time-max", "", "An RFC 3339 timestamp, when set the verify mode only checks the spans started before it")
+		pflag.String("verify.service", "", "When set the verify mode only checks the spans of this service")
+		pflag.Bool("verify.quarantine", false, "Move the corrupt spans found by the verify mode into the quarantined_spans table")
+		pflag.Int("verify.batch-size", 1000, "The number of spans loaded by a single query in the verify mode")
+		pflag.Bool("prune", false, "Delete the services and operations left without spans after cleaning the spans")
+		pflag.Bool("dry-run", false, "Report per service the spans, traces and estimated bytes the spans mode would delete, without deleting anything")
+		pflag.String("report.format", reportFormatTable, "The format of the dry-run and verify reports, either 'table' or 'json'")
+		pflag.Duration("timeout", 0, "Maximum duration of a single run of the cleaner, or 0 for no limit. A run deleting spans in batches stops after the batch in progress, keeping the spans deleted by the previous batches, so a run deletes at most about timeout / (duration of a batch + clean.batch-pause) * clean.batch-size spans")
+		pflag.Bool("lock.wait", false, "Wait for another cleaner running in a conflicting mode to finish, instead of skipping the run")
+		pflag.Bool("daemon.enabled", false, "Keep running, and clean the database on a schedule instead of exiting after a single run")
+		pflag.Duration("daemon.interval", time.Hour, "The interval between the runs of the daemon")
+		pflag.String("daemon.schedule", "", "A cron expression (e.g. '0 * * * *') scheduling the runs of the daemon, takes precedence over daemon.interval")
+		pflag.String("admin.http.host-port", ":12346", "The host:port (e.g. 127.0.0.1:12346 or :12346) for the admin server of the daemon, including health check, /metrics, etc.")
 
 		v := viper.New()
 		v.SetEnvPrefix("JAEGER_POSTGRESQL")
@@ -149,18 +552,38 @@ func main() {
 			ProvidePgxPool(),
 		),
 		fx.Invoke(func(cfg Config, pool *pgxpool.Pool, lc fx.Lifecycle, logger *slog.Logger, stopper fx.Shutdowner) error {
+			run, err := newRun(cfg, pool, logger)
+			if err != nil {
+				return err
+			}
+
+			if cfg.Daemon.Enabled {
+				schedule, err := parseSchedule(cfg.Daemon.Schedule, cfg.Daemon.Interval)
+				if err != nil {
+					return err
+				}
+
+				if err := startAdminServer(lc, cfg, pool, logger); err != nil {
+					return err
+				}
+
+				d := newDaemon(logger, cfg.Mode, schedule, cfg.Timeout, run)
+				lc.Append(fx.StartStopHook(d.Start, d.Stop))
+				return nil
+			}
+
 			go func(ctx context.Context) {
-				ctx, cancelFn := context.WithTimeout(ctx, time.Minute)
+				ctx, cancelFn := withTimeout(ctx, cfg.Timeout)
 				defer cancelFn()
 
-				count, err := clean(ctx, pool, cfg.MaxSpanAge)
-				if err != nil {
-					logger.Error("failed to clean database", "err", err)
+				if _, err := run(ctx); errors.Is(err, errRunSkipped) {
+					logger.Info("cleaner skipped, another cleaner holds the lock", "mode", cfg.Mode)
+				} else if err != nil {
+					logger.Error("cleaner failed", "mode", cfg.Mode, "err", err)
 					stopper.Shutdown(fx.ExitCode(1))
 					return
 				}
 
-				logger.Info("successfully cleaned database", "spans", count)
 				stopper.Shutdown(fx.ExitCode(0))
 			}(context.Background())
 			return nil
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robbert229/jaeger-postgresql/internal/store"
+)
+
+const (
+	// reportFormatTable prints the report as a table.
+	reportFormatTable = "table"
+
+	// reportFormatJSON prints the report as JSON.
+	reportFormatJSON = "json"
+)
+
+// printReport prints the spans that would be deleted by the cleaner in the
+// given format. total is counted by the database rather than summed, as a trace
+// spanning several services is counted by each of them.
+func printReport(w io.Writer, format string, reports []store.RetentionReport, total store.RetentionReport) error {
+	switch format {
+	case reportFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "SERVICE\tSPANS\tTRACES\tBYTES\t")
+		for _, report := range reports {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\n", report.Service, report.Spans, report.Traces, report.Bytes)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\n", "TOTAL", total.Spans, total.Traces, total.Bytes)
+
+		return tw.Flush()
+	case reportFormatJSON:
+		if reports == nil {
+			reports = []store.RetentionReport{}
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Services []store.RetentionReport `json:"services"`
+			Total    store.RetentionReport   `json:"total"`
+		}{reports, total})
+	default:
+		return fmt.Errorf("invalid report.format given: %s", format)
+	}
+}
+
+// printVerifyReport prints the corrupt spans found by the verify mode in the
+// given format.
+func printVerifyReport(w io.Writer, format string, report store.VerifyReport) error {
+	switch format {
+	case reportFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "HACK_ID\tSTART_TIME\tTRACE_ID\tSPAN_ID\tSERVICE\tOPERATION\tQUARANTINED\tREASON")
+		for _, span := range report.Corrupt {
+			fmt.Fprintf(
+				tw,
+				"%d\t%s\t%s\t%s\t%s\t%s\t%t\t%s\n",
+				span.HackID,
+				span.StartTime.Format(time.RFC3339),
+				span.TraceID,
+				span.SpanID,
+				span.Service,
+				span.Operation,
+				span.Quarantined,
+				span.Reason,
+			)
+		}
+
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		_, err := fmt.Fprintf(w, "verified %d spans, %d corrupt, %d quarantined\n", report.Spans, len(report.Corrupt), report.Quarantined())
+		return err
+	case reportFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	default:
+		return fmt.Errorf("invalid report.format given: %s", format)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
@@ -64,6 +65,8 @@ func ProvidePgxPool() any {
 			pgxconfig.MaxConns = maxConns
 		}
 
+		pgxconfig.AfterConnect = sql.RegisterTypes
+
 		// handle timeout duration
 		connectTimeoutDuration := time.Second * 10
 		pgxconfig.ConnConfig.ConnectTimeout = connectTimeoutDuration
@@ -91,48 +94,118 @@ func ProvidePgxPool() any {
 
 // ProvideSpanStoreReader returns a function that provides a spanstore reader.
 func ProvideSpanStoreReader() any {
-	return func(pool *pgxpool.Pool, logger *slog.Logger) spanstore.Reader {
+	return func(cfg Config, pool *pgxpool.Pool, logger *slog.Logger) (spanstore.Reader, error) {
+		opts := store.ReaderOptions{
+			Lookback:     cfg.Reader.Lookback,
+			DecodeErrors: store.DecodeErrorPolicy(cfg.Reader.DecodeErrors),
+			IndexedLogs:  cfg.TagIndex.Logs,
+		}
+
+		if err := opts.DecodeErrors.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid reader.decode-errors given: %w", err)
+		}
+
 		q := sql.New(pool)
-		return store.NewInstrumentedReader(store.NewReader(q, logger), logger)
+		reader := store.NewReaderWithOptions(q, logger, opts)
+
+		return store.NewInstrumentedReader(reader, logger), nil
 	}
 }
 
 // ProvideSpanStoreWriter returns a function that provides a spanstore writer
 func ProvideSpanStoreWriter() any {
-	return func(pool *pgxpool.Pool, logger *slog.Logger) spanstore.Writer {
+	return func(cfg Config, pool *pgxpool.Pool, batchWriter *store.BatchWriter, logger *slog.Logger) spanstore.Writer {
+		if cfg.BatchWriter.Enabled {
+			return store.NewInstrumentedWriter(batchWriter, logger)
+		}
+
 		q := sql.New(pool)
 		return store.NewInstrumentedWriter(store.NewWriter(q, logger), logger)
 	}
 }
 
+// ProvideBatchWriter provides the batch writer that backs the streaming span
+// writer, and optionally the unary span writer. Its buffered spans are flushed
+// when the application stops.
+func ProvideBatchWriter() any {
+	return func(cfg Config, pool *pgxpool.Pool, logger *slog.Logger, lc fx.Lifecycle) *store.BatchWriter {
+		q := sql.New(pool)
+		writer := store.NewBatchWriter(store.NewWriter(q, logger), logger, store.BatchWriterOptions{
+			Size:          cfg.BatchWriter.Size,
+			FlushInterval: cfg.BatchWriter.FlushInterval,
+		})
+
+		lc.Append(fx.StopHook(writer.Close))
+
+		return writer
+	}
+}
+
 // ProvideDependencyStoreReader provides a dependencystore reader
 func ProvideDependencyStoreReader() any {
-	return func(pool *pgxpool.Pool, logger *slog.Logger) dependencystore.Reader {
+	return func(cfg Config, pool *pgxpool.Pool, logger *slog.Logger) dependencystore.Reader {
 		q := sql.New(pool)
+		if cfg.Dependencies.Precomputed {
+			return store.NewDependencyReader(q, logger)
+		}
+
 		return store.NewReader(q, logger)
 	}
 }
 
+// ProvideArchiveSpanStoreReader provides the archive spanstore reader.
+func ProvideArchiveSpanStoreReader() any {
+	return func(cfg Config, pool *pgxpool.Pool, logger *slog.Logger) (*store.ArchiveReader, error) {
+		decodeErrors := store.DecodeErrorPolicy(cfg.Reader.DecodeErrors)
+		if err := decodeErrors.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid reader.decode-errors given: %w", err)
+		}
+
+		q := sql.New(pool)
+		return store.NewArchiveReader(q, logger, decodeErrors), nil
+	}
+}
+
+// ProvideArchiveSpanStoreWriter provides the archive spanstore writer.
+func ProvideArchiveSpanStoreWriter() any {
+	return func(pool *pgxpool.Pool, logger *slog.Logger) *store.ArchiveWriter {
+		q := sql.New(pool)
+		return store.NewArchiveWriter(q, logger)
+	}
+}
+
 // ProvideHandler provides a grpc handler.
 func ProvideHandler() any {
-	return func(reader spanstore.Reader, writer spanstore.Writer, dependencyReader dependencystore.Reader) *shared.GRPCHandler {
+	return func(reader spanstore.Reader, writer spanstore.Writer, dependencyReader dependencystore.Reader, archiveReader *store.ArchiveReader, archiveWriter *store.ArchiveWriter, batchWriter *store.BatchWriter, logger *slog.Logger) *shared.GRPCHandler {
+		streamingWriter := store.NewInstrumentedWriter(batchWriter, logger)
+
 		handler := shared.NewGRPCHandler(&shared.GRPCHandlerStorageImpl{
 			SpanReader:          func() spanstore.Reader { return reader },
 			SpanWriter:          func() spanstore.Writer { return writer },
 			DependencyReader:    func() dependencystore.Reader { return dependencyReader },
-			ArchiveSpanReader:   func() spanstore.Reader { return nil },
-			ArchiveSpanWriter:   func() spanstore.Writer { return nil },
-			StreamingSpanWriter: func() spanstore.Writer { return nil },
+			ArchiveSpanReader:   func() spanstore.Reader { return archiveReader },
+			ArchiveSpanWriter:   func() spanstore.Writer { return archiveWriter },
+			StreamingSpanWriter: func() spanstore.Writer { return streamingWriter },
 		})
 
 		return handler
 	}
 }
 
-// ProvideGRPCServer provides a grpc server.
+// ProvideGRPCServer provides a grpc server serving the handler. The handler,
+// and the batch writer behind it, are provided first, so that the server stops
+// accepting spans before the batch writer is closed, as fx runs the stop hooks
+// in the reverse order of their registration.
 func ProvideGRPCServer() any {
-	return func(lc fx.Lifecycle, cfg Config, logger *slog.Logger) (*grpc.Server, error) {
-		srv := grpc.NewServer()
+	return func(lc fx.Lifecycle, cfg Config, handler *shared.GRPCHandler, logger *slog.Logger) (*grpc.Server, error) {
+		srv := grpc.NewServer(
+			grpc.ChainUnaryInterceptor(store.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(store.StreamServerInterceptor()),
+		)
+
+		if err := handler.Register(srv); err != nil {
+			return nil, fmt.Errorf("failed to register grpc handler: %w", err)
+		}
 
 		if cfg.GRPCServer.HostPort == "" {
 			return nil, fmt.Errorf("invalid grpc-server.host-port given: %s", cfg.GRPCServer.HostPort)
@@ -228,6 +301,37 @@ type Config struct {
 			HostPort string `mapstructure:"host-port"`
 		}
 	}
+
+	Reader struct {
+		Lookback     time.Duration `mapstructure:"lookback"`
+		DecodeErrors string        `mapstructure:"decode-errors"`
+	} `mapstructure:"reader"`
+
+	Dependencies struct {
+		Precomputed bool `mapstructure:"precomputed"`
+	} `mapstructure:"dependencies"`
+
+	TagIndex struct {
+		Logs bool `mapstructure:"logs"`
+	} `mapstructure:"tag-index"`
+
+	Reencode struct {
+		Enabled   bool          `mapstructure:"enabled"`
+		BatchSize int           `mapstructure:"batch-size"`
+		Pause     time.Duration `mapstructure:"pause"`
+		Interval  time.Duration `mapstructure:"interval"`
+	} `mapstructure:"reencode"`
+
+	Partitions struct {
+		Interval  string `mapstructure:"interval"`
+		Lookahead int    `mapstructure:"lookahead"`
+	} `mapstructure:"partitions"`
+
+	BatchWriter struct {
+		Enabled       bool          `mapstructure:"enabled"`
+		Size          int           `mapstructure:"size"`
+		FlushInterval time.Duration `mapstructure:"flush-interval"`
+	} `mapstructure:"batch-writer"`
 }
 
 func ProvideConfig() func() (Config, error) {
@@ -237,6 +341,19 @@ func ProvideConfig() func() (Config, error) {
 		pflag.String("log-level", "warn", "Minimal allowed log level")
 		pflag.String("grpc-server.host-port", ":12345", "the host:port (eg 127.0.0.1:12345 or :12345) of the storage provider's gRPC server")
 		pflag.String("admin.http.host-port", ":12346", "The host:port (e.g. 127.0.0.1:12346 or :12346) for the admin server, including health check, /metrics, etc.")
+		pflag.Bool("tag-index.logs", false, "when true the logs of the spans get a GIN index, which the tag searches need to use the GIN indexes of the tags, at the cost of slower writes")
+		pflag.Bool("reencode.enabled", false, "when true the spans stored in an older encoding version are re-encoded in the current one in the background")
+		pflag.Int("reencode.batch-size", 1000, "The number of spans loaded by a single query when re-encoding spans")
+		pflag.Duration("reencode.pause", time.Millisecond*100, "How long to pause between two batches of re-encoded spans, leaving room for the writers")
+		pflag.Duration("reencode.interval", time.Minute*10, "How often the spans stored in an older encoding version are looked up and re-encoded")
+		pflag.String("partitions.interval", string(store.PartitionIntervalDay), "The range of time covered by each partition of the spans table, either 'hour' or 'day'")
+		pflag.Int("partitions.lookahead", 3, "The number of partitions of the spans table that are created ahead of time")
+		pflag.Bool("batch-writer.enabled", false, "when true spans written with unary WriteSpan calls are buffered and inserted in batches, like the spans received over the streaming writer")
+		pflag.Int("batch-writer.size", 1000, "The number of buffered spans that are inserted together in a single batch")
+		pflag.Duration("batch-writer.flush-interval", time.Second, "The maximum amount of time a span is buffered before being inserted")
+		pflag.Duration("reader.lookback", 0, "when set the services and operations that have not been seen within the lookback are hidden")
+		pflag.String("reader.decode-errors", string(store.DecodeErrorPolicyFail), "what to do with stored and archived spans that cannot be decoded, either 'fail' to fail their trace, or 'drop' to drop the tags, logs and references that cannot be decoded and add a warning to the span naming them")
+		pflag.Bool("dependencies.precomputed", false, "when true dependencies are read from the links precomputed by the cleaner instead of being computed from the spans")
 
 		v := viper.New()
 		v.SetEnvPrefix("JAEGER_POSTGRESQL")
@@ -267,6 +384,19 @@ func ProvideConfig() func() (Config, error) {
 	}
 }
 
+// buildSpansIndexes builds the missing indexes of the spans table on a
+// connection dedicated to it, as the advisory lock of the build belongs to the
+// connection it was taken on.
+func buildSpansIndexes(ctx context.Context, pool *pgxpool.Pool, logger *slog.Logger, opts store.SpansIndexOptions) ([]string, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection to build indexes: %w", err)
+	}
+	defer conn.Release()
+
+	return store.BuildSpansIndexes(ctx, conn.Conn(), logger, opts)
+}
+
 func main() {
 	fx.New(
 		fx.WithLogger(func(logger *slog.Logger) fxevent.Logger {
@@ -279,12 +409,146 @@ func main() {
 			ProvideSpanStoreReader(),
 			ProvideSpanStoreWriter(),
 			ProvideDependencyStoreReader(),
+			ProvideArchiveSpanStoreReader(),
+			ProvideArchiveSpanStoreWriter(),
+			ProvideBatchWriter(),
 			ProvideHandler(),
 			ProvideGRPCServer(),
 			ProvideAdminServer(),
 		),
-		fx.Invoke(func(srv *grpc.Server, handler *shared.GRPCHandler) error {
-			return handler.Register(srv)
+		fx.Invoke(func(srv *grpc.Server) {}),
+		fx.Invoke(func(cfg Config, conn *pgxpool.Pool, logger *slog.Logger, lc fx.Lifecycle) error {
+			interval, err := store.ParsePartitionInterval(cfg.Partitions.Interval)
+			if err != nil {
+				return err
+			}
+
+			q := sql.New(conn)
+			createPartitions := func(ctx context.Context) error {
+				created, err := store.CreatePartitions(ctx, q, time.Now(), interval, cfg.Partitions.Lookahead)
+				if len(created) > 0 {
+					logger.Info("created partitions", "partitions", created)
+				}
+
+				return err
+			}
+
+			// the partitions for the spans that are about to be written must
+			// exist before the grpc server starts accepting them.
+			{
+				ctx, cancelFn := context.WithTimeout(context.Background(), time.Minute)
+				defer cancelFn()
+
+				if err := createPartitions(ctx); err != nil {
+					return err
+				}
+			}
+
+			ctx, cancelFn := context.WithCancel(context.Background())
+			lc.Append(fx.StopHook(cancelFn))
+
+			go func() {
+				ticker := time.NewTicker(time.Minute * 10)
+				defer ticker.Stop()
+
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						if err := createPartitions(ctx); err != nil {
+							logger.Error("failed to create partitions", "err", err)
+						}
+					}
+				}
+			}()
+
+			return nil
+		}),
+		fx.Invoke(func(cfg Config, pool *pgxpool.Pool, logger *slog.Logger, lc fx.Lifecycle) {
+			ctx, cancelFn := context.WithCancel(context.Background())
+			lc.Append(fx.StopHook(cancelFn))
+
+			// the partitions created afterwards get their indexes when they
+			// are created, so the job stops once every partition has them.
+			go func() {
+				opts := store.SpansIndexOptions{
+					Logs: cfg.TagIndex.Logs,
+				}
+
+				for {
+					built, err := buildSpansIndexes(ctx, pool, logger, opts)
+					if err == nil {
+						if len(built) > 0 {
+							logger.Info("finished building indexes", "indexes", built)
+						}
+						return
+					}
+
+					if ctx.Err() != nil {
+						return
+					}
+
+					// the other jaeger-postgresql may stop before it is done, so
+					// the build is tried again later.
+					if errors.Is(err, store.ErrSpansIndexesLocked) {
+						logger.Info("skipped building indexes, another jaeger-postgresql is building them")
+					} else {
+						logger.Error("failed to build indexes", "indexes", built, "err", err)
+					}
+
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Minute * 10):
+					}
+				}
+			}()
+		}),
+		fx.Invoke(func(cfg Config, conn *pgxpool.Pool, logger *slog.Logger, lc fx.Lifecycle) error {
+			if !cfg.Reencode.Enabled {
+				return nil
+			}
+
+			if cfg.Reencode.Interval <= 0 {
+				return fmt.Errorf("invalid reencode.interval given: %s", cfg.Reencode.Interval)
+			}
+
+			ctx, cancelFn := context.WithCancel(context.Background())
+			lc.Append(fx.StopHook(cancelFn))
+
+			// spans are written in the current encoding version, but a writer
+			// of an older jaeger-postgresql may still write spans in an older
+			// one, so the job runs again every interval. Once every span has
+			// been re-encoded, a run only reads an empty index and the archived
+			// spans, which are few.
+			go func() {
+				q := sql.New(conn)
+				opts := store.ReencodeOptions{
+					BatchSize: cfg.Reencode.BatchSize,
+					Pause:     cfg.Reencode.Pause,
+				}
+
+				ticker := time.NewTicker(cfg.Reencode.Interval)
+				defer ticker.Stop()
+
+				for {
+					count, err := store.ReencodeSpans(ctx, q, logger, opts)
+					if err != nil && ctx.Err() == nil {
+						logger.Error("failed to re-encode spans", "spans", count, "err", err)
+					} else if count > 0 {
+						logger.Info("finished re-encoding spans", "spans", count, "encoding_version", store.CurrentEncodingVersion)
+					}
+
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+				}
+			}()
+
+			return nil
 		}),
 		fx.Invoke(func(conn *pgxpool.Pool, logger *slog.Logger, lc fx.Lifecycle) {
 			ctx, cancelFn := context.WithCancel(context.Background())
@@ -9,6 +9,7 @@ require (
 	github.com/jaegertracing/jaeger v1.55.0
 	github.com/pressly/goose/v3 v3.24.1
 	github.com/prometheus/client_golang v1.19.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.18.2
 	github.com/stretchr/testify v1.10.0
@@ -4,3 +4,53 @@
 // source: copyfrom.go
 
 package sql
+
+import (
+	"context"
+)
+
+// iteratorForCopySpans implements pgx.CopyFromSource.
+type iteratorForCopySpans struct {
+	rows                 []CopySpansParams
+	skippedFirstNextCall bool
+}
+
+func (r *iteratorForCopySpans) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	if !r.skippedFirstNextCall {
+		r.skippedFirstNextCall = true
+		return true
+	}
+	r.rows = r.rows[1:]
+	return len(r.rows) > 0
+}
+
+func (r iteratorForCopySpans) Values() ([]interface{}, error) {
+	return []interface{}{
+		r.rows[0].SpanID,
+		r.rows[0].TraceID,
+		r.rows[0].OperationID,
+		r.rows[0].Flags,
+		r.rows[0].StartTime,
+		r.rows[0].Duration,
+		r.rows[0].Tags,
+		r.rows[0].ServiceID,
+		r.rows[0].ProcessID,
+		r.rows[0].ProcessTags,
+		r.rows[0].Warnings,
+		r.rows[0].Kind,
+		r.rows[0].Logs,
+		r.rows[0].Refs,
+		r.rows[0].EncodingVersion,
+	}, nil
+}
+
+func (r iteratorForCopySpans) Err() error {
+	return nil
+}
+
+func (q *Queries) CopySpans(ctx context.Context, arg []CopySpansParams) (int64, error) {
+	return q.db.CopyFrom(ctx, []string{"spans"}, []string{"span_id", "trace_id", "operation_id", "flags", "start_time", "duration", "tags", "service_id", "process_id", "process_tags", "warnings", "kind", "logs", "refs", "encoding_version"}, &iteratorForCopySpans{rows: arg})
+}
@@ -0,0 +1,12 @@
+-- +goose Up
+
+-- tag searches from the jaeger ui are always scoped to a service and a time
+-- window. This index lets the planner narrow the candidate spans down to that
+-- window before the tag predicates are evaluated against the jsonb columns. It
+-- does not serve the tag predicates themselves, which are scanned for within
+-- the window until the GIN indexes of 013_tag_gin_indexes.sql are built.
+CREATE INDEX IF NOT EXISTS idx_spans_service_start_time ON spans (service_id, start_time);
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_spans_service_start_time;
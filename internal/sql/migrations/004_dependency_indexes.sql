@@ -0,0 +1,9 @@
+-- +goose Up
+
+-- dependencies are computed by resolving each span reference to its parent
+-- span, which is looked up by both its trace id and its span id.
+CREATE INDEX IF NOT EXISTS idx_spans_trace_id_span_id ON spans (trace_id, span_id);
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_spans_trace_id_span_id;
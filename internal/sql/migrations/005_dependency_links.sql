@@ -0,0 +1,18 @@
+-- +goose Up
+
+-- dependency_links holds the service dependency graph precomputed by the
+-- cleaner. Each row counts the calls from the parent to the child service for
+-- the hour starting at bucket.
+CREATE TABLE dependency_links (
+  bucket TIMESTAMP NOT NULL,
+  parent TEXT NOT NULL,
+  child TEXT NOT NULL,
+  call_count BIGINT NOT NULL,
+  error_count BIGINT NOT NULL,
+
+  PRIMARY KEY (bucket, parent, child)
+);
+
+-- +goose Down
+
+DROP TABLE dependency_links;
@@ -0,0 +1,30 @@
+-- +goose Up
+
+-- archived_spans holds the traces that have been archived from the jaeger ui.
+-- It is never pruned by the cleaner, so unlike spans it stores the service
+-- and operation names inline rather than referencing the services and
+-- operations tables.
+CREATE TABLE archived_spans (
+  hack_id BIGSERIAL PRIMARY KEY,
+  span_id BYTEA NOT NULL,
+  trace_id BYTEA NOT NULL,
+  operation_name TEXT NOT NULL,
+  flags BIGINT NOT NULL,
+  start_time TIMESTAMP NOT NULL,
+  duration INTERVAL NOT NULL,
+  tags JSONB,
+  service_name TEXT NOT NULL,
+  process_id TEXT NOT NULL,
+  process_tags JSONB NOT NULL,
+  warnings TEXT[],
+  logs JSONB,
+  kind SPANKIND NOT NULL,
+  refs JSONB NOT NULL,
+
+  -- archiving the same trace twice must not duplicate its spans.
+  UNIQUE (trace_id, span_id, kind)
+);
+
+-- +goose Down
+
+DROP TABLE archived_spans;
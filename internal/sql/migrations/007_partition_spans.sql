@@ -0,0 +1,193 @@
+-- +goose Up
+
+-- spans is turned into a table that is range partitioned on start_time, so
+-- that old spans can be removed by dropping whole partitions rather than by
+-- deleting them row by row. Rather than copying every span into the new table,
+-- the existing table is attached as its first partition. It covers every span
+-- started before the day after tomorrow, and the partitions that follow it are
+-- created by jaeger-postgresql.
+
+ALTER TABLE spans RENAME TO spans_legacy;
+ALTER INDEX spans_pkey RENAME TO spans_legacy_pkey;
+ALTER INDEX idx_trace_id RENAME TO spans_legacy_trace_id_idx;
+ALTER INDEX idx_spans_operation_service RENAME TO spans_legacy_operation_service_idx;
+ALTER INDEX idx_spans_start_duration RENAME TO spans_legacy_start_duration_idx;
+ALTER INDEX idx_spans_start_time RENAME TO spans_legacy_start_time_idx;
+ALTER INDEX idx_spans_duration RENAME TO spans_legacy_duration_idx;
+ALTER INDEX idx_spans_service_start_time RENAME TO spans_legacy_service_start_time_idx;
+ALTER INDEX idx_spans_trace_id_span_id RENAME TO spans_legacy_trace_id_span_id_idx;
+
+-- the hack_id sequence must outlive the legacy partition, which is eventually
+-- dropped by the cleaner.
+ALTER SEQUENCE spans_hack_id_seq OWNED BY NONE;
+
+CREATE TABLE spans (
+  hack_id BIGINT NOT NULL DEFAULT nextval('spans_hack_id_seq'),
+  span_id BYTEA NOT NULL,
+  trace_id BYTEA NOT NULL,
+  operation_id BIGINT REFERENCES operations(id) NOT NULL,
+  flags BIGINT NOT NULL,
+  start_time TIMESTAMP NOT NULL,
+  duration INTERVAL NOT NULL,
+  tags JSONB,
+  service_id BIGINT REFERENCES services(id) NOT NULL,
+  process_id TEXT NOT NULL,
+  process_tags JSONB NOT NULL,
+  warnings TEXT[],
+  logs JSONB,
+  kind SPANKIND NOT NULL,
+  refs JSONB NOT NULL,
+
+  PRIMARY KEY (hack_id, start_time)
+) PARTITION BY RANGE (start_time);
+
+ALTER SEQUENCE spans_hack_id_seq OWNED BY spans.hack_id;
+
+CREATE INDEX idx_trace_id ON spans (trace_id);
+CREATE INDEX idx_spans_operation_service ON spans (operation_id, service_id);
+CREATE INDEX idx_spans_start_duration ON spans (start_time, duration);
+CREATE INDEX idx_spans_start_time ON spans (start_time);
+CREATE INDEX idx_spans_duration ON spans (duration);
+CREATE INDEX idx_spans_service_start_time ON spans (service_id, start_time);
+CREATE INDEX idx_spans_trace_id_span_id ON spans (trace_id, span_id);
+
+-- +goose StatementBegin
+DO $$
+DECLARE
+  legacy_end TIMESTAMP;
+BEGIN
+  SELECT date_trunc('day', greatest(max(start_time), now()::TIMESTAMP)) + INTERVAL '2 days'
+  INTO legacy_end
+  FROM spans_legacy;
+
+  EXECUTE format('ALTER TABLE spans ATTACH PARTITION spans_legacy FOR VALUES FROM (MINVALUE) TO (%L)', legacy_end);
+END
+$$;
+-- +goose StatementEnd
+
+-- spans_default holds the spans started outside of every partition, such as
+-- spans from clients whose clock is far ahead or behind, so that writing them
+-- does not fail. It is meant to stay small: the spans it holds are moved to
+-- their partition once it is created, and the old ones are deleted along with
+-- the expired partitions.
+CREATE TABLE spans_default PARTITION OF spans DEFAULT;
+
+-- create_spans_partition creates the partition of spans covering the given
+-- range, moving into it the spans of the range held by spans_default. It
+-- returns the name of the partition, or NULL when the range is already covered
+-- by another partition.
+-- +goose StatementBegin
+CREATE FUNCTION create_spans_partition(partition_start TIMESTAMP, partition_end TIMESTAMP) RETURNS TEXT AS $$
+DECLARE
+  partition_name TEXT := 'spans_' || to_char(partition_start, 'YYYYMMDDHH24');
+BEGIN
+  IF EXISTS (SELECT 1 FROM pg_class WHERE relname = partition_name) THEN
+    RETURN NULL;
+  END IF;
+
+  -- a partition cannot be created while spans_default holds spans of its
+  -- range, so they are set aside until it exists.
+  IF EXISTS (SELECT 1 FROM spans_default WHERE start_time >= partition_start AND start_time < partition_end) THEN
+    EXECUTE 'CREATE TEMPORARY TABLE spans_moved (LIKE spans) ON COMMIT DROP';
+    EXECUTE 'WITH moved AS (
+      DELETE FROM spans_default WHERE start_time >= $1 AND start_time < $2 RETURNING *
+    ) INSERT INTO spans_moved SELECT * FROM moved' USING partition_start, partition_end;
+  END IF;
+
+  EXECUTE format(
+    'CREATE TABLE %I PARTITION OF spans FOR VALUES FROM (%L) TO (%L)',
+    partition_name,
+    partition_start,
+    partition_end
+  );
+
+  IF to_regclass('pg_temp.spans_moved') IS NOT NULL THEN
+    EXECUTE 'INSERT INTO spans SELECT * FROM spans_moved';
+    EXECUTE 'DROP TABLE spans_moved';
+  END IF;
+
+  RETURN partition_name;
+EXCEPTION
+  -- another instance created the partition concurrently.
+  WHEN duplicate_table THEN
+    RETURN NULL;
+  -- the range overlaps with an existing partition, such as spans_legacy.
+  WHEN invalid_object_definition THEN
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- drop_spans_partitions detaches and drops every partition of spans whose range
+-- ends at or before prune_before, and deletes the spans of spans_default
+-- started before it. It returns the names of the dropped partitions.
+-- +goose StatementBegin
+CREATE FUNCTION drop_spans_partitions(prune_before TIMESTAMP) RETURNS SETOF TEXT AS $$
+DECLARE
+  expired RECORD;
+BEGIN
+  FOR expired IN
+    SELECT partitions.name
+    FROM (
+      SELECT
+        child.relname AS name,
+        substring(pg_get_expr(child.relpartbound, child.oid) FROM 'TO \(''([^'']+)''\)')::TIMESTAMP AS partition_end
+      FROM pg_inherits
+        INNER JOIN pg_class AS parent ON (pg_inherits.inhparent = parent.oid)
+        INNER JOIN pg_class AS child ON (pg_inherits.inhrelid = child.oid)
+      WHERE parent.relname = 'spans'
+    ) AS partitions
+    WHERE partitions.partition_end <= prune_before
+    ORDER BY partitions.partition_end ASC
+  LOOP
+    EXECUTE format('ALTER TABLE spans DETACH PARTITION %I', expired.name);
+    EXECUTE format('DROP TABLE %I', expired.name);
+    RETURN NEXT expired.name;
+  END LOOP;
+
+  DELETE FROM spans_default WHERE start_time < prune_before;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+
+-- reverting copies every span back into a regular table.
+
+DROP FUNCTION drop_spans_partitions(TIMESTAMP);
+DROP FUNCTION create_spans_partition(TIMESTAMP, TIMESTAMP);
+
+ALTER SEQUENCE spans_hack_id_seq OWNED BY NONE;
+
+CREATE TABLE spans_unpartitioned (
+  hack_id BIGINT PRIMARY KEY DEFAULT nextval('spans_hack_id_seq'),
+  span_id BYTEA NOT NULL,
+  trace_id BYTEA NOT NULL,
+  operation_id BIGINT REFERENCES operations(id) NOT NULL,
+  flags BIGINT NOT NULL,
+  start_time TIMESTAMP NOT NULL,
+  duration INTERVAL NOT NULL,
+  tags JSONB,
+  service_id BIGINT REFERENCES services(id) NOT NULL,
+  process_id TEXT NOT NULL,
+  process_tags JSONB NOT NULL,
+  warnings TEXT[],
+  logs JSONB,
+  kind SPANKIND NOT NULL,
+  refs JSONB NOT NULL
+);
+
+INSERT INTO spans_unpartitioned SELECT * FROM spans;
+
+DROP TABLE spans;
+
+ALTER TABLE spans_unpartitioned RENAME TO spans;
+ALTER SEQUENCE spans_hack_id_seq OWNED BY spans.hack_id;
+
+CREATE INDEX idx_trace_id ON spans (trace_id);
+CREATE INDEX idx_spans_operation_service ON spans (operation_id, service_id);
+CREATE INDEX idx_spans_start_duration ON spans (start_time, duration);
+CREATE INDEX idx_spans_start_time ON spans (start_time);
+CREATE INDEX idx_spans_duration ON spans (duration);
+CREATE INDEX idx_spans_service_start_time ON spans (service_id, start_time);
+CREATE INDEX idx_spans_trace_id_span_id ON spans (trace_id, span_id);
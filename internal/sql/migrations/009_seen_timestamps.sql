@@ -0,0 +1,42 @@
+-- +goose Up
+
+-- the writer bumps last_seen whenever it upserts a service or operation, which
+-- it does at most once a minute for each of them.
+ALTER TABLE services
+  ADD COLUMN first_seen TIMESTAMP NOT NULL DEFAULT LOCALTIMESTAMP,
+  ADD COLUMN last_seen TIMESTAMP NOT NULL DEFAULT LOCALTIMESTAMP;
+
+ALTER TABLE operations
+  ADD COLUMN first_seen TIMESTAMP NOT NULL DEFAULT LOCALTIMESTAMP,
+  ADD COLUMN last_seen TIMESTAMP NOT NULL DEFAULT LOCALTIMESTAMP;
+
+-- the services and operations that already exist are backfilled from their
+-- spans, so that the ones that stopped sending spans long ago are not seen as
+-- active. Those without spans are considered seen by this migration.
+UPDATE services
+SET first_seen = seen.first_seen, last_seen = seen.last_seen
+FROM (
+  SELECT service_id, MIN(start_time) AS first_seen, MAX(start_time) AS last_seen
+  FROM spans
+  GROUP BY service_id
+) AS seen
+WHERE seen.service_id = services.id;
+
+UPDATE operations
+SET first_seen = seen.first_seen, last_seen = seen.last_seen
+FROM (
+  SELECT operation_id, MIN(start_time) AS first_seen, MAX(start_time) AS last_seen
+  FROM spans
+  GROUP BY operation_id
+) AS seen
+WHERE seen.operation_id = operations.id;
+
+-- +goose Down
+
+ALTER TABLE operations
+  DROP COLUMN first_seen,
+  DROP COLUMN last_seen;
+
+ALTER TABLE services
+  DROP COLUMN first_seen,
+  DROP COLUMN last_seen;
@@ -0,0 +1,129 @@
+-- +goose NO TRANSACTION
+-- +goose Up
+
+-- trace and span ids used to be stored as little-endian 64 bit words, the
+-- high word of the trace id first. They are now stored in the big-endian
+-- layout of W3C trace context, so that encode(trace_id, 'hex') matches the
+-- trace id shown by jaeger. Converting between the two layouts reverses the
+-- bytes of every 64 bit word, which is its own inverse, so the same function
+-- is used to migrate up and down. Ids that are not made of whole words are
+-- left as they are.
+--
+-- The spans cannot tell which layout their ids are in, so every writer of an
+-- older jaeger-postgresql must be stopped before this migration runs: a span
+-- such a writer stores afterwards keeps the little-endian layout, and its
+-- trace cannot be found by its id.
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION swap_id_endianness(id BYTEA) RETURNS BYTEA AS $$
+  SELECT CASE WHEN length(id) > 0 AND length(id) % 8 = 0 THEN (
+    SELECT string_agg(substring(id FROM word * 8 + 8 - i FOR 1), ''::BYTEA ORDER BY word, i)
+    FROM generate_series(0, length(id) / 8 - 1) AS word, generate_series(0, 7) AS i
+  ) ELSE id END
+$$ LANGUAGE SQL IMMUTABLE STRICT;
+-- +goose StatementEnd
+
+-- swap_refs_endianness converts the ids of the span references, which are
+-- stored as [trace_id, span_id, ref_type] arrays of base64 encoded ids.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION swap_refs_endianness(refs JSONB) RETURNS JSONB AS $$
+  SELECT COALESCE(
+    jsonb_agg(
+      jsonb_build_array(
+        encode(swap_id_endianness(decode(ref->>0, 'base64')), 'base64'),
+        encode(swap_id_endianness(decode(ref->>1, 'base64')), 'base64'),
+        ref->2
+      )
+      ORDER BY position
+    ),
+    '[]'::JSONB
+  )
+  FROM jsonb_array_elements(refs) WITH ORDINALITY AS elements(ref, position)
+$$ LANGUAGE SQL IMMUTABLE STRICT;
+-- +goose StatementEnd
+
+-- big_endian_ids records which layout the ids are in, so that converting
+-- them again, which would restore the previous layout, is a no-op. It has at
+-- most one row, and no row while the ids are in the little-endian layout.
+CREATE TABLE IF NOT EXISTS big_endian_ids (
+  singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+  big_endian BOOLEAN NOT NULL
+);
+
+-- swap_ids_endianness converts the ids of spans and archived_spans to the
+-- big-endian layout, or back to the little-endian one when to_big_endian
+-- is false, in batches of batch_size spans, committing each batch, so that the
+-- tables are not rewritten in one long transaction holding the locks of every
+-- span. The ids_swapped column records the spans whose ids were converted, so
+-- that the conversion resumes where it stopped when the migration is
+-- interrupted. It is dropped in the transaction recording the new layout in
+-- big_endian_ids.
+--
+-- The migrations run when every jaeger-postgresql starts, so the conversion
+-- holds an advisory lock: a jaeger-postgresql starting while another one is
+-- converting the ids waits for it to finish, and then finds the ids already
+-- in the layout. It must be called outside of a transaction.
+-- +goose StatementBegin
+CREATE OR REPLACE PROCEDURE swap_ids_endianness(batch_size INT, to_big_endian BOOLEAN) AS $$
+DECLARE
+  first_id BIGINT;
+  last_id BIGINT;
+BEGIN
+  PERFORM pg_advisory_lock(hashtext('jaeger-postgresql:swap_ids_endianness'));
+
+  IF COALESCE((SELECT big_endian_ids.big_endian FROM big_endian_ids), FALSE) = to_big_endian THEN
+    PERFORM pg_advisory_unlock(hashtext('jaeger-postgresql:swap_ids_endianness'));
+    RETURN;
+  END IF;
+
+  ALTER TABLE spans ADD COLUMN IF NOT EXISTS ids_swapped BOOLEAN NOT NULL DEFAULT FALSE;
+  ALTER TABLE archived_spans ADD COLUMN IF NOT EXISTS ids_swapped BOOLEAN NOT NULL DEFAULT FALSE;
+  COMMIT;
+
+  SELECT MIN(hack_id), MAX(hack_id) INTO first_id, last_id FROM spans;
+  WHILE first_id <= last_id LOOP
+    UPDATE spans SET
+      trace_id = swap_id_endianness(trace_id),
+      span_id = swap_id_endianness(span_id),
+      refs = swap_refs_endianness(refs),
+      ids_swapped = TRUE
+    WHERE hack_id >= first_id AND hack_id < first_id + batch_size AND NOT ids_swapped;
+    COMMIT;
+
+    first_id := first_id + batch_size;
+  END LOOP;
+
+  SELECT MIN(hack_id), MAX(hack_id) INTO first_id, last_id FROM archived_spans;
+  WHILE first_id <= last_id LOOP
+    UPDATE archived_spans SET
+      trace_id = swap_id_endianness(trace_id),
+      span_id = swap_id_endianness(span_id),
+      refs = swap_refs_endianness(refs),
+      ids_swapped = TRUE
+    WHERE hack_id >= first_id AND hack_id < first_id + batch_size AND NOT ids_swapped;
+    COMMIT;
+
+    first_id := first_id + batch_size;
+  END LOOP;
+
+  ALTER TABLE archived_spans DROP COLUMN ids_swapped;
+  ALTER TABLE spans DROP COLUMN ids_swapped;
+  INSERT INTO big_endian_ids (big_endian) VALUES (to_big_endian)
+  ON CONFLICT (singleton) DO UPDATE SET big_endian = EXCLUDED.big_endian;
+  COMMIT;
+
+  PERFORM pg_advisory_unlock(hashtext('jaeger-postgresql:swap_ids_endianness'));
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CALL swap_ids_endianness(10000, TRUE);
+
+-- +goose Down
+
+CALL swap_ids_endianness(10000, FALSE);
+
+DROP PROCEDURE swap_ids_endianness(INT, BOOLEAN);
+DROP TABLE big_endian_ids;
+DROP FUNCTION swap_refs_endianness(JSONB);
+DROP FUNCTION swap_id_endianness(BYTEA);
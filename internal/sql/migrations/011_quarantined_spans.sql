@@ -0,0 +1,29 @@
+-- +goose Up
+
+-- quarantined_spans holds the spans that the verify mode of the cleaner found
+-- to be corrupt, along with the reason they were quarantined. They are moved
+-- out of spans so that they no longer fail the traces they belong to, while
+-- being kept around to be inspected or repaired.
+CREATE TABLE quarantined_spans (
+  hack_id BIGINT PRIMARY KEY,
+  span_id BYTEA NOT NULL,
+  trace_id BYTEA NOT NULL,
+  operation_id BIGINT NOT NULL,
+  flags BIGINT NOT NULL,
+  start_time TIMESTAMP NOT NULL,
+  duration INTERVAL NOT NULL,
+  tags JSONB,
+  service_id BIGINT NOT NULL,
+  process_id TEXT NOT NULL,
+  process_tags JSONB NOT NULL,
+  warnings TEXT[],
+  logs JSONB,
+  kind SPANKIND NOT NULL,
+  refs JSONB NOT NULL,
+  reason TEXT NOT NULL,
+  quarantined_at TIMESTAMP NOT NULL DEFAULT LOCALTIMESTAMP
+);
+
+-- +goose Down
+
+DROP TABLE quarantined_spans;
@@ -0,0 +1,15 @@
+-- +goose Up
+
+-- encoding_version records the layout of the jsonb encoded tags, logs and
+-- refs of every span, so that the layout can evolve while the spans written
+-- in an older layout stay readable. The spans written so far all use the first
+-- layout. Adding a column with a constant default does not rewrite the tables.
+ALTER TABLE spans ADD COLUMN encoding_version SMALLINT NOT NULL DEFAULT 1;
+ALTER TABLE archived_spans ADD COLUMN encoding_version SMALLINT NOT NULL DEFAULT 1;
+ALTER TABLE quarantined_spans ADD COLUMN encoding_version SMALLINT NOT NULL DEFAULT 1;
+
+-- +goose Down
+
+ALTER TABLE quarantined_spans DROP COLUMN encoding_version;
+ALTER TABLE archived_spans DROP COLUMN encoding_version;
+ALTER TABLE spans DROP COLUMN encoding_version;
@@ -0,0 +1,45 @@
+-- +goose Up
+
+-- spans written in the second encoding version store their tags as objects of
+-- their keys to their typed values, with logs as [timestamp, fields] arrays
+-- whose fields are encoded the same way, for example:
+--
+--   {"error": true, "http.status_code": 500, "peer.service": "billing"}
+--
+-- These GIN indexes let the containment operator look spans up by tag, both
+-- from the tag searches of the jaeger ui and from ad-hoc queries such as:
+--
+--   SELECT trace_id FROM spans WHERE tags @> '{"http.status_code": 500}';
+--
+-- jsonb_path_ops indexes are smaller and faster than the default operator
+-- class, but only support the containment and jsonpath operators.
+--
+-- Building an index on the whole of spans would block the writers until it is
+-- built, so the indexes are only created on spans itself here. They stay
+-- invalid until jaeger-postgresql builds the index of every existing partition
+-- concurrently and attaches it, see store.BuildSpansIndexes. The partitions
+-- created afterwards get their indexes when they are created.
+--
+-- The GIN index of the logs is not created here, as it adds to the cost of
+-- every write. It is built when jaeger-postgresql runs with
+-- --tag-index.logs, which the tag searches need to use the GIN indexes.
+CREATE INDEX IF NOT EXISTS idx_spans_tags ON ONLY spans USING GIN (tags jsonb_path_ops);
+CREATE INDEX IF NOT EXISTS idx_spans_process_tags ON ONLY spans USING GIN (process_tags jsonb_path_ops);
+
+-- spans written in the first encoding version store their tags as arrays of
+-- [key, type, value] arrays instead. The same GIN indexes find them by
+-- containment of a [key, value] array, which matches the tags in any order and
+-- is checked against the key and the value of each tag afterwards, see
+-- store.EncodeTagIndexCandidates.
+--
+-- This index lets the re-encoding job find the spans of the first encoding
+-- version without scanning the table, and becomes empty once every span has
+-- been re-encoded.
+CREATE INDEX IF NOT EXISTS idx_spans_encoding_version_1 ON ONLY spans (hack_id) WHERE encoding_version < 2;
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_spans_encoding_version_1;
+DROP INDEX IF EXISTS idx_spans_logs;
+DROP INDEX IF EXISTS idx_spans_process_tags;
+DROP INDEX IF EXISTS idx_spans_tags;
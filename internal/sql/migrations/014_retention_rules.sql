@@ -0,0 +1,63 @@
+-- +goose Up
+
+-- retention_prune_before returns the time before which a span is pruned by the
+-- cleaner: the prune_before of the first retention rule matching the span, or
+-- default_prune_before when none does. The rules are given as parallel arrays,
+-- one element per rule, in the order they are tried. An empty service name,
+-- operation name or tag key matches every span. A tag matches when the
+-- [key, type, value] arrays of the first encoding version hold the key and the
+-- value, or when the tags contain one of the JSON objects of tag_candidates,
+-- which are the typed values the tag may be encoded as in the objects of the
+-- second encoding version.
+--
+-- It is shared by the deletion and the report of the cleaner, so that the
+-- report always shows what the deletion would remove.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION retention_prune_before(
+  span_service_name TEXT,
+  span_operation_name TEXT,
+  span_tags JSONB,
+  span_process_tags JSONB,
+  rule_service_names TEXT[],
+  rule_operation_names TEXT[],
+  rule_tag_keys TEXT[],
+  rule_tag_values TEXT[],
+  rule_tag_candidates TEXT[],
+  rule_prune_befores TIMESTAMP[],
+  default_prune_before TIMESTAMP
+) RETURNS TIMESTAMP AS $$
+  SELECT COALESCE((
+    SELECT rule.prune_before
+    FROM unnest(
+      rule_service_names,
+      rule_operation_names,
+      rule_tag_keys,
+      rule_tag_values,
+      rule_tag_candidates,
+      rule_prune_befores
+    ) WITH ORDINALITY AS rule(service_name, operation_name, tag_key, tag_value, tag_candidates, prune_before, position)
+    WHERE
+      (rule.service_name = '' OR rule.service_name = span_service_name) AND
+      (rule.operation_name = '' OR rule.operation_name = span_operation_name) AND
+      (rule.tag_key = '' OR EXISTS (
+        SELECT 1
+        FROM jsonb_array_elements(CASE jsonb_typeof(span_tags) WHEN 'array' THEN span_tags ELSE '[]'::JSONB END) AS kv
+        WHERE kv->>0 = rule.tag_key AND kv->>2 = rule.tag_value
+      ) OR EXISTS (
+        SELECT 1
+        FROM jsonb_array_elements(CASE jsonb_typeof(span_process_tags) WHEN 'array' THEN span_process_tags ELSE '[]'::JSONB END) AS kv
+        WHERE kv->>0 = rule.tag_key AND kv->>2 = rule.tag_value
+      ) OR EXISTS (
+        SELECT 1
+        FROM jsonb_array_elements(COALESCE(rule.tag_candidates, '[]')::JSONB) AS candidate(value)
+        WHERE span_tags @> candidate.value OR span_process_tags @> candidate.value
+      ))
+    ORDER BY rule.position ASC
+    LIMIT 1
+  ), default_prune_before)
+$$ LANGUAGE SQL IMMUTABLE PARALLEL SAFE;
+-- +goose StatementEnd
+
+-- +goose Down
+
+DROP FUNCTION IF EXISTS retention_prune_before(TEXT, TEXT, JSONB, JSONB, TEXT[], TEXT[], TEXT[], TEXT[], TEXT[], TIMESTAMP[], TIMESTAMP);
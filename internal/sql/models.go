@@ -58,32 +58,85 @@ func (ns NullSpankind) Value() (driver.Value, error) {
 	return string(ns.Spankind), nil
 }
 
+type ArchivedSpan struct {
+	HackID          int64
+	SpanID          []byte
+	TraceID         []byte
+	OperationName   string
+	Flags           int64
+	StartTime       pgtype.Timestamp
+	Duration        pgtype.Interval
+	Tags            []byte
+	ServiceName     string
+	ProcessID       string
+	ProcessTags     []byte
+	Warnings        []string
+	Logs            []byte
+	Kind            Spankind
+	Refs            []byte
+	EncodingVersion int16
+}
+
+type DependencyLink struct {
+	Bucket     pgtype.Timestamp
+	Parent     string
+	Child      string
+	CallCount  int64
+	ErrorCount int64
+}
+
 type Operation struct {
 	ID        int64
 	Name      string
 	ServiceID int64
 	Kind      Spankind
+	FirstSeen pgtype.Timestamp
+	LastSeen  pgtype.Timestamp
+}
+
+type QuarantinedSpan struct {
+	HackID          int64
+	SpanID          []byte
+	TraceID         []byte
+	OperationID     int64
+	Flags           int64
+	StartTime       pgtype.Timestamp
+	Duration        pgtype.Interval
+	Tags            []byte
+	ServiceID       int64
+	ProcessID       string
+	ProcessTags     []byte
+	Warnings        []string
+	Logs            []byte
+	Kind            Spankind
+	Refs            []byte
+	Reason          string
+	QuarantinedAt   pgtype.Timestamp
+	EncodingVersion int16
 }
 
 type Service struct {
-	ID   int64
-	Name string
+	ID        int64
+	Name      string
+	FirstSeen pgtype.Timestamp
+	LastSeen  pgtype.Timestamp
 }
 
 type Span struct {
-	HackID      int64
-	SpanID      []byte
-	TraceID     []byte
-	OperationID int64
-	Flags       int64
-	StartTime   pgtype.Timestamp
-	Duration    pgtype.Interval
-	Tags        []byte
-	ServiceID   int64
-	ProcessID   string
-	ProcessTags []byte
-	Warnings    []string
-	Logs        []byte
-	Kind        Spankind
-	Refs        []byte
+	HackID          int64
+	SpanID          []byte
+	TraceID         []byte
+	OperationID     int64
+	Flags           int64
+	StartTime       pgtype.Timestamp
+	Duration        pgtype.Interval
+	Tags            []byte
+	ServiceID       int64
+	ProcessID       string
+	ProcessTags     []byte
+	Warnings        []string
+	Logs            []byte
+	Kind            Spankind
+	Refs            []byte
+	EncodingVersion int16
 }
@@ -2,26 +2,98 @@
 SELECT operations.name, operations.kind
 FROM operations
   INNER JOIN services ON (operations.service_id = services.id)
-WHERE services.name = sqlc.arg(service_name)::VARCHAR
+WHERE
+  services.name = sqlc.arg(service_name)::VARCHAR AND
+  (operations.kind::TEXT = sqlc.arg(kind)::TEXT OR sqlc.arg(kind_enable_filter)::BOOLEAN = FALSE) AND
+  (operations.last_seen >= LOCALTIMESTAMP - sqlc.arg(lookback)::INTERVAL OR sqlc.arg(lookback_enable_filter)::BOOLEAN = FALSE)
 ORDER BY operations.name ASC;
 
 -- name: GetServices :many
 SELECT services.name
 FROM services
+WHERE
+  (services.last_seen >= LOCALTIMESTAMP - sqlc.arg(lookback)::INTERVAL OR sqlc.arg(lookback_enable_filter)::BOOLEAN = FALSE)
 ORDER BY services.name ASC;
 
--- -- name: GetDependencies :many
--- SELECT
---     COUNT(*) AS call_count,
---     source_services.name as parent,
---     child_services.name as child,
---     '' as source
--- FROM spanrefs
---     INNER JOIN spans AS source_spans ON (source_spans.span_id = spanrefs.source_span_id)
---     INNER JOIN spans AS child_spans ON (child_spans.span_id = spanrefs.child_span_id)
---     INNER JOIN services AS source_services ON (source_spans.service_id = source_services.id)
---     INNER JOIN services AS child_services ON (child_spans.service_id = child_services.id)
--- GROUP BY source_services.name, child_services.name;
+-- name: GetDependencies :many
+SELECT
+  parent_services.name AS parent,
+  child_services.name AS child,
+  COUNT(*)::BIGINT AS call_count
+FROM spans AS child_spans
+  CROSS JOIN LATERAL jsonb_array_elements(child_spans.refs) AS ref
+  INNER JOIN spans AS parent_spans ON (
+    parent_spans.trace_id = decode(ref->>0, 'base64') AND
+    parent_spans.span_id = decode(ref->>1, 'base64')
+  )
+  INNER JOIN services AS parent_services ON (parent_spans.service_id = parent_services.id)
+  INNER JOIN services AS child_services ON (child_spans.service_id = child_services.id)
+WHERE
+  child_spans.start_time >= sqlc.arg(start_time)::TIMESTAMP AND
+  child_spans.start_time <= sqlc.arg(end_time)::TIMESTAMP AND
+  parent_spans.service_id <> child_spans.service_id
+GROUP BY parent_services.name, child_services.name
+ORDER BY parent_services.name, child_services.name;
+
+-- name: AggregateDependencyLinks :execrows
+INSERT INTO dependency_links (bucket, parent, child, call_count, error_count)
+SELECT
+  date_trunc('hour', child_spans.start_time) AS bucket,
+  parent_services.name AS parent,
+  child_services.name AS child,
+  COUNT(*) AS call_count,
+  COUNT(*) FILTER (
+    WHERE EXISTS (
+      SELECT 1
+      FROM jsonb_array_elements(CASE jsonb_typeof(child_spans.tags) WHEN 'array' THEN child_spans.tags ELSE '[]'::JSONB END) AS kv
+      WHERE kv->>0 = 'error' AND kv->>2 = 'true'
+    ) OR
+    child_spans.tags @> '{"error": true}' OR
+    child_spans.tags @> '{"error": [true]}' OR
+    child_spans.tags @> '{"error": "true"}' OR
+    child_spans.tags @> '{"error": ["true"]}'
+  ) AS error_count
+FROM spans AS child_spans
+  CROSS JOIN LATERAL jsonb_array_elements(child_spans.refs) AS ref
+  INNER JOIN spans AS parent_spans ON (
+    parent_spans.trace_id = decode(ref->>0, 'base64') AND
+    parent_spans.span_id = decode(ref->>1, 'base64')
+  )
+  INNER JOIN services AS parent_services ON (parent_spans.service_id = parent_services.id)
+  INNER JOIN services AS child_services ON (child_spans.service_id = child_services.id)
+WHERE
+  child_spans.start_time >= sqlc.arg(start_time)::TIMESTAMP AND
+  child_spans.start_time < sqlc.arg(end_time)::TIMESTAMP AND
+  parent_spans.service_id <> child_spans.service_id
+GROUP BY 1, 2, 3
+ON CONFLICT (bucket, parent, child) DO UPDATE SET
+  call_count = EXCLUDED.call_count,
+  error_count = EXCLUDED.error_count;
+
+-- name: InsertDependencyLink :exec
+INSERT INTO dependency_links (bucket, parent, child, call_count, error_count)
+VALUES (
+  date_trunc('hour', sqlc.arg(bucket)::TIMESTAMP),
+  sqlc.arg(parent)::TEXT,
+  sqlc.arg(child)::TEXT,
+  sqlc.arg(call_count)::BIGINT,
+  sqlc.arg(error_count)::BIGINT
+)
+ON CONFLICT (bucket, parent, child) DO UPDATE SET
+  call_count = dependency_links.call_count + EXCLUDED.call_count,
+  error_count = dependency_links.error_count + EXCLUDED.error_count;
+
+-- name: GetDependencyLinks :many
+SELECT
+  dependency_links.parent,
+  dependency_links.child,
+  SUM(dependency_links.call_count)::BIGINT AS call_count
+FROM dependency_links
+WHERE
+  dependency_links.bucket >= date_trunc('hour', sqlc.arg(start_time)::TIMESTAMP) AND
+  dependency_links.bucket <= sqlc.arg(end_time)::TIMESTAMP
+GROUP BY dependency_links.parent, dependency_links.child
+ORDER BY dependency_links.parent, dependency_links.child;
 
 -- -- name: FindTraceIDs :many
 -- SELECT DISTINCT spans.trace_id
@@ -40,7 +112,9 @@ ORDER BY services.name ASC;
 
 -- name: UpsertService :exec
 INSERT INTO services (name) 
-VALUES (sqlc.arg(name)::VARCHAR) ON CONFLICT(name) DO NOTHING RETURNING id;
+VALUES (sqlc.arg(name)::VARCHAR)
+ON CONFLICT(name) DO UPDATE SET last_seen = LOCALTIMESTAMP
+RETURNING id;
 
 -- name: GetServiceID :one
 SELECT id
@@ -53,7 +127,9 @@ VALUES (
   sqlc.arg(name)::TEXT, 
   sqlc.arg(service_id)::BIGINT, 
   sqlc.arg(kind)::SPANKIND
-) ON CONFLICT(name, service_id, kind) DO NOTHING RETURNING id;
+)
+ON CONFLICT(name, service_id, kind) DO UPDATE SET last_seen = LOCALTIMESTAMP
+RETURNING id;
 
 -- name: GetOperationID :one
 SELECT id 
@@ -78,12 +154,35 @@ SELECT
   services.name as process_name,
   spans.process_tags as process_tags,
   spans.logs as logs,
-  spans.refs as refs
+  spans.refs as refs,
+  spans.encoding_version as encoding_version
 FROM spans 
   INNER JOIN operations ON (spans.operation_id = operations.id)
   INNER JOIN services ON (spans.service_id = services.id)
 WHERE trace_id = sqlc.arg(trace_id)::BYTEA;
 
+-- name: GetTracesSpans :many
+SELECT
+  spans.span_id as span_id,
+  spans.trace_id as trace_id,
+  operations.name as operation_name,
+  spans.flags as flags,
+  spans.start_time as start_time,
+  spans.duration as duration,
+  spans.tags as tags,
+  spans.process_id as process_id,
+  spans.warnings as warnings,
+  spans.kind as kind,
+  services.name as process_name,
+  spans.process_tags as process_tags,
+  spans.logs as logs,
+  spans.refs as refs,
+  spans.encoding_version as encoding_version
+FROM spans 
+  INNER JOIN operations ON (spans.operation_id = operations.id)
+  INNER JOIN services ON (spans.service_id = services.id)
+WHERE trace_id = ANY(sqlc.arg(trace_ids)::BYTEA[]);
+
 -- name: InsertSpan :one
 INSERT INTO spans (
   span_id,
@@ -99,7 +198,8 @@ INSERT INTO spans (
   warnings,
   kind,
   logs,
-  refs
+  refs,
+  encoding_version
 )
 VALUES(
   sqlc.arg(span_id)::BYTEA,
@@ -115,26 +215,310 @@ VALUES(
   sqlc.arg(warnings)::TEXT[],
   sqlc.arg(kind)::SPANKIND,
   sqlc.arg(logs)::JSONB,
-  sqlc.arg(refs)::JSONB
+  sqlc.arg(refs)::JSONB,
+  sqlc.arg(encoding_version)::SMALLINT
 )
 RETURNING spans.hack_id;
 
+-- name: InsertArchivedSpan :exec
+INSERT INTO archived_spans (
+  span_id,
+  trace_id,
+  operation_name,
+  flags,
+  start_time,
+  duration,
+  tags,
+  service_name,
+  process_id,
+  process_tags,
+  warnings,
+  kind,
+  logs,
+  refs,
+  encoding_version
+)
+VALUES(
+  sqlc.arg(span_id)::BYTEA,
+  sqlc.arg(trace_id)::BYTEA,
+  sqlc.arg(operation_name)::TEXT,
+  sqlc.arg(flags)::BIGINT,
+  sqlc.arg(start_time)::TIMESTAMP,
+  sqlc.arg(duration)::INTERVAL,
+  sqlc.arg(tags)::JSONB,
+  sqlc.arg(service_name)::TEXT,
+  sqlc.arg(process_id)::TEXT,
+  sqlc.arg(process_tags)::JSONB,
+  sqlc.arg(warnings)::TEXT[],
+  sqlc.arg(kind)::SPANKIND,
+  sqlc.arg(logs)::JSONB,
+  sqlc.arg(refs)::JSONB,
+  sqlc.arg(encoding_version)::SMALLINT
+)
+ON CONFLICT (trace_id, span_id, kind) DO NOTHING;
+
+-- name: GetArchivedTraceSpans :many
+SELECT
+  archived_spans.span_id as span_id,
+  archived_spans.trace_id as trace_id,
+  archived_spans.operation_name as operation_name,
+  archived_spans.flags as flags,
+  archived_spans.start_time as start_time,
+  archived_spans.duration as duration,
+  archived_spans.tags as tags,
+  archived_spans.process_id as process_id,
+  archived_spans.warnings as warnings,
+  archived_spans.kind as kind,
+  archived_spans.service_name as process_name,
+  archived_spans.process_tags as process_tags,
+  archived_spans.logs as logs,
+  archived_spans.refs as refs,
+  archived_spans.encoding_version as encoding_version
+FROM archived_spans
+WHERE trace_id = sqlc.arg(trace_id)::BYTEA;
+
+-- name: CopySpans :copyfrom
+INSERT INTO spans (
+  span_id,
+  trace_id,
+  operation_id,
+  flags,
+  start_time,
+  duration,
+  tags,
+  service_id,
+  process_id,
+  process_tags,
+  warnings,
+  kind,
+  logs,
+  refs,
+  encoding_version
+)
+VALUES (
+  sqlc.arg(span_id),
+  sqlc.arg(trace_id),
+  sqlc.arg(operation_id),
+  sqlc.arg(flags),
+  sqlc.arg(start_time),
+  sqlc.arg(duration),
+  sqlc.arg(tags),
+  sqlc.arg(service_id),
+  sqlc.arg(process_id),
+  sqlc.arg(process_tags),
+  sqlc.arg(warnings),
+  sqlc.arg(kind),
+  sqlc.arg(logs),
+  sqlc.arg(refs),
+  sqlc.arg(encoding_version)
+);
+
 -- name: CleanSpans :execrows
 
 DELETE FROM spans
 WHERE spans.start_time < sqlc.arg(prune_before)::TIMESTAMP;
 
+-- name: GetUnusedOperationIDs :many
+SELECT operations.id
+FROM operations
+WHERE NOT EXISTS (
+  SELECT 1
+  FROM spans
+  WHERE spans.operation_id = operations.id
+)
+ORDER BY operations.id ASC;
+
+-- name: DeleteUnusedOperation :execrows
+DELETE FROM operations
+WHERE
+  operations.id = sqlc.arg(id)::BIGINT AND
+  NOT EXISTS (
+    SELECT 1
+    FROM spans
+    WHERE spans.operation_id = operations.id
+  );
+
+-- name: GetUnusedServiceIDs :many
+SELECT services.id
+FROM services
+WHERE
+  NOT EXISTS (
+    SELECT 1
+    FROM operations
+    WHERE operations.service_id = services.id
+  ) AND
+  NOT EXISTS (
+    SELECT 1
+    FROM spans
+    WHERE spans.service_id = services.id
+  )
+ORDER BY services.id ASC;
+
+-- name: DeleteUnusedService :execrows
+DELETE FROM services
+WHERE
+  services.id = sqlc.arg(id)::BIGINT AND
+  NOT EXISTS (
+    SELECT 1
+    FROM operations
+    WHERE operations.service_id = services.id
+  ) AND
+  NOT EXISTS (
+    SELECT 1
+    FROM spans
+    WHERE spans.service_id = services.id
+  );
+
+-- name: CleanSpansBatch :execrows
+
+DELETE FROM spans
+WHERE (spans.hack_id, spans.start_time) IN (
+  SELECT expired.hack_id, expired.start_time
+  FROM spans AS expired
+  WHERE expired.start_time < sqlc.arg(prune_before)::TIMESTAMP
+  ORDER BY expired.start_time ASC
+  LIMIT sqlc.arg(batch_size)::INT
+);
+
+-- name: CleanSpansByRetentionBatch :execrows
+
+DELETE FROM spans
+WHERE (spans.hack_id, spans.start_time) IN (
+  SELECT expired.hack_id, expired.start_time
+  FROM spans AS expired
+    INNER JOIN services ON (services.id = expired.service_id)
+    INNER JOIN operations ON (operations.id = expired.operation_id)
+  WHERE
+    expired.start_time >= sqlc.arg(start_time_minimum)::TIMESTAMP AND
+    expired.start_time < sqlc.arg(start_time_maximum)::TIMESTAMP AND
+    expired.start_time < retention_prune_before(
+      services.name,
+      operations.name,
+      expired.tags,
+      expired.process_tags,
+      sqlc.arg(rule_service_names)::TEXT[],
+      sqlc.arg(rule_operation_names)::TEXT[],
+      sqlc.arg(rule_tag_keys)::TEXT[],
+      sqlc.arg(rule_tag_values)::TEXT[],
+      sqlc.arg(rule_tag_candidates)::TEXT[],
+      sqlc.arg(rule_prune_befores)::TIMESTAMP[],
+      sqlc.arg(default_prune_before)::TIMESTAMP
+    )
+  LIMIT sqlc.arg(batch_size)::INT
+);
+
+-- name: GetExpiredSpansReport :many
+
+SELECT
+  COALESCE(services.name, '')::TEXT AS service_name,
+  (GROUPING(services.name) = 1)::BOOLEAN AS total,
+  COUNT(*)::BIGINT AS spans,
+  COUNT(DISTINCT expired.trace_id)::BIGINT AS traces,
+  COALESCE(SUM(pg_column_size(expired.*)), 0)::BIGINT AS bytes
+FROM spans AS expired
+  INNER JOIN services ON (services.id = expired.service_id)
+  INNER JOIN operations ON (operations.id = expired.operation_id)
+WHERE
+  expired.start_time < sqlc.arg(start_time_maximum)::TIMESTAMP AND
+  expired.start_time < retention_prune_before(
+    services.name,
+    operations.name,
+    expired.tags,
+    expired.process_tags,
+    sqlc.arg(rule_service_names)::TEXT[],
+    sqlc.arg(rule_operation_names)::TEXT[],
+    sqlc.arg(rule_tag_keys)::TEXT[],
+    sqlc.arg(rule_tag_values)::TEXT[],
+    sqlc.arg(rule_tag_candidates)::TEXT[],
+    sqlc.arg(rule_prune_befores)::TIMESTAMP[],
+    sqlc.arg(default_prune_before)::TIMESTAMP
+  )
+GROUP BY GROUPING SETS ((services.name), ())
+ORDER BY GROUPING(services.name) ASC, services.name ASC;
+
+-- name: GetOldestSpanStartTime :one
+SELECT MIN(spans.start_time)::TIMESTAMP AS start_time
+FROM spans;
+
+-- name: GetOldestSpanStartTimeSince :one
+SELECT MIN(spans.start_time)::TIMESTAMP AS start_time
+FROM spans
+WHERE spans.start_time >= sqlc.arg(start_time_minimum)::TIMESTAMP;
+
 -- name: GetSpansDiskSize :one
 
-SELECT pg_total_relation_size('spans');
+WITH span_tables AS (
+    SELECT inhrelid::regclass::text AS relname
+    FROM pg_catalog.pg_class
+        JOIN pg_catalog.pg_inherits ON inhparent = oid
+    WHERE relname = 'spans'
+    UNION
+    SELECT 'spans'
+)
+SELECT sum(pg_total_relation_size(relname))
+FROM span_tables;
 
 -- name: GetSpansCount :one
 
-SELECT COUNT(*) FROM spans;
+WITH span_tables AS (
+    SELECT inhrelid::regclass::text AS relname
+    FROM pg_catalog.pg_class
+        JOIN pg_catalog.pg_inherits ON inhparent = oid
+    WHERE relname = 'spans'
+    UNION
+    SELECT 'spans'
+)
+SELECT sum(n_live_tup)
+FROM pg_stat_user_tables
+    JOIN span_tables USING (relname) ;
+
+-- name: VacuumSpans :exec
+
+-- VACUUM gives the pages emptied at the end of a table back to the disk, and
+-- ANALYZE refreshes the estimated number of spans.
+VACUUM (ANALYZE) spans;
+
+-- name: CreateSpansPartition :one
+SELECT COALESCE(create_spans_partition(
+  sqlc.arg(partition_start)::TIMESTAMP,
+  sqlc.arg(partition_end)::TIMESTAMP
+), '')::TEXT AS partition_name;
+
+-- name: DropSpansPartitions :many
+SELECT dropped.partition_name::TEXT AS partition_name
+FROM drop_spans_partitions(sqlc.arg(prune_before)::TIMESTAMP) AS dropped(partition_name);
+
+-- name: GetSpansPartitionsWithoutIndex :many
+SELECT
+  pg_namespace.nspname::TEXT AS schema_name,
+  pg_class.relname::TEXT AS partition_name
+FROM pg_catalog.pg_inherits AS partitions
+  INNER JOIN pg_catalog.pg_class ON (pg_class.oid = partitions.inhrelid)
+  INNER JOIN pg_catalog.pg_namespace ON (pg_namespace.oid = pg_class.relnamespace)
+WHERE
+  partitions.inhparent = 'spans'::regclass AND
+  NOT EXISTS (
+    SELECT 1
+    FROM pg_catalog.pg_inherits AS indexes
+      INNER JOIN pg_catalog.pg_index ON (pg_index.indexrelid = indexes.inhrelid)
+    WHERE
+      indexes.inhparent = sqlc.arg(index_name)::TEXT::regclass AND
+      pg_index.indrelid = partitions.inhrelid
+  )
+ORDER BY pg_class.relname ASC;
 
 -- name: FindTraceIDs :many
 
-SELECT DISTINCT spans.trace_id as trace_id
+-- the matching spans are read from the most recent one, a page of at most
+-- span_limit spans at a time, so that a search stops as soon as its caller
+-- has found enough distinct traces instead of aggregating every match. The
+-- next page starts after the last span of the previous one, given by
+-- cursor_start_time and cursor_hack_id, and span_limit is not applied when it
+-- is zero.
+SELECT
+  spans.trace_id as trace_id,
+  spans.start_time as start_time,
+  spans.hack_id as hack_id
 FROM spans
     INNER JOIN operations ON (operations.id = spans.operation_id)
     INNER JOIN services ON (services.id = spans.service_id)
@@ -144,5 +528,165 @@ WHERE
     (start_time >= sqlc.arg(start_time_minimum)::TIMESTAMP OR sqlc.arg(start_time_minimum_enable_filter)::BOOLEAN = FALSE) AND
     (start_time <= sqlc.arg(start_time_maximum)::TIMESTAMP OR sqlc.arg(start_time_maximum_enable_filter)::BOOLEAN = FALSE) AND
     (duration >= sqlc.arg(duration_minimum)::INTERVAL OR sqlc.arg(duration_minimum_enable_filter)::BOOLEAN = FALSE) AND
-    (duration <= sqlc.arg(duration_maximum)::INTERVAL OR sqlc.arg(duration_maximum_enable_filter)::BOOLEAN = FALSE)
-LIMIT sqlc.arg(num_traces);
\ No newline at end of file
+    (duration <= sqlc.arg(duration_maximum)::INTERVAL OR sqlc.arg(duration_maximum_enable_filter)::BOOLEAN = FALSE) AND
+    (
+      sqlc.arg(tag_index_enable_filter)::BOOLEAN = FALSE OR
+      spans.tags @> ANY(sqlc.arg(tag_index_candidates)::TEXT[]::JSONB[]) OR
+      spans.process_tags @> ANY(sqlc.arg(tag_index_candidates)::TEXT[]::JSONB[]) OR
+      spans.logs @> ANY(sqlc.arg(tag_index_log_candidates)::TEXT[]::JSONB[])
+    ) AND
+    NOT EXISTS (
+      SELECT 1
+      FROM unnest(
+        sqlc.arg(tag_keys)::TEXT[],
+        sqlc.arg(tag_values)::TEXT[],
+        sqlc.arg(tag_candidates)::TEXT[]
+      ) AS tag(key, value, candidates)
+      WHERE
+        NOT EXISTS (
+          SELECT 1
+          FROM jsonb_array_elements(COALESCE(tag.candidates, '[]')::JSONB) AS candidate(value)
+          WHERE
+            spans.tags @> candidate.value OR
+            spans.process_tags @> candidate.value OR
+            spans.logs @> jsonb_build_array(jsonb_build_array(candidate.value))
+        ) AND
+        NOT EXISTS (
+          SELECT 1
+          FROM jsonb_array_elements(CASE jsonb_typeof(spans.tags) WHEN 'array' THEN spans.tags ELSE '[]'::JSONB END) AS kv
+          WHERE kv->>0 = tag.key AND kv->>2 = tag.value
+        ) AND
+        NOT EXISTS (
+          SELECT 1
+          FROM jsonb_array_elements(CASE jsonb_typeof(spans.process_tags) WHEN 'array' THEN spans.process_tags ELSE '[]'::JSONB END) AS kv
+          WHERE kv->>0 = tag.key AND kv->>2 = tag.value
+        ) AND
+        NOT EXISTS (
+          SELECT 1
+          FROM jsonb_array_elements(CASE jsonb_typeof(spans.logs) WHEN 'array' THEN spans.logs ELSE '[]'::JSONB END) AS log,
+            jsonb_array_elements(CASE jsonb_typeof(log->1) WHEN 'array' THEN log->1 ELSE '[]'::JSONB END) AS kv
+          WHERE kv->>0 = tag.key AND kv->>2 = tag.value
+        )
+    ) AND
+    (
+      sqlc.arg(cursor_enable_filter)::BOOLEAN = FALSE OR
+      (spans.start_time, spans.hack_id) < (sqlc.arg(cursor_start_time)::TIMESTAMP, sqlc.arg(cursor_hack_id)::BIGINT)
+    )
+ORDER BY spans.start_time DESC, spans.hack_id DESC
+LIMIT NULLIF(sqlc.arg(span_limit)::INT, 0);
+
+-- name: TryAdvisoryLock :one
+SELECT pg_try_advisory_lock(sqlc.arg(key)::BIGINT)::BOOLEAN AS locked;
+
+-- name: AdvisoryLock :exec
+SELECT pg_advisory_lock(sqlc.arg(key)::BIGINT);
+
+-- name: AdvisoryUnlock :one
+SELECT pg_advisory_unlock(sqlc.arg(key)::BIGINT)::BOOLEAN AS unlocked;
+
+-- name: GetSpansToVerify :many
+SELECT
+  spans.hack_id as hack_id,
+  spans.span_id as span_id,
+  spans.trace_id as trace_id,
+  spans.operation_id as operation_id,
+  operations.name as operation_name,
+  operations.service_id as operation_service_id,
+  operations.kind as operation_kind,
+  spans.flags as flags,
+  spans.start_time as start_time,
+  spans.duration as duration,
+  spans.tags as tags,
+  spans.service_id as service_id,
+  services.name as process_name,
+  spans.process_id as process_id,
+  spans.warnings as warnings,
+  spans.kind as kind,
+  spans.process_tags as process_tags,
+  spans.logs as logs,
+  spans.refs as refs,
+  spans.encoding_version as encoding_version
+FROM spans
+  INNER JOIN operations ON (spans.operation_id = operations.id)
+  INNER JOIN services ON (spans.service_id = services.id)
+WHERE
+  spans.hack_id > sqlc.arg(after_hack_id)::BIGINT AND
+  (spans.start_time >= sqlc.arg(start_time_minimum)::TIMESTAMP OR sqlc.arg(start_time_minimum_enable_filter)::BOOLEAN = FALSE) AND
+  (spans.start_time < sqlc.arg(start_time_maximum)::TIMESTAMP OR sqlc.arg(start_time_maximum_enable_filter)::BOOLEAN = FALSE) AND
+  (services.name = sqlc.arg(service_name)::TEXT OR sqlc.arg(service_name_enable_filter)::BOOLEAN = FALSE)
+ORDER BY spans.hack_id ASC
+LIMIT sqlc.arg(batch_size)::INT;
+
+-- name: QuarantineSpan :execrows
+WITH quarantined AS (
+  DELETE FROM spans
+  WHERE spans.hack_id = sqlc.arg(hack_id)::BIGINT AND spans.start_time = sqlc.arg(start_time)::TIMESTAMP
+  RETURNING *
+)
+INSERT INTO quarantined_spans (
+  hack_id, span_id, trace_id, operation_id, flags, start_time, duration, tags, service_id,
+  process_id, process_tags, warnings, logs, kind, refs, encoding_version, reason
+)
+SELECT
+  hack_id, span_id, trace_id, operation_id, flags, start_time, duration, tags, service_id,
+  process_id, process_tags, warnings, logs, kind, refs, encoding_version, sqlc.arg(reason)::TEXT
+FROM quarantined;
+
+-- name: GetSpansToReencode :many
+-- the encoding version is not a parameter, so that a generic plan can use
+-- idx_spans_encoding_version_1, whose predicate it matches.
+SELECT
+  spans.hack_id as hack_id,
+  spans.start_time as start_time,
+  spans.encoding_version as encoding_version,
+  spans.tags as tags,
+  spans.process_tags as process_tags,
+  spans.logs as logs,
+  spans.refs as refs
+FROM spans
+WHERE
+  spans.hack_id > sqlc.arg(after_hack_id)::BIGINT AND
+  spans.encoding_version < 2
+ORDER BY spans.hack_id ASC
+LIMIT sqlc.arg(batch_size)::INT;
+
+-- name: GetArchivedSpansToReencode :many
+SELECT
+  archived_spans.hack_id as hack_id,
+  archived_spans.start_time as start_time,
+  archived_spans.encoding_version as encoding_version,
+  archived_spans.tags as tags,
+  archived_spans.process_tags as process_tags,
+  archived_spans.logs as logs,
+  archived_spans.refs as refs
+FROM archived_spans
+WHERE
+  archived_spans.hack_id > sqlc.arg(after_hack_id)::BIGINT AND
+  archived_spans.encoding_version < 2
+ORDER BY archived_spans.hack_id ASC
+LIMIT sqlc.arg(batch_size)::INT;
+
+-- name: ReencodeSpan :execrows
+UPDATE spans
+SET
+  tags = sqlc.arg(tags)::JSONB,
+  process_tags = sqlc.arg(process_tags)::JSONB,
+  logs = sqlc.arg(logs)::JSONB,
+  refs = sqlc.arg(refs)::JSONB,
+  encoding_version = sqlc.arg(encoding_version)::SMALLINT
+WHERE
+  spans.hack_id = sqlc.arg(hack_id)::BIGINT AND
+  spans.start_time = sqlc.arg(start_time)::TIMESTAMP AND
+  spans.encoding_version = sqlc.arg(previous_encoding_version)::SMALLINT;
+
+-- name: ReencodeArchivedSpan :execrows
+UPDATE archived_spans
+SET
+  tags = sqlc.arg(tags)::JSONB,
+  process_tags = sqlc.arg(process_tags)::JSONB,
+  logs = sqlc.arg(logs)::JSONB,
+  refs = sqlc.arg(refs)::JSONB,
+  encoding_version = sqlc.arg(encoding_version)::SMALLINT
+WHERE
+  archived_spans.hack_id = sqlc.arg(hack_id)::BIGINT AND
+  archived_spans.encoding_version = sqlc.arg(previous_encoding_version)::SMALLINT;
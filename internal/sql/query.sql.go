@@ -11,6 +11,75 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const advisoryLock = `-- name: AdvisoryLock :exec
+SELECT pg_advisory_lock($1::BIGINT)
+`
+
+func (q *Queries) AdvisoryLock(ctx context.Context, key int64) error {
+	_, err := q.db.Exec(ctx, advisoryLock, key)
+	return err
+}
+
+const advisoryUnlock = `-- name: AdvisoryUnlock :one
+SELECT pg_advisory_unlock($1::BIGINT)::BOOLEAN AS unlocked
+`
+
+func (q *Queries) AdvisoryUnlock(ctx context.Context, key int64) (bool, error) {
+	row := q.db.QueryRow(ctx, advisoryUnlock, key)
+	var unlocked bool
+	err := row.Scan(&unlocked)
+	return unlocked, err
+}
+
+const aggregateDependencyLinks = `-- name: AggregateDependencyLinks :execrows
+INSERT INTO dependency_links (bucket, parent, child, call_count, error_count)
+SELECT
+  date_trunc('hour', child_spans.start_time) AS bucket,
+  parent_services.name AS parent,
+  child_services.name AS child,
+  COUNT(*) AS call_count,
+  COUNT(*) FILTER (
+    WHERE EXISTS (
+      SELECT 1
+      FROM jsonb_array_elements(CASE jsonb_typeof(child_spans.tags) WHEN 'array' THEN child_spans.tags ELSE '[]'::JSONB END) AS kv
+      WHERE kv->>0 = 'error' AND kv->>2 = 'true'
+    ) OR
+    child_spans.tags @> '{"error": true}' OR
+    child_spans.tags @> '{"error": [true]}' OR
+    child_spans.tags @> '{"error": "true"}' OR
+    child_spans.tags @> '{"error": ["true"]}'
+  ) AS error_count
+FROM spans AS child_spans
+  CROSS JOIN LATERAL jsonb_array_elements(child_spans.refs) AS ref
+  INNER JOIN spans AS parent_spans ON (
+    parent_spans.trace_id = decode(ref->>0, 'base64') AND
+    parent_spans.span_id = decode(ref->>1, 'base64')
+  )
+  INNER JOIN services AS parent_services ON (parent_spans.service_id = parent_services.id)
+  INNER JOIN services AS child_services ON (child_spans.service_id = child_services.id)
+WHERE
+  child_spans.start_time >= $1::TIMESTAMP AND
+  child_spans.start_time < $2::TIMESTAMP AND
+  parent_spans.service_id <> child_spans.service_id
+GROUP BY 1, 2, 3
+ON CONFLICT (bucket, parent, child) DO UPDATE SET
+  call_count = EXCLUDED.call_count,
+  error_count = EXCLUDED.error_count
+`
+
+type AggregateDependencyLinksParams struct {
+	StartTime pgtype.Timestamp
+	EndTime   pgtype.Timestamp
+}
+
+func (q *Queries) AggregateDependencyLinks(ctx context.Context, arg AggregateDependencyLinksParams) (int64, error) {
+	result, err := q.db.Exec(ctx, aggregateDependencyLinks, arg.StartTime, arg.EndTime)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const cleanSpans = `-- name: CleanSpans :execrows
 
 DELETE FROM spans
@@ -25,9 +94,202 @@ func (q *Queries) CleanSpans(ctx context.Context, pruneBefore pgtype.Timestamp)
 	return result.RowsAffected(), nil
 }
 
+const cleanSpansBatch = `-- name: CleanSpansBatch :execrows
+
+DELETE FROM spans
+WHERE (spans.hack_id, spans.start_time) IN (
+  SELECT expired.hack_id, expired.start_time
+  FROM spans AS expired
+  WHERE expired.start_time < $1::TIMESTAMP
+  ORDER BY expired.start_time ASC
+  LIMIT $2::INT
+)
+`
+
+type CleanSpansBatchParams struct {
+	PruneBefore pgtype.Timestamp
+	BatchSize   int32
+}
+
+func (q *Queries) CleanSpansBatch(ctx context.Context, arg CleanSpansBatchParams) (int64, error) {
+	result, err := q.db.Exec(ctx, cleanSpansBatch, arg.PruneBefore, arg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const cleanSpansByRetentionBatch = `-- name: CleanSpansByRetentionBatch :execrows
+
+DELETE FROM spans
+WHERE (spans.hack_id, spans.start_time) IN (
+  SELECT expired.hack_id, expired.start_time
+  FROM spans AS expired
+    INNER JOIN services ON (services.id = expired.service_id)
+    INNER JOIN operations ON (operations.id = expired.operation_id)
+  WHERE
+    expired.start_time >= $1::TIMESTAMP AND
+    expired.start_time < $2::TIMESTAMP AND
+    expired.start_time < retention_prune_before(
+      services.name,
+      operations.name,
+      expired.tags,
+      expired.process_tags,
+      $3::TEXT[],
+      $4::TEXT[],
+      $5::TEXT[],
+      $6::TEXT[],
+      $7::TEXT[],
+      $8::TIMESTAMP[],
+      $9::TIMESTAMP
+    )
+  LIMIT $10::INT
+)
+`
+
+type CleanSpansByRetentionBatchParams struct {
+	StartTimeMinimum   pgtype.Timestamp
+	StartTimeMaximum   pgtype.Timestamp
+	RuleServiceNames   []string
+	RuleOperationNames []string
+	RuleTagKeys        []string
+	RuleTagValues      []string
+	RuleTagCandidates  []string
+	RulePruneBefores   []pgtype.Timestamp
+	DefaultPruneBefore pgtype.Timestamp
+	BatchSize          int32
+}
+
+func (q *Queries) CleanSpansByRetentionBatch(ctx context.Context, arg CleanSpansByRetentionBatchParams) (int64, error) {
+	result, err := q.db.Exec(ctx, cleanSpansByRetentionBatch,
+		arg.StartTimeMinimum,
+		arg.StartTimeMaximum,
+		arg.RuleServiceNames,
+		arg.RuleOperationNames,
+		arg.RuleTagKeys,
+		arg.RuleTagValues,
+		arg.RuleTagCandidates,
+		arg.RulePruneBefores,
+		arg.DefaultPruneBefore,
+		arg.BatchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+type CopySpansParams struct {
+	SpanID          []byte
+	TraceID         []byte
+	OperationID     int64
+	Flags           int64
+	StartTime       pgtype.Timestamp
+	Duration        pgtype.Interval
+	Tags            []byte
+	ServiceID       int64
+	ProcessID       string
+	ProcessTags     []byte
+	Warnings        []string
+	Kind            Spankind
+	Logs            []byte
+	Refs            []byte
+	EncodingVersion int16
+}
+
+const createSpansPartition = `-- name: CreateSpansPartition :one
+SELECT COALESCE(create_spans_partition(
+  $1::TIMESTAMP,
+  $2::TIMESTAMP
+), '')::TEXT AS partition_name
+`
+
+type CreateSpansPartitionParams struct {
+	PartitionStart pgtype.Timestamp
+	PartitionEnd   pgtype.Timestamp
+}
+
+func (q *Queries) CreateSpansPartition(ctx context.Context, arg CreateSpansPartitionParams) (string, error) {
+	row := q.db.QueryRow(ctx, createSpansPartition, arg.PartitionStart, arg.PartitionEnd)
+	var partition_name string
+	err := row.Scan(&partition_name)
+	return partition_name, err
+}
+
+const deleteUnusedOperation = `-- name: DeleteUnusedOperation :execrows
+DELETE FROM operations
+WHERE
+  operations.id = $1::BIGINT AND
+  NOT EXISTS (
+    SELECT 1
+    FROM spans
+    WHERE spans.operation_id = operations.id
+  )
+`
+
+func (q *Queries) DeleteUnusedOperation(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteUnusedOperation, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteUnusedService = `-- name: DeleteUnusedService :execrows
+DELETE FROM services
+WHERE
+  services.id = $1::BIGINT AND
+  NOT EXISTS (
+    SELECT 1
+    FROM operations
+    WHERE operations.service_id = services.id
+  ) AND
+  NOT EXISTS (
+    SELECT 1
+    FROM spans
+    WHERE spans.service_id = services.id
+  )
+`
+
+func (q *Queries) DeleteUnusedService(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteUnusedService, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const dropSpansPartitions = `-- name: DropSpansPartitions :many
+SELECT dropped.partition_name::TEXT AS partition_name
+FROM drop_spans_partitions($1::TIMESTAMP) AS dropped(partition_name)
+`
+
+func (q *Queries) DropSpansPartitions(ctx context.Context, pruneBefore pgtype.Timestamp) ([]string, error) {
+	rows, err := q.db.Query(ctx, dropSpansPartitions, pruneBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var partition_name string
+		if err := rows.Scan(&partition_name); err != nil {
+			return nil, err
+		}
+		items = append(items, partition_name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const findTraceIDs = `-- name: FindTraceIDs :many
 
-SELECT DISTINCT spans.trace_id as trace_id
+SELECT
+  spans.trace_id as trace_id,
+  spans.start_time as start_time,
+  spans.hack_id as hack_id
 FROM spans
     INNER JOIN operations ON (operations.id = spans.operation_id)
     INNER JOIN services ON (services.id = spans.service_id)
@@ -37,8 +299,52 @@ WHERE
     (start_time >= $5::TIMESTAMP OR $6::BOOLEAN = FALSE) AND
     (start_time <= $7::TIMESTAMP OR $8::BOOLEAN = FALSE) AND
     (duration >= $9::INTERVAL OR $10::BOOLEAN = FALSE) AND
-    (duration <= $11::INTERVAL OR $12::BOOLEAN = FALSE)
-LIMIT $13
+    (duration <= $11::INTERVAL OR $12::BOOLEAN = FALSE) AND
+    (
+      $13::BOOLEAN = FALSE OR
+      spans.tags @> ANY($14::TEXT[]::JSONB[]) OR
+      spans.process_tags @> ANY($14::TEXT[]::JSONB[]) OR
+      spans.logs @> ANY($15::TEXT[]::JSONB[])
+    ) AND
+    NOT EXISTS (
+      SELECT 1
+      FROM unnest(
+        $16::TEXT[],
+        $17::TEXT[],
+        $18::TEXT[]
+      ) AS tag(key, value, candidates)
+      WHERE
+        NOT EXISTS (
+          SELECT 1
+          FROM jsonb_array_elements(COALESCE(tag.candidates, '[]')::JSONB) AS candidate(value)
+          WHERE
+            spans.tags @> candidate.value OR
+            spans.process_tags @> candidate.value OR
+            spans.logs @> jsonb_build_array(jsonb_build_array(candidate.value))
+        ) AND
+        NOT EXISTS (
+          SELECT 1
+          FROM jsonb_array_elements(CASE jsonb_typeof(spans.tags) WHEN 'array' THEN spans.tags ELSE '[]'::JSONB END) AS kv
+          WHERE kv->>0 = tag.key AND kv->>2 = tag.value
+        ) AND
+        NOT EXISTS (
+          SELECT 1
+          FROM jsonb_array_elements(CASE jsonb_typeof(spans.process_tags) WHEN 'array' THEN spans.process_tags ELSE '[]'::JSONB END) AS kv
+          WHERE kv->>0 = tag.key AND kv->>2 = tag.value
+        ) AND
+        NOT EXISTS (
+          SELECT 1
+          FROM jsonb_array_elements(CASE jsonb_typeof(spans.logs) WHEN 'array' THEN spans.logs ELSE '[]'::JSONB END) AS log,
+            jsonb_array_elements(CASE jsonb_typeof(log->1) WHEN 'array' THEN log->1 ELSE '[]'::JSONB END) AS kv
+          WHERE kv->>0 = tag.key AND kv->>2 = tag.value
+        )
+    ) AND
+    (
+      $19::BOOLEAN = FALSE OR
+      (spans.start_time, spans.hack_id) < ($20::TIMESTAMP, $21::BIGINT)
+    )
+ORDER BY spans.start_time DESC, spans.hack_id DESC
+LIMIT NULLIF($22::INT, 0)
 `
 
 type FindTraceIDsParams struct {
@@ -54,10 +360,31 @@ type FindTraceIDsParams struct {
 	DurationMinimumEnableFilter  bool
 	DurationMaximum              pgtype.Interval
 	DurationMaximumEnableFilter  bool
-	NumTraces                    int32
+	TagIndexEnableFilter         bool
+	TagIndexCandidates           []string
+	TagIndexLogCandidates        []string
+	TagKeys                      []string
+	TagValues                    []string
+	TagCandidates                []string
+	CursorEnableFilter           bool
+	CursorStartTime              pgtype.Timestamp
+	CursorHackID                 int64
+	SpanLimit                    int32
 }
 
-func (q *Queries) FindTraceIDs(ctx context.Context, arg FindTraceIDsParams) ([][]byte, error) {
+type FindTraceIDsRow struct {
+	TraceID   []byte
+	StartTime pgtype.Timestamp
+	HackID    int64
+}
+
+// the matching spans are read from the most recent one, a page of at most
+// span_limit spans at a time, so that a search stops as soon as its caller
+// has found enough distinct traces instead of aggregating every match. The
+// next page starts after the last span of the previous one, given by
+// cursor_start_time and cursor_hack_id, and span_limit is not applied when it
+// is zero.
+func (q *Queries) FindTraceIDs(ctx context.Context, arg FindTraceIDsParams) ([]FindTraceIDsRow, error) {
 	rows, err := q.db.Query(ctx, findTraceIDs,
 		arg.ServiceName,
 		arg.ServiceNameEnableFilter,
@@ -71,19 +398,343 @@ func (q *Queries) FindTraceIDs(ctx context.Context, arg FindTraceIDsParams) ([][
 		arg.DurationMinimumEnableFilter,
 		arg.DurationMaximum,
 		arg.DurationMaximumEnableFilter,
-		arg.NumTraces,
+		arg.TagIndexEnableFilter,
+		arg.TagIndexCandidates,
+		arg.TagIndexLogCandidates,
+		arg.TagKeys,
+		arg.TagValues,
+		arg.TagCandidates,
+		arg.CursorEnableFilter,
+		arg.CursorStartTime,
+		arg.CursorHackID,
+		arg.SpanLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []FindTraceIDsRow
+	for rows.Next() {
+		var i FindTraceIDsRow
+		if err := rows.Scan(&i.TraceID, &i.StartTime, &i.HackID); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getArchivedSpansToReencode = `-- name: GetArchivedSpansToReencode :many
+SELECT
+  archived_spans.hack_id as hack_id,
+  archived_spans.start_time as start_time,
+  archived_spans.encoding_version as encoding_version,
+  archived_spans.tags as tags,
+  archived_spans.process_tags as process_tags,
+  archived_spans.logs as logs,
+  archived_spans.refs as refs
+FROM archived_spans
+WHERE
+  archived_spans.hack_id > $1::BIGINT AND
+  archived_spans.encoding_version < 2
+ORDER BY archived_spans.hack_id ASC
+LIMIT $2::INT
+`
+
+type GetArchivedSpansToReencodeParams struct {
+	AfterHackID int64
+	BatchSize   int32
+}
+
+type GetArchivedSpansToReencodeRow struct {
+	HackID          int64
+	StartTime       pgtype.Timestamp
+	EncodingVersion int16
+	Tags            []byte
+	ProcessTags     []byte
+	Logs            []byte
+	Refs            []byte
+}
+
+func (q *Queries) GetArchivedSpansToReencode(ctx context.Context, arg GetArchivedSpansToReencodeParams) ([]GetArchivedSpansToReencodeRow, error) {
+	rows, err := q.db.Query(ctx, getArchivedSpansToReencode, arg.AfterHackID, arg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetArchivedSpansToReencodeRow
+	for rows.Next() {
+		var i GetArchivedSpansToReencodeRow
+		if err := rows.Scan(
+			&i.HackID,
+			&i.StartTime,
+			&i.EncodingVersion,
+			&i.Tags,
+			&i.ProcessTags,
+			&i.Logs,
+			&i.Refs,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getArchivedTraceSpans = `-- name: GetArchivedTraceSpans :many
+SELECT
+  archived_spans.span_id as span_id,
+  archived_spans.trace_id as trace_id,
+  archived_spans.operation_name as operation_name,
+  archived_spans.flags as flags,
+  archived_spans.start_time as start_time,
+  archived_spans.duration as duration,
+  archived_spans.tags as tags,
+  archived_spans.process_id as process_id,
+  archived_spans.warnings as warnings,
+  archived_spans.kind as kind,
+  archived_spans.service_name as process_name,
+  archived_spans.process_tags as process_tags,
+  archived_spans.logs as logs,
+  archived_spans.refs as refs,
+  archived_spans.encoding_version as encoding_version
+FROM archived_spans
+WHERE trace_id = $1::BYTEA
+`
+
+type GetArchivedTraceSpansRow struct {
+	SpanID          []byte
+	TraceID         []byte
+	OperationName   string
+	Flags           int64
+	StartTime       pgtype.Timestamp
+	Duration        pgtype.Interval
+	Tags            []byte
+	ProcessID       string
+	Warnings        []string
+	Kind            Spankind
+	ProcessName     string
+	ProcessTags     []byte
+	Logs            []byte
+	Refs            []byte
+	EncodingVersion int16
+}
+
+func (q *Queries) GetArchivedTraceSpans(ctx context.Context, traceID []byte) ([]GetArchivedTraceSpansRow, error) {
+	rows, err := q.db.Query(ctx, getArchivedTraceSpans, traceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetArchivedTraceSpansRow
+	for rows.Next() {
+		var i GetArchivedTraceSpansRow
+		if err := rows.Scan(
+			&i.SpanID,
+			&i.TraceID,
+			&i.OperationName,
+			&i.Flags,
+			&i.StartTime,
+			&i.Duration,
+			&i.Tags,
+			&i.ProcessID,
+			&i.Warnings,
+			&i.Kind,
+			&i.ProcessName,
+			&i.ProcessTags,
+			&i.Logs,
+			&i.Refs,
+			&i.EncodingVersion,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDependencies = `-- name: GetDependencies :many
+SELECT
+  parent_services.name AS parent,
+  child_services.name AS child,
+  COUNT(*)::BIGINT AS call_count
+FROM spans AS child_spans
+  CROSS JOIN LATERAL jsonb_array_elements(child_spans.refs) AS ref
+  INNER JOIN spans AS parent_spans ON (
+    parent_spans.trace_id = decode(ref->>0, 'base64') AND
+    parent_spans.span_id = decode(ref->>1, 'base64')
+  )
+  INNER JOIN services AS parent_services ON (parent_spans.service_id = parent_services.id)
+  INNER JOIN services AS child_services ON (child_spans.service_id = child_services.id)
+WHERE
+  child_spans.start_time >= $1::TIMESTAMP AND
+  child_spans.start_time <= $2::TIMESTAMP AND
+  parent_spans.service_id <> child_spans.service_id
+GROUP BY parent_services.name, child_services.name
+ORDER BY parent_services.name, child_services.name
+`
+
+type GetDependenciesParams struct {
+	StartTime pgtype.Timestamp
+	EndTime   pgtype.Timestamp
+}
+
+type GetDependenciesRow struct {
+	Parent    string
+	Child     string
+	CallCount int64
+}
+
+func (q *Queries) GetDependencies(ctx context.Context, arg GetDependenciesParams) ([]GetDependenciesRow, error) {
+	rows, err := q.db.Query(ctx, getDependencies, arg.StartTime, arg.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetDependenciesRow
+	for rows.Next() {
+		var i GetDependenciesRow
+		if err := rows.Scan(&i.Parent, &i.Child, &i.CallCount); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDependencyLinks = `-- name: GetDependencyLinks :many
+SELECT
+  dependency_links.parent,
+  dependency_links.child,
+  SUM(dependency_links.call_count)::BIGINT AS call_count
+FROM dependency_links
+WHERE
+  dependency_links.bucket >= date_trunc('hour', $1::TIMESTAMP) AND
+  dependency_links.bucket <= $2::TIMESTAMP
+GROUP BY dependency_links.parent, dependency_links.child
+ORDER BY dependency_links.parent, dependency_links.child
+`
+
+type GetDependencyLinksParams struct {
+	StartTime pgtype.Timestamp
+	EndTime   pgtype.Timestamp
+}
+
+type GetDependencyLinksRow struct {
+	Parent    string
+	Child     string
+	CallCount int64
+}
+
+func (q *Queries) GetDependencyLinks(ctx context.Context, arg GetDependencyLinksParams) ([]GetDependencyLinksRow, error) {
+	rows, err := q.db.Query(ctx, getDependencyLinks, arg.StartTime, arg.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetDependencyLinksRow
+	for rows.Next() {
+		var i GetDependencyLinksRow
+		if err := rows.Scan(&i.Parent, &i.Child, &i.CallCount); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getExpiredSpansReport = `-- name: GetExpiredSpansReport :many
+
+SELECT
+  COALESCE(services.name, '')::TEXT AS service_name,
+  (GROUPING(services.name) = 1)::BOOLEAN AS total,
+  COUNT(*)::BIGINT AS spans,
+  COUNT(DISTINCT expired.trace_id)::BIGINT AS traces,
+  COALESCE(SUM(pg_column_size(expired.*)), 0)::BIGINT AS bytes
+FROM spans AS expired
+  INNER JOIN services ON (services.id = expired.service_id)
+  INNER JOIN operations ON (operations.id = expired.operation_id)
+WHERE
+  expired.start_time < $1::TIMESTAMP AND
+  expired.start_time < retention_prune_before(
+    services.name,
+    operations.name,
+    expired.tags,
+    expired.process_tags,
+    $2::TEXT[],
+    $3::TEXT[],
+    $4::TEXT[],
+    $5::TEXT[],
+    $6::TEXT[],
+    $7::TIMESTAMP[],
+    $8::TIMESTAMP
+  )
+GROUP BY GROUPING SETS ((services.name), ())
+ORDER BY GROUPING(services.name) ASC, services.name ASC
+`
+
+type GetExpiredSpansReportParams struct {
+	StartTimeMaximum   pgtype.Timestamp
+	RuleServiceNames   []string
+	RuleOperationNames []string
+	RuleTagKeys        []string
+	RuleTagValues      []string
+	RuleTagCandidates  []string
+	RulePruneBefores   []pgtype.Timestamp
+	DefaultPruneBefore pgtype.Timestamp
+}
+
+type GetExpiredSpansReportRow struct {
+	ServiceName string
+	Total       bool
+	Spans       int64
+	Traces      int64
+	Bytes       int64
+}
+
+func (q *Queries) GetExpiredSpansReport(ctx context.Context, arg GetExpiredSpansReportParams) ([]GetExpiredSpansReportRow, error) {
+	rows, err := q.db.Query(ctx, getExpiredSpansReport,
+		arg.StartTimeMaximum,
+		arg.RuleServiceNames,
+		arg.RuleOperationNames,
+		arg.RuleTagKeys,
+		arg.RuleTagValues,
+		arg.RuleTagCandidates,
+		arg.RulePruneBefores,
+		arg.DefaultPruneBefore,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items [][]byte
+	var items []GetExpiredSpansReportRow
 	for rows.Next() {
-		var trace_id []byte
-		if err := rows.Scan(&trace_id); err != nil {
+		var i GetExpiredSpansReportRow
+		if err := rows.Scan(
+			&i.ServiceName,
+			&i.Total,
+			&i.Spans,
+			&i.Traces,
+			&i.Bytes,
+		); err != nil {
 			return nil, err
 		}
-		items = append(items, trace_id)
+		items = append(items, i)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -91,6 +742,31 @@ func (q *Queries) FindTraceIDs(ctx context.Context, arg FindTraceIDsParams) ([][
 	return items, nil
 }
 
+const getOldestSpanStartTime = `-- name: GetOldestSpanStartTime :one
+SELECT MIN(spans.start_time)::TIMESTAMP AS start_time
+FROM spans
+`
+
+func (q *Queries) GetOldestSpanStartTime(ctx context.Context) (pgtype.Timestamp, error) {
+	row := q.db.QueryRow(ctx, getOldestSpanStartTime)
+	var start_time pgtype.Timestamp
+	err := row.Scan(&start_time)
+	return start_time, err
+}
+
+const getOldestSpanStartTimeSince = `-- name: GetOldestSpanStartTimeSince :one
+SELECT MIN(spans.start_time)::TIMESTAMP AS start_time
+FROM spans
+WHERE spans.start_time >= $1::TIMESTAMP
+`
+
+func (q *Queries) GetOldestSpanStartTimeSince(ctx context.Context, startTimeMinimum pgtype.Timestamp) (pgtype.Timestamp, error) {
+	row := q.db.QueryRow(ctx, getOldestSpanStartTimeSince, startTimeMinimum)
+	var start_time pgtype.Timestamp
+	err := row.Scan(&start_time)
+	return start_time, err
+}
+
 const getOperationID = `-- name: GetOperationID :one
 SELECT id 
 FROM operations 
@@ -117,17 +793,34 @@ const getOperations = `-- name: GetOperations :many
 SELECT operations.name, operations.kind
 FROM operations
   INNER JOIN services ON (operations.service_id = services.id)
-WHERE services.name = $1::VARCHAR
+WHERE
+  services.name = $1::VARCHAR AND
+  (operations.kind::TEXT = $2::TEXT OR $3::BOOLEAN = FALSE) AND
+  (operations.last_seen >= LOCALTIMESTAMP - $4::INTERVAL OR $5::BOOLEAN = FALSE)
 ORDER BY operations.name ASC
 `
 
+type GetOperationsParams struct {
+	ServiceName          string
+	Kind                 string
+	KindEnableFilter     bool
+	Lookback             pgtype.Interval
+	LookbackEnableFilter bool
+}
+
 type GetOperationsRow struct {
 	Name string
 	Kind Spankind
 }
 
-func (q *Queries) GetOperations(ctx context.Context, serviceName string) ([]GetOperationsRow, error) {
-	rows, err := q.db.Query(ctx, getOperations, serviceName)
+func (q *Queries) GetOperations(ctx context.Context, arg GetOperationsParams) ([]GetOperationsRow, error) {
+	rows, err := q.db.Query(ctx, getOperations,
+		arg.ServiceName,
+		arg.Kind,
+		arg.KindEnableFilter,
+		arg.Lookback,
+		arg.LookbackEnableFilter,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -152,32 +845,384 @@ FROM services
 WHERE name = $1::TEXT
 `
 
-func (q *Queries) GetServiceID(ctx context.Context, name string) (int64, error) {
-	row := q.db.QueryRow(ctx, getServiceID, name)
-	var id int64
-	err := row.Scan(&id)
-	return id, err
+func (q *Queries) GetServiceID(ctx context.Context, name string) (int64, error) {
+	row := q.db.QueryRow(ctx, getServiceID, name)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const getServices = `-- name: GetServices :many
+SELECT services.name
+FROM services
+WHERE
+  (services.last_seen >= LOCALTIMESTAMP - $1::INTERVAL OR $2::BOOLEAN = FALSE)
+ORDER BY services.name ASC
+`
+
+type GetServicesParams struct {
+	Lookback             pgtype.Interval
+	LookbackEnableFilter bool
+}
+
+func (q *Queries) GetServices(ctx context.Context, arg GetServicesParams) ([]string, error) {
+	rows, err := q.db.Query(ctx, getServices, arg.Lookback, arg.LookbackEnableFilter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		items = append(items, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSpansCount = `-- name: GetSpansCount :one
+
+WITH span_tables AS (
+    SELECT inhrelid::regclass::text AS relname
+    FROM pg_catalog.pg_class
+        JOIN pg_catalog.pg_inherits ON inhparent = oid
+    WHERE relname = 'spans'
+    UNION
+    SELECT 'spans'
+)
+SELECT sum(n_live_tup)
+FROM pg_stat_user_tables
+    JOIN span_tables USING (relname) 
+`
+
+func (q *Queries) GetSpansCount(ctx context.Context) (int64, error) {
+	row := q.db.QueryRow(ctx, getSpansCount)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const getSpansDiskSize = `-- name: GetSpansDiskSize :one
+
+WITH span_tables AS (
+    SELECT inhrelid::regclass::text AS relname
+    FROM pg_catalog.pg_class
+        JOIN pg_catalog.pg_inherits ON inhparent = oid
+    WHERE relname = 'spans'
+    UNION
+    SELECT 'spans'
+)
+SELECT sum(pg_total_relation_size(relname))
+FROM span_tables
+`
+
+func (q *Queries) GetSpansDiskSize(ctx context.Context) (int64, error) {
+	row := q.db.QueryRow(ctx, getSpansDiskSize)
+	var pg_total_relation_size int64
+	err := row.Scan(&pg_total_relation_size)
+	return pg_total_relation_size, err
+}
+
+const getSpansPartitionsWithoutIndex = `-- name: GetSpansPartitionsWithoutIndex :many
+SELECT
+  pg_namespace.nspname::TEXT AS schema_name,
+  pg_class.relname::TEXT AS partition_name
+FROM pg_catalog.pg_inherits AS partitions
+  INNER JOIN pg_catalog.pg_class ON (pg_class.oid = partitions.inhrelid)
+  INNER JOIN pg_catalog.pg_namespace ON (pg_namespace.oid = pg_class.relnamespace)
+WHERE
+  partitions.inhparent = 'spans'::regclass AND
+  NOT EXISTS (
+    SELECT 1
+    FROM pg_catalog.pg_inherits AS indexes
+      INNER JOIN pg_catalog.pg_index ON (pg_index.indexrelid = indexes.inhrelid)
+    WHERE
+      indexes.inhparent = $1::TEXT::regclass AND
+      pg_index.indrelid = partitions.inhrelid
+  )
+ORDER BY pg_class.relname ASC
+`
+
+type GetSpansPartitionsWithoutIndexRow struct {
+	SchemaName    string
+	PartitionName string
+}
+
+func (q *Queries) GetSpansPartitionsWithoutIndex(ctx context.Context, indexName string) ([]GetSpansPartitionsWithoutIndexRow, error) {
+	rows, err := q.db.Query(ctx, getSpansPartitionsWithoutIndex, indexName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetSpansPartitionsWithoutIndexRow
+	for rows.Next() {
+		var i GetSpansPartitionsWithoutIndexRow
+		if err := rows.Scan(&i.SchemaName, &i.PartitionName); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSpansToReencode = `-- name: GetSpansToReencode :many
+SELECT
+  spans.hack_id as hack_id,
+  spans.start_time as start_time,
+  spans.encoding_version as encoding_version,
+  spans.tags as tags,
+  spans.process_tags as process_tags,
+  spans.logs as logs,
+  spans.refs as refs
+FROM spans
+WHERE
+  spans.hack_id > $1::BIGINT AND
+  spans.encoding_version < 2
+ORDER BY spans.hack_id ASC
+LIMIT $2::INT
+`
+
+type GetSpansToReencodeParams struct {
+	AfterHackID int64
+	BatchSize   int32
+}
+
+type GetSpansToReencodeRow struct {
+	HackID          int64
+	StartTime       pgtype.Timestamp
+	EncodingVersion int16
+	Tags            []byte
+	ProcessTags     []byte
+	Logs            []byte
+	Refs            []byte
+}
+
+// the encoding version is not a parameter, so that a generic plan can use
+// idx_spans_encoding_version_1, whose predicate it matches.
+func (q *Queries) GetSpansToReencode(ctx context.Context, arg GetSpansToReencodeParams) ([]GetSpansToReencodeRow, error) {
+	rows, err := q.db.Query(ctx, getSpansToReencode, arg.AfterHackID, arg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetSpansToReencodeRow
+	for rows.Next() {
+		var i GetSpansToReencodeRow
+		if err := rows.Scan(
+			&i.HackID,
+			&i.StartTime,
+			&i.EncodingVersion,
+			&i.Tags,
+			&i.ProcessTags,
+			&i.Logs,
+			&i.Refs,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSpansToVerify = `-- name: GetSpansToVerify :many
+SELECT
+  spans.hack_id as hack_id,
+  spans.span_id as span_id,
+  spans.trace_id as trace_id,
+  spans.operation_id as operation_id,
+  operations.name as operation_name,
+  operations.service_id as operation_service_id,
+  operations.kind as operation_kind,
+  spans.flags as flags,
+  spans.start_time as start_time,
+  spans.duration as duration,
+  spans.tags as tags,
+  spans.service_id as service_id,
+  services.name as process_name,
+  spans.process_id as process_id,
+  spans.warnings as warnings,
+  spans.kind as kind,
+  spans.process_tags as process_tags,
+  spans.logs as logs,
+  spans.refs as refs,
+  spans.encoding_version as encoding_version
+FROM spans
+  INNER JOIN operations ON (spans.operation_id = operations.id)
+  INNER JOIN services ON (spans.service_id = services.id)
+WHERE
+  spans.hack_id > $1::BIGINT AND
+  (spans.start_time >= $2::TIMESTAMP OR $3::BOOLEAN = FALSE) AND
+  (spans.start_time < $4::TIMESTAMP OR $5::BOOLEAN = FALSE) AND
+  (services.name = $6::TEXT OR $7::BOOLEAN = FALSE)
+ORDER BY spans.hack_id ASC
+LIMIT $8::INT
+`
+
+type GetSpansToVerifyParams struct {
+	AfterHackID                  int64
+	StartTimeMinimum             pgtype.Timestamp
+	StartTimeMinimumEnableFilter bool
+	StartTimeMaximum             pgtype.Timestamp
+	StartTimeMaximumEnableFilter bool
+	ServiceName                  string
+	ServiceNameEnableFilter      bool
+	BatchSize                    int32
+}
+
+type GetSpansToVerifyRow struct {
+	HackID             int64
+	SpanID             []byte
+	TraceID            []byte
+	OperationID        int64
+	OperationName      string
+	OperationServiceID int64
+	OperationKind      Spankind
+	Flags              int64
+	StartTime          pgtype.Timestamp
+	Duration           pgtype.Interval
+	Tags               []byte
+	ServiceID          int64
+	ProcessName        string
+	ProcessID          string
+	Warnings           []string
+	Kind               Spankind
+	ProcessTags        []byte
+	Logs               []byte
+	Refs               []byte
+	EncodingVersion    int16
+}
+
+func (q *Queries) GetSpansToVerify(ctx context.Context, arg GetSpansToVerifyParams) ([]GetSpansToVerifyRow, error) {
+	rows, err := q.db.Query(ctx, getSpansToVerify,
+		arg.AfterHackID,
+		arg.StartTimeMinimum,
+		arg.StartTimeMinimumEnableFilter,
+		arg.StartTimeMaximum,
+		arg.StartTimeMaximumEnableFilter,
+		arg.ServiceName,
+		arg.ServiceNameEnableFilter,
+		arg.BatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetSpansToVerifyRow
+	for rows.Next() {
+		var i GetSpansToVerifyRow
+		if err := rows.Scan(
+			&i.HackID,
+			&i.SpanID,
+			&i.TraceID,
+			&i.OperationID,
+			&i.OperationName,
+			&i.OperationServiceID,
+			&i.OperationKind,
+			&i.Flags,
+			&i.StartTime,
+			&i.Duration,
+			&i.Tags,
+			&i.ServiceID,
+			&i.ProcessName,
+			&i.ProcessID,
+			&i.Warnings,
+			&i.Kind,
+			&i.ProcessTags,
+			&i.Logs,
+			&i.Refs,
+			&i.EncodingVersion,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getTraceSpans = `-- name: GetTraceSpans :many
+SELECT
+  spans.span_id as span_id,
+  spans.trace_id as trace_id,
+  operations.name as operation_name,
+  spans.flags as flags,
+  spans.start_time as start_time,
+  spans.duration as duration,
+  spans.tags as tags,
+  spans.process_id as process_id,
+  spans.warnings as warnings,
+  spans.kind as kind,
+  services.name as process_name,
+  spans.process_tags as process_tags,
+  spans.logs as logs,
+  spans.refs as refs,
+  spans.encoding_version as encoding_version
+FROM spans 
+  INNER JOIN operations ON (spans.operation_id = operations.id)
+  INNER JOIN services ON (spans.service_id = services.id)
+WHERE trace_id = $1::BYTEA
+`
+
+type GetTraceSpansRow struct {
+	SpanID          []byte
+	TraceID         []byte
+	OperationName   string
+	Flags           int64
+	StartTime       pgtype.Timestamp
+	Duration        pgtype.Interval
+	Tags            []byte
+	ProcessID       string
+	Warnings        []string
+	Kind            Spankind
+	ProcessName     string
+	ProcessTags     []byte
+	Logs            []byte
+	Refs            []byte
+	EncodingVersion int16
 }
 
-const getServices = `-- name: GetServices :many
-SELECT services.name
-FROM services
-ORDER BY services.name ASC
-`
-
-func (q *Queries) GetServices(ctx context.Context) ([]string, error) {
-	rows, err := q.db.Query(ctx, getServices)
+func (q *Queries) GetTraceSpans(ctx context.Context, traceID []byte) ([]GetTraceSpansRow, error) {
+	rows, err := q.db.Query(ctx, getTraceSpans, traceID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []string
+	var items []GetTraceSpansRow
 	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
+		var i GetTraceSpansRow
+		if err := rows.Scan(
+			&i.SpanID,
+			&i.TraceID,
+			&i.OperationName,
+			&i.Flags,
+			&i.StartTime,
+			&i.Duration,
+			&i.Tags,
+			&i.ProcessID,
+			&i.Warnings,
+			&i.Kind,
+			&i.ProcessName,
+			&i.ProcessTags,
+			&i.Logs,
+			&i.Refs,
+			&i.EncodingVersion,
+		); err != nil {
 			return nil, err
 		}
-		items = append(items, name)
+		items = append(items, i)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -185,50 +1230,7 @@ func (q *Queries) GetServices(ctx context.Context) ([]string, error) {
 	return items, nil
 }
 
-const getSpansCount = `-- name: GetSpansCount :one
-
-WITH span_tables AS (
-    SELECT inhrelid::regclass::text AS relname
-    FROM pg_catalog.pg_class
-        JOIN pg_catalog.pg_inherits ON inhparent = oid
-    WHERE relname = 'spans'
-    UNION
-    SELECT 'spans'
-)
-SELECT sum(n_live_tup)
-FROM pg_stat_user_tables
-    JOIN span_tables USING (relname) 
-`
-
-func (q *Queries) GetSpansCount(ctx context.Context) (int64, error) {
-	row := q.db.QueryRow(ctx, getSpansCount)
-	var count int64
-	err := row.Scan(&count)
-	return count, err
-}
-
-const getSpansDiskSize = `-- name: GetSpansDiskSize :one
-
-WITH span_tables AS (
-    SELECT inhrelid::regclass::text AS relname
-    FROM pg_catalog.pg_class
-        JOIN pg_catalog.pg_inherits ON inhparent = oid
-    WHERE relname = 'spans'
-    UNION
-    SELECT 'spans'
-)
-SELECT sum(pg_total_relation_size(relname))
-FROM span_tables
-`
-
-func (q *Queries) GetSpansDiskSize(ctx context.Context) (int64, error) {
-	row := q.db.QueryRow(ctx, getSpansDiskSize)
-	var pg_total_relation_size int64
-	err := row.Scan(&pg_total_relation_size)
-	return pg_total_relation_size, err
-}
-
-const getTraceSpans = `-- name: GetTraceSpans :many
+const getTracesSpans = `-- name: GetTracesSpans :many
 SELECT
   spans.span_id as span_id,
   spans.trace_id as trace_id,
@@ -243,39 +1245,41 @@ SELECT
   services.name as process_name,
   spans.process_tags as process_tags,
   spans.logs as logs,
-  spans.refs as refs
+  spans.refs as refs,
+  spans.encoding_version as encoding_version
 FROM spans 
   INNER JOIN operations ON (spans.operation_id = operations.id)
   INNER JOIN services ON (spans.service_id = services.id)
-WHERE trace_id = $1::BYTEA
+WHERE trace_id = ANY($1::BYTEA[])
 `
 
-type GetTraceSpansRow struct {
-	SpanID        []byte
-	TraceID       []byte
-	OperationName string
-	Flags         int64
-	StartTime     pgtype.Timestamp
-	Duration      pgtype.Interval
-	Tags          []byte
-	ProcessID     string
-	Warnings      []string
-	Kind          Spankind
-	ProcessName   string
-	ProcessTags   []byte
-	Logs          []byte
-	Refs          []byte
+type GetTracesSpansRow struct {
+	SpanID          []byte
+	TraceID         []byte
+	OperationName   string
+	Flags           int64
+	StartTime       pgtype.Timestamp
+	Duration        pgtype.Interval
+	Tags            []byte
+	ProcessID       string
+	Warnings        []string
+	Kind            Spankind
+	ProcessName     string
+	ProcessTags     []byte
+	Logs            []byte
+	Refs            []byte
+	EncodingVersion int16
 }
 
-func (q *Queries) GetTraceSpans(ctx context.Context, traceID []byte) ([]GetTraceSpansRow, error) {
-	rows, err := q.db.Query(ctx, getTraceSpans, traceID)
+func (q *Queries) GetTracesSpans(ctx context.Context, traceIds [][]byte) ([]GetTracesSpansRow, error) {
+	rows, err := q.db.Query(ctx, getTracesSpans, traceIds)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []GetTraceSpansRow
+	var items []GetTracesSpansRow
 	for rows.Next() {
-		var i GetTraceSpansRow
+		var i GetTracesSpansRow
 		if err := rows.Scan(
 			&i.SpanID,
 			&i.TraceID,
@@ -291,6 +1295,7 @@ func (q *Queries) GetTraceSpans(ctx context.Context, traceID []byte) ([]GetTrace
 			&i.ProcessTags,
 			&i.Logs,
 			&i.Refs,
+			&i.EncodingVersion,
 		); err != nil {
 			return nil, err
 		}
@@ -302,6 +1307,184 @@ func (q *Queries) GetTraceSpans(ctx context.Context, traceID []byte) ([]GetTrace
 	return items, nil
 }
 
+const getUnusedOperationIDs = `-- name: GetUnusedOperationIDs :many
+SELECT operations.id
+FROM operations
+WHERE NOT EXISTS (
+  SELECT 1
+  FROM spans
+  WHERE spans.operation_id = operations.id
+)
+ORDER BY operations.id ASC
+`
+
+func (q *Queries) GetUnusedOperationIDs(ctx context.Context) ([]int64, error) {
+	rows, err := q.db.Query(ctx, getUnusedOperationIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUnusedServiceIDs = `-- name: GetUnusedServiceIDs :many
+SELECT services.id
+FROM services
+WHERE
+  NOT EXISTS (
+    SELECT 1
+    FROM operations
+    WHERE operations.service_id = services.id
+  ) AND
+  NOT EXISTS (
+    SELECT 1
+    FROM spans
+    WHERE spans.service_id = services.id
+  )
+ORDER BY services.id ASC
+`
+
+func (q *Queries) GetUnusedServiceIDs(ctx context.Context) ([]int64, error) {
+	rows, err := q.db.Query(ctx, getUnusedServiceIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertArchivedSpan = `-- name: InsertArchivedSpan :exec
+INSERT INTO archived_spans (
+  span_id,
+  trace_id,
+  operation_name,
+  flags,
+  start_time,
+  duration,
+  tags,
+  service_name,
+  process_id,
+  process_tags,
+  warnings,
+  kind,
+  logs,
+  refs,
+  encoding_version
+)
+VALUES(
+  $1::BYTEA,
+  $2::BYTEA,
+  $3::TEXT,
+  $4::BIGINT,
+  $5::TIMESTAMP,
+  $6::INTERVAL,
+  $7::JSONB,
+  $8::TEXT,
+  $9::TEXT,
+  $10::JSONB,
+  $11::TEXT[],
+  $12::SPANKIND,
+  $13::JSONB,
+  $14::JSONB,
+  $15::SMALLINT
+)
+ON CONFLICT (trace_id, span_id, kind) DO NOTHING
+`
+
+type InsertArchivedSpanParams struct {
+	SpanID          []byte
+	TraceID         []byte
+	OperationName   string
+	Flags           int64
+	StartTime       pgtype.Timestamp
+	Duration        pgtype.Interval
+	Tags            []byte
+	ServiceName     string
+	ProcessID       string
+	ProcessTags     []byte
+	Warnings        []string
+	Kind            Spankind
+	Logs            []byte
+	Refs            []byte
+	EncodingVersion int16
+}
+
+func (q *Queries) InsertArchivedSpan(ctx context.Context, arg InsertArchivedSpanParams) error {
+	_, err := q.db.Exec(ctx, insertArchivedSpan,
+		arg.SpanID,
+		arg.TraceID,
+		arg.OperationName,
+		arg.Flags,
+		arg.StartTime,
+		arg.Duration,
+		arg.Tags,
+		arg.ServiceName,
+		arg.ProcessID,
+		arg.ProcessTags,
+		arg.Warnings,
+		arg.Kind,
+		arg.Logs,
+		arg.Refs,
+		arg.EncodingVersion,
+	)
+	return err
+}
+
+const insertDependencyLink = `-- name: InsertDependencyLink :exec
+INSERT INTO dependency_links (bucket, parent, child, call_count, error_count)
+VALUES (
+  date_trunc('hour', $1::TIMESTAMP),
+  $2::TEXT,
+  $3::TEXT,
+  $4::BIGINT,
+  $5::BIGINT
+)
+ON CONFLICT (bucket, parent, child) DO UPDATE SET
+  call_count = dependency_links.call_count + EXCLUDED.call_count,
+  error_count = dependency_links.error_count + EXCLUDED.error_count
+`
+
+type InsertDependencyLinkParams struct {
+	Bucket     pgtype.Timestamp
+	Parent     string
+	Child      string
+	CallCount  int64
+	ErrorCount int64
+}
+
+func (q *Queries) InsertDependencyLink(ctx context.Context, arg InsertDependencyLinkParams) error {
+	_, err := q.db.Exec(ctx, insertDependencyLink,
+		arg.Bucket,
+		arg.Parent,
+		arg.Child,
+		arg.CallCount,
+		arg.ErrorCount,
+	)
+	return err
+}
+
 const insertSpan = `-- name: InsertSpan :one
 INSERT INTO spans (
   span_id,
@@ -317,7 +1500,8 @@ INSERT INTO spans (
   warnings,
   kind,
   logs,
-  refs
+  refs,
+  encoding_version
 )
 VALUES(
   $1::BYTEA,
@@ -333,26 +1517,28 @@ VALUES(
   $11::TEXT[],
   $12::SPANKIND,
   $13::JSONB,
-  $14::JSONB
+  $14::JSONB,
+  $15::SMALLINT
 )
 RETURNING spans.hack_id
 `
 
 type InsertSpanParams struct {
-	SpanID      []byte
-	TraceID     []byte
-	OperationID int64
-	Flags       int64
-	StartTime   pgtype.Timestamp
-	Duration    pgtype.Interval
-	Tags        []byte
-	ServiceID   int64
-	ProcessID   string
-	ProcessTags []byte
-	Warnings    []string
-	Kind        Spankind
-	Logs        []byte
-	Refs        []byte
+	SpanID          []byte
+	TraceID         []byte
+	OperationID     int64
+	Flags           int64
+	StartTime       pgtype.Timestamp
+	Duration        pgtype.Interval
+	Tags            []byte
+	ServiceID       int64
+	ProcessID       string
+	ProcessTags     []byte
+	Warnings        []string
+	Kind            Spankind
+	Logs            []byte
+	Refs            []byte
+	EncodingVersion int16
 }
 
 func (q *Queries) InsertSpan(ctx context.Context, arg InsertSpanParams) (int64, error) {
@@ -371,19 +1557,144 @@ func (q *Queries) InsertSpan(ctx context.Context, arg InsertSpanParams) (int64,
 		arg.Kind,
 		arg.Logs,
 		arg.Refs,
+		arg.EncodingVersion,
 	)
 	var hack_id int64
 	err := row.Scan(&hack_id)
 	return hack_id, err
 }
 
+const quarantineSpan = `-- name: QuarantineSpan :execrows
+WITH quarantined AS (
+  DELETE FROM spans
+  WHERE spans.hack_id = $1::BIGINT AND spans.start_time = $2::TIMESTAMP
+  RETURNING hack_id, span_id, trace_id, operation_id, flags, start_time, duration, tags, service_id, process_id, process_tags, warnings, logs, kind, refs, encoding_version
+)
+INSERT INTO quarantined_spans (
+  hack_id, span_id, trace_id, operation_id, flags, start_time, duration, tags, service_id,
+  process_id, process_tags, warnings, logs, kind, refs, encoding_version, reason
+)
+SELECT
+  hack_id, span_id, trace_id, operation_id, flags, start_time, duration, tags, service_id,
+  process_id, process_tags, warnings, logs, kind, refs, encoding_version, $3::TEXT
+FROM quarantined
+`
+
+type QuarantineSpanParams struct {
+	HackID    int64
+	StartTime pgtype.Timestamp
+	Reason    string
+}
+
+func (q *Queries) QuarantineSpan(ctx context.Context, arg QuarantineSpanParams) (int64, error) {
+	result, err := q.db.Exec(ctx, quarantineSpan, arg.HackID, arg.StartTime, arg.Reason)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const reencodeArchivedSpan = `-- name: ReencodeArchivedSpan :execrows
+UPDATE archived_spans
+SET
+  tags = $1::JSONB,
+  process_tags = $2::JSONB,
+  logs = $3::JSONB,
+  refs = $4::JSONB,
+  encoding_version = $5::SMALLINT
+WHERE
+  archived_spans.hack_id = $6::BIGINT AND
+  archived_spans.encoding_version = $7::SMALLINT
+`
+
+type ReencodeArchivedSpanParams struct {
+	Tags                    []byte
+	ProcessTags             []byte
+	Logs                    []byte
+	Refs                    []byte
+	EncodingVersion         int16
+	HackID                  int64
+	PreviousEncodingVersion int16
+}
+
+func (q *Queries) ReencodeArchivedSpan(ctx context.Context, arg ReencodeArchivedSpanParams) (int64, error) {
+	result, err := q.db.Exec(ctx, reencodeArchivedSpan,
+		arg.Tags,
+		arg.ProcessTags,
+		arg.Logs,
+		arg.Refs,
+		arg.EncodingVersion,
+		arg.HackID,
+		arg.PreviousEncodingVersion,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const reencodeSpan = `-- name: ReencodeSpan :execrows
+UPDATE spans
+SET
+  tags = $1::JSONB,
+  process_tags = $2::JSONB,
+  logs = $3::JSONB,
+  refs = $4::JSONB,
+  encoding_version = $5::SMALLINT
+WHERE
+  spans.hack_id = $6::BIGINT AND
+  spans.start_time = $7::TIMESTAMP AND
+  spans.encoding_version = $8::SMALLINT
+`
+
+type ReencodeSpanParams struct {
+	Tags                    []byte
+	ProcessTags             []byte
+	Logs                    []byte
+	Refs                    []byte
+	EncodingVersion         int16
+	HackID                  int64
+	StartTime               pgtype.Timestamp
+	PreviousEncodingVersion int16
+}
+
+func (q *Queries) ReencodeSpan(ctx context.Context, arg ReencodeSpanParams) (int64, error) {
+	result, err := q.db.Exec(ctx, reencodeSpan,
+		arg.Tags,
+		arg.ProcessTags,
+		arg.Logs,
+		arg.Refs,
+		arg.EncodingVersion,
+		arg.HackID,
+		arg.StartTime,
+		arg.PreviousEncodingVersion,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const tryAdvisoryLock = `-- name: TryAdvisoryLock :one
+SELECT pg_try_advisory_lock($1::BIGINT)::BOOLEAN AS locked
+`
+
+func (q *Queries) TryAdvisoryLock(ctx context.Context, key int64) (bool, error) {
+	row := q.db.QueryRow(ctx, tryAdvisoryLock, key)
+	var locked bool
+	err := row.Scan(&locked)
+	return locked, err
+}
+
 const upsertOperation = `-- name: UpsertOperation :exec
 INSERT INTO operations (name, service_id, kind) 
 VALUES (
   $1::TEXT, 
   $2::BIGINT, 
   $3::SPANKIND
-) ON CONFLICT(name, service_id, kind) DO NOTHING RETURNING id
+)
+ON CONFLICT(name, service_id, kind) DO UPDATE SET last_seen = LOCALTIMESTAMP
+RETURNING id
 `
 
 type UpsertOperationParams struct {
@@ -401,25 +1712,11 @@ const upsertService = `-- name: UpsertService :exec
 
 
 INSERT INTO services (name) 
-VALUES ($1::VARCHAR) ON CONFLICT(name) DO NOTHING RETURNING id
+VALUES ($1::VARCHAR)
+ON CONFLICT(name) DO UPDATE SET last_seen = LOCALTIMESTAMP
+RETURNING id
 `
 
-// -- name: GetDependencies :many
-// SELECT
-//
-//	COUNT(*) AS call_count,
-//	source_services.name as parent,
-//	child_services.name as child,
-//	'' as source
-//
-// FROM spanrefs
-//
-//	INNER JOIN spans AS source_spans ON (source_spans.span_id = spanrefs.source_span_id)
-//	INNER JOIN spans AS child_spans ON (child_spans.span_id = spanrefs.child_span_id)
-//	INNER JOIN services AS source_services ON (source_spans.service_id = source_services.id)
-//	INNER JOIN services AS child_services ON (child_spans.service_id = child_services.id)
-//
-// GROUP BY source_services.name, child_services.name;
 // -- name: FindTraceIDs :many
 // SELECT DISTINCT spans.trace_id
 // FROM spans
@@ -442,3 +1739,15 @@ func (q *Queries) UpsertService(ctx context.Context, name string) error {
 	_, err := q.db.Exec(ctx, upsertService, name)
 	return err
 }
+
+const vacuumSpans = `-- name: VacuumSpans :exec
+
+VACUUM (ANALYZE) spans
+`
+
+// VACUUM gives the pages emptied at the end of a table back to the disk, and
+// ANALYZE refreshes the estimated number of spans.
+func (q *Queries) VacuumSpans(ctx context.Context) error {
+	_, err := q.db.Exec(ctx, vacuumSpans)
+	return err
+}
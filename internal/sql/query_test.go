@@ -2,9 +2,12 @@ package sql_test
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/robbert229/jaeger-postgresql/internal/sql"
 	"github.com/robbert229/jaeger-postgresql/internal/sqltest"
@@ -25,7 +28,7 @@ func TestGetOperations(t *testing.T) {
 		err := q.UpsertService(ctx, "service-1")
 		require.Nil(t, err)
 
-		operations, err := q.GetOperations(ctx, "service-1")
+		operations, err := q.GetOperations(ctx, sql.GetOperationsParams{ServiceName: "service-1"})
 		require.Nil(t, err)
 
 		require.Empty(t, operations)
@@ -47,7 +50,7 @@ func TestGetOperations(t *testing.T) {
 		})
 		require.Nil(t, err)
 
-		operations, err := q.GetOperations(ctx, "service-2")
+		operations, err := q.GetOperations(ctx, sql.GetOperationsParams{ServiceName: "service-2"})
 		require.Nil(t, err)
 
 		require.Len(t, operations, 0)
@@ -69,11 +72,42 @@ func TestGetOperations(t *testing.T) {
 		})
 		require.Nil(t, err)
 
-		operations, err := q.GetOperations(ctx, "service-1")
+		operations, err := q.GetOperations(ctx, sql.GetOperationsParams{ServiceName: "service-1"})
 		require.Nil(t, err)
 
 		require.Equal(t, []sql.GetOperationsRow{{Name: "Something", Kind: sql.SpankindClient}}, operations)
 	})
+
+	t.Run("should only return operations of the requested kind", func(t *testing.T) {
+		require.Nil(t, cleanup())
+
+		err := q.UpsertService(ctx, "service-1")
+		require.Nil(t, err)
+
+		serviceID, err := q.GetServiceID(ctx, "service-1")
+		require.Nil(t, err)
+
+		for _, kind := range []sql.Spankind{sql.SpankindClient, sql.SpankindServer} {
+			err = q.UpsertOperation(ctx, sql.UpsertOperationParams{
+				Name:      "Something",
+				ServiceID: serviceID,
+				Kind:      kind,
+			})
+			require.Nil(t, err)
+		}
+
+		operations, err := q.GetOperations(ctx, sql.GetOperationsParams{ServiceName: "service-1", Kind: "server", KindEnableFilter: true})
+		require.Nil(t, err)
+		require.Equal(t, []sql.GetOperationsRow{{Name: "Something", Kind: sql.SpankindServer}}, operations)
+
+		operations, err = q.GetOperations(ctx, sql.GetOperationsParams{ServiceName: "service-1", Kind: "producer", KindEnableFilter: true})
+		require.Nil(t, err)
+		require.Empty(t, operations)
+
+		operations, err = q.GetOperations(ctx, sql.GetOperationsParams{ServiceName: "service-1"})
+		require.Nil(t, err)
+		require.Len(t, operations, 2)
+	})
 }
 
 func TestGetServices(t *testing.T) {
@@ -86,7 +120,7 @@ func TestGetServices(t *testing.T) {
 	t.Run("should return nothing when no services exist", func(t *testing.T) {
 		require.Nil(t, cleanup())
 
-		services, err := q.GetServices(ctx)
+		services, err := q.GetServices(ctx, sql.GetServicesParams{})
 		require.Nil(t, err)
 
 		require.Empty(t, services)
@@ -103,11 +137,41 @@ func TestGetServices(t *testing.T) {
 
 		require.NotNil(t, serviceID)
 
-		services, err := q.GetServices(ctx)
+		services, err := q.GetServices(ctx, sql.GetServicesParams{})
 		require.Nil(t, err)
 
 		require.Equal(t, []string{"Something"}, services)
 	})
+
+	t.Run("should hide services not seen within the lookback", func(t *testing.T) {
+		require.Nil(t, cleanup())
+
+		for _, name := range []string{"stale", "fresh"} {
+			err := q.UpsertService(ctx, name)
+			require.Nil(t, err)
+		}
+
+		_, err := conn.Exec(ctx, "UPDATE services SET last_seen = LOCALTIMESTAMP - INTERVAL '2 days' WHERE name = 'stale'")
+		require.Nil(t, err)
+
+		lookback := pgtype.Interval{Microseconds: time.Hour.Microseconds(), Valid: true}
+
+		services, err := q.GetServices(ctx, sql.GetServicesParams{Lookback: lookback, LookbackEnableFilter: true})
+		require.Nil(t, err)
+		require.Equal(t, []string{"fresh"}, services)
+
+		services, err = q.GetServices(ctx, sql.GetServicesParams{})
+		require.Nil(t, err)
+		require.Equal(t, []string{"fresh", "stale"}, services)
+
+		// upserting the service again marks it as seen.
+		err = q.UpsertService(ctx, "stale")
+		require.Nil(t, err)
+
+		services, err = q.GetServices(ctx, sql.GetServicesParams{Lookback: lookback, LookbackEnableFilter: true})
+		require.Nil(t, err)
+		require.Equal(t, []string{"fresh", "stale"}, services)
+	})
 }
 
 func TestSpans(t *testing.T) {
@@ -208,7 +272,7 @@ func TestSpans(t *testing.T) {
 		operationID, err := q.GetOperationID(ctx, sql.GetOperationIDParams{Name: "operation-1", ServiceID: serviceID, Kind: sql.SpankindClient})
 		require.Nil(t, err)
 
-		queried, err := q.FindTraceIDs(ctx, sql.FindTraceIDsParams{NumTraces: 0})
+		queried, err := q.FindTraceIDs(ctx, sql.FindTraceIDsParams{})
 		require.Nil(t, err)
 
 		require.Len(t, queried, 0)
@@ -267,14 +331,460 @@ func TestSpans(t *testing.T) {
 		})
 		require.Nil(t, err)
 
-		queried, err = q.FindTraceIDs(ctx, sql.FindTraceIDsParams{NumTraces: 1})
+		queried, err = q.FindTraceIDs(ctx, sql.FindTraceIDsParams{SpanLimit: 1})
 		require.Nil(t, err)
 
 		require.Len(t, queried, 1)
 
-		queried, err = q.FindTraceIDs(ctx, sql.FindTraceIDsParams{NumTraces: 2})
+		queried, err = q.FindTraceIDs(ctx, sql.FindTraceIDsParams{SpanLimit: 2})
 		require.Nil(t, err)
 
 		require.Len(t, queried, 2)
 	})
+
+	t.Run("should return the most recent traces first", func(t *testing.T) {
+		require.Nil(t, cleanup())
+
+		err := q.UpsertService(ctx, "service-1")
+		require.Nil(t, err)
+
+		serviceID, err := q.GetServiceID(ctx, "service-1")
+		require.Nil(t, err)
+
+		err = q.UpsertOperation(ctx, sql.UpsertOperationParams{Name: "operation-1", ServiceID: serviceID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		operationID, err := q.GetOperationID(ctx, sql.GetOperationIDParams{Name: "operation-1", ServiceID: serviceID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		now := time.Now()
+
+		// the first trace has both the oldest and the most recent span, so it
+		// is ordered by its most recent span.
+		for i, span := range []struct {
+			traceID   []byte
+			startTime time.Time
+		}{
+			{traceID: []byte{0, 0, 0, 1}, startTime: now.Add(-time.Hour * 3)},
+			{traceID: []byte{0, 0, 0, 2}, startTime: now.Add(-time.Hour * 2)},
+			{traceID: []byte{0, 0, 0, 3}, startTime: now.Add(-time.Hour)},
+			{traceID: []byte{0, 0, 0, 3}, startTime: now.Add(-time.Hour * 4)},
+			{traceID: []byte{0, 0, 0, 1}, startTime: now},
+		} {
+			_, err = q.InsertSpan(ctx, sql.InsertSpanParams{
+				SpanID:      []byte{0, 0, 0, byte(i)},
+				TraceID:     span.traceID,
+				OperationID: operationID,
+				Flags:       0,
+				StartTime:   pgtype.Timestamp{Time: span.startTime, Valid: true},
+				Duration:    pgtype.Interval{Microseconds: 1000, Valid: true},
+				Tags:        []byte("[]"),
+				ServiceID:   serviceID,
+				ProcessID:   "",
+				ProcessTags: []byte("[]"),
+				Warnings:    []string{},
+				Kind:        sql.SpankindClient,
+				Logs:        []byte("null"),
+				Refs:        []byte("[]"),
+			})
+			require.Nil(t, err)
+		}
+
+		queried, err := q.FindTraceIDs(ctx, sql.FindTraceIDsParams{})
+		require.Nil(t, err)
+		require.Len(t, queried, 5)
+		require.Equal(t, [][]byte{{0, 0, 0, 1}, {0, 0, 0, 3}, {0, 0, 0, 2}}, traceIDs(queried))
+
+		// only the two most recent spans are read, so the oldest trace is
+		// not found.
+		queried, err = q.FindTraceIDs(ctx, sql.FindTraceIDsParams{SpanLimit: 2})
+		require.Nil(t, err)
+		require.Equal(t, [][]byte{{0, 0, 0, 1}, {0, 0, 0, 3}}, traceIDs(queried))
+
+		// the next page starts after the last span of the previous one.
+		last := queried[len(queried)-1]
+		queried, err = q.FindTraceIDs(ctx, sql.FindTraceIDsParams{
+			CursorEnableFilter: true,
+			CursorStartTime:    last.StartTime,
+			CursorHackID:       last.HackID,
+			SpanLimit:          2,
+		})
+		require.Nil(t, err)
+		require.Equal(t, [][]byte{{0, 0, 0, 2}, {0, 0, 0, 1}}, traceIDs(queried))
+	})
+
+	t.Run("should only return traces whose spans match every tag", func(t *testing.T) {
+		require.Nil(t, cleanup())
+
+		err := q.UpsertService(ctx, "service-1")
+		require.Nil(t, err)
+
+		serviceID, err := q.GetServiceID(ctx, "service-1")
+		require.Nil(t, err)
+
+		err = q.UpsertOperation(ctx, sql.UpsertOperationParams{Name: "operation-1", ServiceID: serviceID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		operationID, err := q.GetOperationID(ctx, sql.GetOperationIDParams{Name: "operation-1", ServiceID: serviceID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		_, err = q.InsertSpan(ctx, sql.InsertSpanParams{
+			SpanID:      []byte{0, 0, 0, 1},
+			TraceID:     []byte{0, 0, 0, 1},
+			OperationID: operationID,
+			Flags:       0,
+			StartTime:   pgtype.Timestamp{Time: time.Now(), Valid: true},
+			Duration:    pgtype.Interval{Microseconds: 1000, Valid: true},
+			Tags:        []byte(`[["error", 1, true], ["http.status_code", 2, "500"]]`),
+			ServiceID:   serviceID,
+			ProcessID:   "",
+			ProcessTags: []byte(`[["hostname", 0, "host-1"]]`),
+			Warnings:    []string{},
+			Kind:        sql.SpankindClient,
+			Logs:        []byte(`[["2024-01-01T00:00:00Z", [["event", 0, "retry"]]]]`),
+			Refs:        []byte("[]"),
+		})
+		require.Nil(t, err)
+
+		_, err = q.InsertSpan(ctx, sql.InsertSpanParams{
+			SpanID:      []byte{0, 0, 0, 2},
+			TraceID:     []byte{0, 0, 0, 2},
+			OperationID: operationID,
+			Flags:       0,
+			StartTime:   pgtype.Timestamp{Time: time.Now(), Valid: true},
+			Duration:    pgtype.Interval{Microseconds: 1000, Valid: true},
+			Tags:        []byte(`[["http.status_code", 2, "200"]]`),
+			ServiceID:   serviceID,
+			ProcessID:   "",
+			ProcessTags: []byte("null"),
+			Warnings:    []string{},
+			Kind:        sql.SpankindClient,
+			Logs:        []byte("null"),
+			Refs:        []byte("[]"),
+		})
+		require.Nil(t, err)
+
+		queried, err := q.FindTraceIDs(ctx, sql.FindTraceIDsParams{
+			TagKeys:   []string{"error", "hostname", "event"},
+			TagValues: []string{"true", "host-1", "retry"},
+		})
+		require.Nil(t, err)
+		require.Equal(t, [][]byte{{0, 0, 0, 1}}, traceIDs(queried))
+
+		queried, err = q.FindTraceIDs(ctx, sql.FindTraceIDsParams{
+			TagKeys:   []string{"error", "http.status_code"},
+			TagValues: []string{"true", "200"},
+		})
+		require.Nil(t, err)
+		require.Len(t, queried, 0)
+	})
+
+	t.Run("should match tags stored as objects by containment", func(t *testing.T) {
+		require.Nil(t, cleanup())
+
+		err := q.UpsertService(ctx, "service-1")
+		require.Nil(t, err)
+
+		serviceID, err := q.GetServiceID(ctx, "service-1")
+		require.Nil(t, err)
+
+		err = q.UpsertOperation(ctx, sql.UpsertOperationParams{Name: "operation-1", ServiceID: serviceID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		operationID, err := q.GetOperationID(ctx, sql.GetOperationIDParams{Name: "operation-1", ServiceID: serviceID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		_, err = q.InsertSpan(ctx, sql.InsertSpanParams{
+			SpanID:          []byte{0, 0, 0, 1},
+			TraceID:         []byte{0, 0, 0, 1},
+			OperationID:     operationID,
+			Flags:           0,
+			StartTime:       pgtype.Timestamp{Time: time.Now(), Valid: true},
+			Duration:        pgtype.Interval{Microseconds: 1000, Valid: true},
+			Tags:            []byte(`{"error": true, "http.status_code": 500}`),
+			ServiceID:       serviceID,
+			ProcessID:       "",
+			ProcessTags:     []byte(`{"hostname": "host-1"}`),
+			Warnings:        []string{},
+			Kind:            sql.SpankindClient,
+			Logs:            []byte(`[["2024-01-01T00:00:00Z", {"event": ["retry", "error"]}]]`),
+			Refs:            []byte("[]"),
+			EncodingVersion: 2,
+		})
+		require.Nil(t, err)
+
+		// a span in the first encoding version is matched by containment of a
+		// [key, value] array.
+		_, err = q.InsertSpan(ctx, sql.InsertSpanParams{
+			SpanID:          []byte{0, 0, 0, 2},
+			TraceID:         []byte{0, 0, 0, 2},
+			OperationID:     operationID,
+			Flags:           0,
+			StartTime:       pgtype.Timestamp{Time: time.Now(), Valid: true},
+			Duration:        pgtype.Interval{Microseconds: 1000, Valid: true},
+			Tags:            []byte(`[["http.status_code", 2, "500"]]`),
+			ServiceID:       serviceID,
+			ProcessID:       "",
+			ProcessTags:     []byte(`[]`),
+			Warnings:        []string{},
+			Kind:            sql.SpankindClient,
+			Logs:            []byte(`[]`),
+			Refs:            []byte("[]"),
+			EncodingVersion: 1,
+		})
+		require.Nil(t, err)
+
+		queried, err := q.FindTraceIDs(ctx, sql.FindTraceIDsParams{
+			TagIndexEnableFilter:  true,
+			TagIndexCandidates:    []string{`{"error": "true"}`, `{"error": true}`},
+			TagIndexLogCandidates: []string{`[[{"error": "true"}]]`, `[[{"error": true}]]`},
+			TagKeys:               []string{"error", "event", "hostname"},
+			TagValues:             []string{"true", "retry", "host-1"},
+			TagCandidates: []string{
+				`[{"error": "true"}, {"error": true}]`,
+				`[{"event": "retry"}, {"event": ["retry"]}]`,
+				`[{"hostname": "host-1"}]`,
+			},
+		})
+		require.Nil(t, err)
+		require.Equal(t, [][]byte{{0, 0, 0, 1}}, traceIDs(queried))
+
+		queried, err = q.FindTraceIDs(ctx, sql.FindTraceIDsParams{
+			TagIndexEnableFilter:  true,
+			TagIndexCandidates:    []string{`{"http.status_code": "500"}`, `{"http.status_code": 500}`, `[["http.status_code", "500"]]`},
+			TagIndexLogCandidates: []string{`[[{"http.status_code": "500"}]]`, `[[{"http.status_code": 500}]]`, `[[[["http.status_code", "500"]]]]`},
+			TagKeys:               []string{"http.status_code"},
+			TagValues:             []string{"500"},
+			TagCandidates:         []string{`[{"http.status_code": "500"}, {"http.status_code": 500}]`},
+		})
+		require.Nil(t, err)
+		require.ElementsMatch(t, [][]byte{{0, 0, 0, 1}, {0, 0, 0, 2}}, traceIDs(queried))
+	})
+
+	t.Run("should return the spans of every requested trace", func(t *testing.T) {
+		require.Nil(t, cleanup())
+
+		err := q.UpsertService(ctx, "service-1")
+		require.Nil(t, err)
+
+		serviceID, err := q.GetServiceID(ctx, "service-1")
+		require.Nil(t, err)
+
+		err = q.UpsertOperation(ctx, sql.UpsertOperationParams{Name: "operation-1", ServiceID: serviceID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		operationID, err := q.GetOperationID(ctx, sql.GetOperationIDParams{Name: "operation-1", ServiceID: serviceID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		for i, traceID := range [][]byte{{0, 0, 0, 1}, {0, 0, 0, 1}, {0, 0, 0, 2}, {0, 0, 0, 3}} {
+			_, err = q.InsertSpan(ctx, sql.InsertSpanParams{
+				SpanID:      []byte{0, 0, 0, byte(i)},
+				TraceID:     traceID,
+				OperationID: operationID,
+				Flags:       0,
+				StartTime:   pgtype.Timestamp{Time: time.Now(), Valid: true},
+				Duration:    pgtype.Interval{Microseconds: 1000, Valid: true},
+				Tags:        []byte("[]"),
+				ServiceID:   serviceID,
+				ProcessID:   "",
+				ProcessTags: []byte("[]"),
+				Warnings:    []string{},
+				Kind:        sql.SpankindClient,
+				Logs:        []byte("null"),
+				Refs:        []byte("[]"),
+			})
+			require.Nil(t, err)
+		}
+
+		queried, err := q.GetTracesSpans(ctx, [][]byte{{0, 0, 0, 1}, {0, 0, 0, 3}})
+		require.Nil(t, err)
+		require.Len(t, queried, 3)
+
+		for _, span := range queried {
+			require.NotEqual(t, []byte{0, 0, 0, 2}, span.TraceID)
+		}
+	})
+}
+
+// traceIDs returns the distinct trace ids of the spans found by FindTraceIDs,
+// in the order of their most recent span.
+func traceIDs(rows []sql.FindTraceIDsRow) [][]byte {
+	seen := map[string]bool{}
+	ids := make([][]byte, 0, len(rows))
+	for _, row := range rows {
+		if seen[string(row.TraceID)] {
+			continue
+		}
+
+		seen[string(row.TraceID)] = true
+		ids = append(ids, row.TraceID)
+	}
+
+	return ids
+}
+
+func TestGetDependencies(t *testing.T) {
+	ctx := context.Background()
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	q := sql.New(conn)
+
+	t.Run("should return links between the services of parent and child spans", func(t *testing.T) {
+		require.Nil(t, cleanup())
+
+		err := q.UpsertService(ctx, "frontend")
+		require.Nil(t, err)
+
+		frontendID, err := q.GetServiceID(ctx, "frontend")
+		require.Nil(t, err)
+
+		err = q.UpsertService(ctx, "backend")
+		require.Nil(t, err)
+
+		backendID, err := q.GetServiceID(ctx, "backend")
+		require.Nil(t, err)
+
+		err = q.UpsertOperation(ctx, sql.UpsertOperationParams{Name: "operation-1", ServiceID: frontendID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		frontendOperationID, err := q.GetOperationID(ctx, sql.GetOperationIDParams{Name: "operation-1", ServiceID: frontendID, Kind: sql.SpankindClient})
+		require.Nil(t, err)
+
+		err = q.UpsertOperation(ctx, sql.UpsertOperationParams{Name: "operation-1", ServiceID: backendID, Kind: sql.SpankindServer})
+		require.Nil(t, err)
+
+		backendOperationID, err := q.GetOperationID(ctx, sql.GetOperationIDParams{Name: "operation-1", ServiceID: backendID, Kind: sql.SpankindServer})
+		require.Nil(t, err)
+
+		traceID := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+		parentSpanID := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+		_, err = q.InsertSpan(ctx, sql.InsertSpanParams{
+			SpanID:      parentSpanID,
+			TraceID:     traceID,
+			OperationID: frontendOperationID,
+			Flags:       0,
+			StartTime:   pgtype.Timestamp{Time: time.Now(), Valid: true},
+			Duration:    pgtype.Interval{Microseconds: 1000, Valid: true},
+			Tags:        []byte("[]"),
+			ServiceID:   frontendID,
+			ProcessID:   "",
+			ProcessTags: []byte("[]"),
+			Warnings:    []string{},
+			Kind:        sql.SpankindClient,
+			Logs:        []byte("null"),
+			Refs:        []byte("[]"),
+		})
+		require.Nil(t, err)
+
+		refs := fmt.Sprintf(
+			`[[%q, %q, 0]]`,
+			base64.StdEncoding.EncodeToString(traceID),
+			base64.StdEncoding.EncodeToString(parentSpanID),
+		)
+
+		for i := byte(2); i < 4; i++ {
+			_, err = q.InsertSpan(ctx, sql.InsertSpanParams{
+				SpanID:      []byte{0, 0, 0, 0, 0, 0, 0, i},
+				TraceID:     traceID,
+				OperationID: backendOperationID,
+				Flags:       0,
+				StartTime:   pgtype.Timestamp{Time: time.Now(), Valid: true},
+				Duration:    pgtype.Interval{Microseconds: 1000, Valid: true},
+				Tags:        []byte("[]"),
+				ServiceID:   backendID,
+				ProcessID:   "",
+				ProcessTags: []byte("[]"),
+				Warnings:    []string{},
+				Kind:        sql.SpankindServer,
+				Logs:        []byte("null"),
+				Refs:        []byte(refs),
+			})
+			require.Nil(t, err)
+		}
+
+		dependencies, err := q.GetDependencies(ctx, sql.GetDependenciesParams{
+			StartTime: pgtype.Timestamp{Time: time.Now().Add(-1 * time.Hour), Valid: true},
+			EndTime:   pgtype.Timestamp{Time: time.Now().Add(time.Hour), Valid: true},
+		})
+		require.Nil(t, err)
+
+		require.Equal(t, []sql.GetDependenciesRow{{Parent: "frontend", Child: "backend", CallCount: 2}}, dependencies)
+
+		dependencies, err = q.GetDependencies(ctx, sql.GetDependenciesParams{
+			StartTime: pgtype.Timestamp{Time: time.Now().Add(-2 * time.Hour), Valid: true},
+			EndTime:   pgtype.Timestamp{Time: time.Now().Add(-1 * time.Hour), Valid: true},
+		})
+		require.Nil(t, err)
+
+		require.Empty(t, dependencies)
+	})
+}
+
+func TestDependencyLinks(t *testing.T) {
+	ctx := context.Background()
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	q := sql.New(conn)
+
+	t.Run("should sum the call counts of the buckets within the window", func(t *testing.T) {
+		require.Nil(t, cleanup())
+
+		now := time.Now().Truncate(time.Hour)
+
+		for _, bucket := range []time.Time{now, now.Add(-1 * time.Hour), now.Add(-5 * time.Hour)} {
+			err := q.InsertDependencyLink(ctx, sql.InsertDependencyLinkParams{
+				Bucket:    pgtype.Timestamp{Time: bucket, Valid: true},
+				Parent:    "frontend",
+				Child:     "backend",
+				CallCount: 2,
+			})
+			require.Nil(t, err)
+		}
+
+		links, err := q.GetDependencyLinks(ctx, sql.GetDependencyLinksParams{
+			StartTime: pgtype.Timestamp{Time: now.Add(-90 * time.Minute), Valid: true},
+			EndTime:   pgtype.Timestamp{Time: now.Add(time.Minute), Valid: true},
+		})
+		require.Nil(t, err)
+
+		require.Equal(t, []sql.GetDependencyLinksRow{{Parent: "frontend", Child: "backend", CallCount: 4}}, links)
+	})
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	ctx := context.Background()
+	conn, _, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	other, err := pgx.ConnectConfig(ctx, conn.Config())
+	require.Nil(t, err)
+	defer other.Close(ctx)
+
+	q := sql.New(conn)
+	otherQ := sql.New(other)
+
+	t.Run("should only let a single session hold the lock", func(t *testing.T) {
+		locked, err := q.TryAdvisoryLock(ctx, 42)
+		require.Nil(t, err)
+		require.True(t, locked)
+
+		locked, err = otherQ.TryAdvisoryLock(ctx, 42)
+		require.Nil(t, err)
+		require.False(t, locked)
+
+		unlocked, err := q.AdvisoryUnlock(ctx, 42)
+		require.Nil(t, err)
+		require.True(t, unlocked)
+
+		locked, err = otherQ.TryAdvisoryLock(ctx, 42)
+		require.Nil(t, err)
+		require.True(t, locked)
+
+		unlocked, err = otherQ.AdvisoryUnlock(ctx, 42)
+		require.Nil(t, err)
+		require.True(t, unlocked)
+	})
 }
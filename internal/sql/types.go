@@ -0,0 +1,22 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RegisterTypes registers the custom types of the schema with the connection.
+// pgx needs to know about them to encode them in the binary format, which is
+// used when copying rows into a table.
+func RegisterTypes(ctx context.Context, conn *pgx.Conn) error {
+	spanKind, err := conn.LoadType(ctx, "spankind")
+	if err != nil {
+		return fmt.Errorf("failed to load spankind type: %w", err)
+	}
+
+	conn.TypeMap().RegisterType(spanKind)
+
+	return nil
+}
@@ -17,7 +17,7 @@ import (
 
 func TruncateAll(conn *pgx.Conn) error {
 	ctx := context.Background()
-	tables := []string{"operations", "services", "spans"}
+	tables := []string{"operations", "services", "spans", "dependency_links", "archived_spans", "quarantined_spans"}
 	for _, table := range tables {
 		if _, err := conn.Exec(ctx, fmt.Sprintf("TRUNCATE %s CASCADE", table)); err != nil {
 			return err
@@ -83,6 +83,9 @@ func Harness(t interface {
 	conn, err := pgx.Connect(ctx, databaseURL)
 	require.Nil(t, err, "failed to connect to database")
 
+	err = sql.RegisterTypes(ctx, conn)
+	require.Nil(t, err, "failed to register types")
+
 	return conn, func() error {
 		return TruncateAll(conn)
 	}, harnessCloser{pgC, conn}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+var _ spanstore.Reader = (*ArchiveReader)(nil)
+var _ spanstore.Writer = (*ArchiveWriter)(nil)
+
+// errArchiveSearchNotSupported is returned by the search methods of the
+// ArchiveReader. Jaeger only ever loads archived traces by their id.
+var errArchiveSearchNotSupported = errors.New("searching archived traces is not supported")
+
+// ArchiveReader loads archived traces from PostgreSQL.
+type ArchiveReader struct {
+	logger       *slog.Logger
+	q            *sql.Queries
+	decodeErrors DecodeErrorPolicy
+}
+
+// NewArchiveReader returns a new ArchiveReader, applying the given policy to
+// the archived spans that cannot be decoded.
+func NewArchiveReader(q *sql.Queries, logger *slog.Logger, decodeErrors DecodeErrorPolicy) *ArchiveReader {
+	return &ArchiveReader{
+		q:            q,
+		logger:       logger,
+		decodeErrors: decodeErrors,
+	}
+}
+
+// GetTrace takes a traceID and returns the archived Trace associated with it.
+func (r *ArchiveReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	dbSpans, err := r.q.GetArchivedTraceSpans(ctx, EncodeTraceID(traceID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get archived trace spans: %w", err)
+	}
+
+	if len(dbSpans) == 0 {
+		return nil, spanstore.ErrTraceNotFound
+	}
+
+	var spans []*model.Span = make([]*model.Span, len(dbSpans))
+	for i, dbSpan := range dbSpans {
+		span, err := decodeSpan(sql.GetTraceSpansRow(dbSpan), r.decodeErrors)
+		if err != nil {
+			return nil, err
+		}
+
+		spans[i] = span
+	}
+
+	return &model.Trace{
+		Spans: spans,
+	}, nil
+}
+
+// GetServices is not supported by the archive.
+func (r *ArchiveReader) GetServices(ctx context.Context) ([]string, error) {
+	return nil, errArchiveSearchNotSupported
+}
+
+// GetOperations is not supported by the archive.
+func (r *ArchiveReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	return nil, errArchiveSearchNotSupported
+}
+
+// FindTraces is not supported by the archive.
+func (r *ArchiveReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	return nil, errArchiveSearchNotSupported
+}
+
+// FindTraceIDs is not supported by the archive.
+func (r *ArchiveReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	return nil, errArchiveSearchNotSupported
+}
+
+// ArchiveWriter writes archived traces into PostgreSQL. Archived spans are kept
+// apart from the spans table so that they are never removed by the cleaner.
+type ArchiveWriter struct {
+	logger *slog.Logger
+	q      *sql.Queries
+}
+
+// NewArchiveWriter returns a new ArchiveWriter.
+func NewArchiveWriter(q *sql.Queries, logger *slog.Logger) *ArchiveWriter {
+	return &ArchiveWriter{
+		q:      q,
+		logger: logger,
+	}
+}
+
+// WriteSpan saves the span into the archive. Archiving a span that has already
+// been archived is a no-op.
+func (w *ArchiveWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	encoded, err := encodeSpan(span)
+	if err != nil {
+		return err
+	}
+
+	err = w.q.InsertArchivedSpan(ctx, sql.InsertArchivedSpanParams{
+		SpanID:          EncodeSpanID(span.SpanID),
+		TraceID:         EncodeTraceID(span.TraceID),
+		OperationName:   span.OperationName,
+		Flags:           int64(span.Flags),
+		StartTime:       EncodeTimestamp(span.StartTime),
+		Duration:        EncodeInterval(span.Duration),
+		Tags:            encoded.Tags,
+		ServiceName:     span.Process.ServiceName,
+		ProcessID:       span.ProcessID,
+		ProcessTags:     encoded.ProcessTags,
+		Warnings:        span.Warnings,
+		Kind:            encodeSpanKindOf(span),
+		Logs:            encoded.Logs,
+		Refs:            encoded.Refs,
+		EncodingVersion: int16(encoded.Version),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert archived span: %w", err)
+	}
+
+	return nil
+}
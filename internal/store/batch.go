@@ -0,0 +1,214 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+var _ spanstore.Writer = (*BatchWriter)(nil)
+var _ io.Closer = (*BatchWriter)(nil)
+
+// ErrBatchWriterClosed is returned when a span is written to a closed BatchWriter.
+var ErrBatchWriterClosed = errors.New("batch writer is closed")
+
+// BatchWriterOptions configures a BatchWriter.
+type BatchWriterOptions struct {
+	// Size is the number of spans after which a batch is flushed.
+	Size int
+
+	// FlushInterval is the maximum amount of time a span is buffered before
+	// being flushed.
+	FlushInterval time.Duration
+
+	// FlushTimeout bounds the time spent writing a single batch.
+	FlushTimeout time.Duration
+}
+
+// BatchWriter buffers the spans written to it, and asynchronously flushes them
+// to PostgreSQL in batches. A batch is flushed when it is full, or when the
+// flush interval elapses.
+type BatchWriter struct {
+	writer *Writer
+	logger *slog.Logger
+	opts   BatchWriterOptions
+
+	mu     sync.RWMutex
+	closed bool
+
+	spans chan *model.Span
+	done  chan struct{}
+}
+
+// NewBatchWriter returns a new BatchWriter, and starts flushing in the
+// background. Close must be called to flush the remaining spans.
+func NewBatchWriter(writer *Writer, logger *slog.Logger, opts BatchWriterOptions) *BatchWriter {
+	if opts.Size <= 0 {
+		opts.Size = 1000
+	}
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+
+	if opts.FlushTimeout <= 0 {
+		opts.FlushTimeout = time.Second * 30
+	}
+
+	w := &BatchWriter{
+		writer: writer,
+		logger: logger,
+		opts:   opts,
+		spans:  make(chan *model.Span, opts.Size),
+		done:   make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+// WriteSpan queues the span to be written in the next batch. It blocks when
+// the buffer is full until there is room for the span.
+func (w *BatchWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return ErrBatchWriterClosed
+	}
+
+	select {
+	case w.spans <- span:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting spans, and flushes the spans that are still buffered.
+func (w *BatchWriter) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.spans)
+	}
+	w.mu.Unlock()
+
+	<-w.done
+	return nil
+}
+
+func (w *BatchWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*model.Span, 0, w.opts.Size)
+	for {
+		select {
+		case span, ok := <-w.spans:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+
+			batch = append(batch, span)
+			if len(batch) >= w.opts.Size {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// batchRetryPause is how long the batch writer waits before writing a batch
+// again after the database could not be reached.
+const batchRetryPause = time.Second
+
+// flush writes the batch. A batch that fails because the database could not
+// be reached is written again once before being dropped. A batch that the
+// database rejected may have been failed by a single span, so its spans are
+// then written one at a time, and only the spans that fail are dropped.
+func (w *BatchWriter) flush(batch []*model.Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	{
+		promWriteBatchCounter.Inc()
+		promWriteBatchSpansHistogram.Observe(float64(len(batch)))
+
+		start := time.Now()
+		defer func() {
+			promWriteBatchHistogram.Observe(time.Since(start).Seconds())
+		}()
+	}
+
+	err := w.writeBatch(batch)
+	if err != nil && isTransientWriteError(err) {
+		w.logger.Warn("failed to write batch, retrying", "spans", len(batch), "err", err)
+
+		time.Sleep(batchRetryPause)
+		err = w.writeBatch(batch)
+	}
+
+	var invalid *InvalidSpansError
+	switch {
+	case err == nil:
+		w.logger.Debug("wrote batch", "spans", len(batch))
+	case errors.As(err, &invalid):
+		promWriteBatchDroppedSpansCounter.Add(float64(len(invalid.Errs)))
+		w.logger.Error("dropped spans that could not be encoded", "spans", len(invalid.Errs), "err", err)
+	case isTransientWriteError(err):
+		promWriteBatchErrorsCounter.Inc()
+		promWriteBatchDroppedSpansCounter.Add(float64(len(batch)))
+		w.logger.Error("failed to write batch", "spans", len(batch), "err", err)
+	default:
+		promWriteBatchErrorsCounter.Inc()
+		w.logger.Warn("failed to write batch, writing its spans one at a time", "spans", len(batch), "err", err)
+
+		w.writeEach(batch)
+	}
+}
+
+// writeBatch writes the batch with a single COPY.
+func (w *BatchWriter) writeBatch(batch []*model.Span) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), w.opts.FlushTimeout)
+	defer cancelFn()
+
+	return w.writer.WriteSpans(ctx, batch)
+}
+
+// writeEach writes the spans of the batch one at a time, dropping the spans
+// that fail.
+func (w *BatchWriter) writeEach(batch []*model.Span) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), w.opts.FlushTimeout)
+	defer cancelFn()
+
+	for _, span := range batch {
+		if err := w.writer.WriteSpan(ctx, span); err != nil {
+			promWriteBatchDroppedSpansCounter.Inc()
+			w.logger.Error("dropped span that could not be written", "trace_id", span.TraceID, "span_id", span.SpanID, "err", err)
+		}
+	}
+}
+
+// isTransientWriteError returns true if the write failed because of the
+// database rather than because of the spans, so that writing them again may
+// succeed.
+func isTransientWriteError(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) || isDatabaseUnavailable(err)
+}
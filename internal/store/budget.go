@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+)
+
+// DiskBudget caps the disk space used by the spans table.
+type DiskBudget struct {
+	// MaxBytes is the disk space the spans table, its partitions and their
+	// indexes may use before the oldest spans are deleted.
+	MaxBytes int64
+
+	// TargetBytes is the disk space the spans table is brought down to once
+	// it exceeds MaxBytes, leaving room for the spans written until the next
+	// run. Zero means 90% of MaxBytes.
+	TargetBytes int64
+
+	// MinAge is the minimum retention of the spans. Spans younger than it are
+	// never deleted, even when the budget is exceeded.
+	MinAge time.Duration
+}
+
+// target returns the disk space the spans table is brought down to.
+func (b DiskBudget) target() int64 {
+	if b.TargetBytes > 0 {
+		return b.TargetBytes
+	}
+
+	return b.MaxBytes / 10 * 9
+}
+
+// DiskBudgetReport describes what was removed to enforce a disk budget.
+type DiskBudgetReport struct {
+	// SizeBytes is the disk space used by the spans table before any span
+	// was deleted.
+	SizeBytes int64
+
+	// Spans is the number of spans that were deleted.
+	Spans int64
+
+	// EstimatedBytes is the estimated size of the deleted spans.
+	EstimatedBytes int64
+
+	// OldestSpan is the start time of the oldest span that was kept, it is
+	// zero when no span is left.
+	OldestSpan time.Time
+}
+
+// CleanSpansToBudget deletes the oldest spans when the disk space used by the
+// spans table exceeds the budget, until the estimated size of the table is
+// under the target of the budget. The spans table is vacuumed afterwards, which
+// gives the emptied partitions back to the disk, so the next run measures the
+// space freed by this one. A partition that is only partly emptied keeps its
+// size until the spans written later reuse it, so the table can stay over the
+// target by up to a partition.
+func CleanSpansToBudget(ctx context.Context, q *sql.Queries, logger *slog.Logger, now time.Time, budget DiskBudget, opts CleanOptions) (DiskBudgetReport, error) {
+	var report DiskBudgetReport
+
+	if budget.MaxBytes <= 0 {
+		return report, fmt.Errorf("invalid disk budget: %d bytes", budget.MaxBytes)
+	}
+
+	if budget.TargetBytes < 0 || budget.TargetBytes > budget.MaxBytes {
+		return report, fmt.Errorf("invalid disk budget target: %d bytes, it must be between 0 and %d bytes", budget.TargetBytes, budget.MaxBytes)
+	}
+
+	size, err := q.GetSpansDiskSize(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to get the disk size of the spans: %w", err)
+	}
+
+	report.SizeBytes = size
+
+	if size > budget.MaxBytes {
+		count, err := q.GetSpansCount(ctx)
+		if err != nil {
+			return report, fmt.Errorf("failed to get the number of spans: %w", err)
+		}
+
+		if count > 0 {
+			// the average size of a span is rounded up, so that enough spans
+			// are deleted to reach the target.
+			target := budget.target()
+			spanSize := (size + count - 1) / count
+			excess := (size - target + spanSize - 1) / spanSize
+
+			deleted, err := cleanOldestSpans(ctx, q, logger, now.Add(-1*budget.MinAge), excess, opts)
+			report.Spans = deleted
+			report.EstimatedBytes = deleted * spanSize
+			if err != nil {
+				return report, err
+			}
+
+			if deleted < excess {
+				logger.Warn(
+					"disk budget exceeded by spans younger than the minimum retention",
+					"size", size,
+					"max_bytes", budget.MaxBytes,
+					"target_bytes", target,
+					"min_age", budget.MinAge,
+				)
+			}
+
+			if deleted > 0 {
+				if err := q.VacuumSpans(ctx); err != nil {
+					return report, fmt.Errorf("failed to vacuum the spans: %w", err)
+				}
+			}
+		}
+	}
+
+	oldest, err := q.GetOldestSpanStartTime(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to get the start time of the oldest span: %w", err)
+	}
+
+	if oldest.Valid {
+		report.OldestSpan = oldest.Time
+	}
+
+	return report, nil
+}
+
+// cleanOldestSpans deletes at most limit spans started before pruneBefore in
+// batches, the oldest spans first.
+func cleanOldestSpans(ctx context.Context, q *sql.Queries, logger *slog.Logger, pruneBefore time.Time, limit int64, opts CleanOptions) (int64, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 10000
+	}
+
+	var total int64
+	for total < limit {
+		size := min(int64(opts.BatchSize), limit-total)
+
+		count, err := q.CleanSpansBatch(ctx, sql.CleanSpansBatchParams{
+			PruneBefore: EncodeTimestamp(pruneBefore),
+			BatchSize:   int32(size),
+		})
+		if err != nil {
+			return total, fmt.Errorf("failed to delete the oldest spans: %w", err)
+		}
+
+		total += count
+
+		logger.Info("deleted batch of the oldest spans", "spans", count, "total", total, "limit", limit)
+
+		if count < size || total >= limit {
+			break
+		}
+
+		if err := pause(ctx, opts.Pause); err != nil {
+			return total, fmt.Errorf("stopped deleting the oldest spans: %w", err)
+		}
+	}
+
+	return total, nil
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// idCache is a bounded, concurrency-safe, least recently used cache of
+// database ids. Ids expire after the ttl, so that they are periodically
+// resolved again.
+type idCache[K comparable] struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	items    map[K]*list.Element
+	order    *list.List
+
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+type idCacheEntry[K comparable] struct {
+	key     K
+	id      int64
+	expires time.Time
+}
+
+// newIDCache returns a new idCache that holds at most capacity ids, each for at
+// most ttl.
+func newIDCache[K comparable](capacity int, ttl time.Duration, hits, misses prometheus.Counter) *idCache[K] {
+	return &idCache[K]{
+		capacity: capacity,
+		ttl:      ttl,
+		items:    make(map[K]*list.Element),
+		order:    list.New(),
+		hits:     hits,
+		misses:   misses,
+	}
+}
+
+// Get returns the id cached for the key.
+func (c *idCache[K]) Get(key K) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		c.misses.Inc()
+		return 0, false
+	}
+
+	entry := element.Value.(*idCacheEntry[K])
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.items, key)
+		c.misses.Inc()
+		return 0, false
+	}
+
+	c.hits.Inc()
+	c.order.MoveToFront(element)
+	return entry.id, true
+}
+
+// Put caches the id for the key, evicting the least recently used id when the
+// cache is full.
+func (c *idCache[K]) Put(key K, id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+
+	if element, ok := c.items[key]; ok {
+		entry := element.Value.(*idCacheEntry[K])
+		entry.id = id
+		entry.expires = expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&idCacheEntry[K]{key: key, id: id, expires: expires})
+
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*idCacheEntry[K]).key)
+	}
+}
+
+// Purge removes every id from the cache.
+func (c *idCache[K]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[K]*list.Element)
+	c.order.Init()
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDCache(t *testing.T) {
+	hits := prometheus.NewCounter(prometheus.CounterOpts{Name: "hits"})
+	misses := prometheus.NewCounter(prometheus.CounterOpts{Name: "misses"})
+
+	cache := newIDCache[string](2, time.Hour, hits, misses)
+
+	_, ok := cache.Get("service-1")
+	require.False(t, ok)
+
+	cache.Put("service-1", 1)
+	cache.Put("service-2", 2)
+
+	id, ok := cache.Get("service-1")
+	require.True(t, ok)
+	require.Equal(t, int64(1), id)
+
+	// service-2 is the least recently used id, so it is the one evicted.
+	cache.Put("service-3", 3)
+
+	_, ok = cache.Get("service-2")
+	require.False(t, ok)
+
+	id, ok = cache.Get("service-3")
+	require.True(t, ok)
+	require.Equal(t, int64(3), id)
+
+	require.Equal(t, float64(2), testutil.ToFloat64(hits))
+	require.Equal(t, float64(2), testutil.ToFloat64(misses))
+
+	cache.Purge()
+
+	_, ok = cache.Get("service-1")
+	require.False(t, ok)
+}
+
+func TestIDCacheExpiry(t *testing.T) {
+	hits := prometheus.NewCounter(prometheus.CounterOpts{Name: "hits"})
+	misses := prometheus.NewCounter(prometheus.CounterOpts{Name: "misses"})
+
+	cache := newIDCache[string](2, time.Millisecond, hits, misses)
+
+	cache.Put("service-1", 1)
+	time.Sleep(time.Millisecond * 5)
+
+	_, ok := cache.Get("service-1")
+	require.False(t, ok)
+	require.Equal(t, float64(1), testutil.ToFloat64(misses))
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+)
+
+// CleanOptions configures CleanSpans.
+type CleanOptions struct {
+	// BatchSize is the maximum number of spans deleted by a single statement.
+	BatchSize int
+
+	// Pause is the amount of time waited between two batches, leaving room
+	// for the writers.
+	Pause time.Duration
+}
+
+// CleanSpans deletes the spans started before pruneBefore in batches, the
+// oldest spans first. Every batch is committed on its own, so an interrupted
+// cleanup loses no progress and resumes where it stopped on the next run. It
+// returns the number of spans that were deleted, including when it fails part
+// way through.
+func CleanSpans(ctx context.Context, q *sql.Queries, logger *slog.Logger, pruneBefore time.Time, opts CleanOptions) (int64, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 10000
+	}
+
+	var total int64
+	for batch := 1; ; batch++ {
+		start := time.Now()
+
+		count, err := q.CleanSpansBatch(ctx, sql.CleanSpansBatchParams{
+			PruneBefore: EncodeTimestamp(pruneBefore),
+			BatchSize:   int32(opts.BatchSize),
+		})
+		if err != nil {
+			return total, fmt.Errorf("failed to delete batch %d of spans: %w", batch, err)
+		}
+
+		total += count
+
+		logger.Info(
+			"deleted batch of spans",
+			"batch", batch,
+			"spans", count,
+			"total", total,
+			"duration", time.Since(start),
+		)
+
+		if count < int64(opts.BatchSize) {
+			return total, nil
+		}
+
+		if err := pause(ctx, opts.Pause); err != nil {
+			return total, fmt.Errorf("stopped deleting spans after batch %d: %w", batch, err)
+		}
+	}
+}
+
+// pause waits for the given duration, or until the context is done.
+func pause(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
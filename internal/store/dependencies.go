@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/dependencystore"
+)
+
+var _ dependencystore.Reader = (*DependencyReader)(nil)
+var _ dependencystore.Writer = (*DependencyWriter)(nil)
+
+// DependencyReader loads the precomputed dependency links from PostgreSQL.
+type DependencyReader struct {
+	logger *slog.Logger
+	q      *sql.Queries
+}
+
+// NewDependencyReader returns a new DependencyReader.
+func NewDependencyReader(q *sql.Queries, logger *slog.Logger) *DependencyReader {
+	return &DependencyReader{
+		q:      q,
+		logger: logger,
+	}
+}
+
+// GetDependencies returns the inter-service dependencies aggregated over the
+// hourly buckets that overlap with the requested window.
+func (r *DependencyReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	response, err := r.q.GetDependencyLinks(ctx, sql.GetDependencyLinksParams{
+		StartTime: EncodeTimestamp(endTs.Add(-1 * lookback)),
+		EndTime:   EncodeTimestamp(endTs),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dependency links: %w", err)
+	}
+
+	var dependencies = make([]model.DependencyLink, len(response))
+	for i, iter := range response {
+		dependencies[i] = model.DependencyLink{
+			Parent:    iter.Parent,
+			Child:     iter.Child,
+			CallCount: uint64(iter.CallCount),
+		}
+	}
+
+	return dependencies, nil
+}
+
+// DependencyWriter writes dependency links into the precomputed buckets.
+type DependencyWriter struct {
+	logger *slog.Logger
+	q      *sql.Queries
+}
+
+// NewDependencyWriter returns a new DependencyWriter.
+func NewDependencyWriter(q *sql.Queries, logger *slog.Logger) *DependencyWriter {
+	return &DependencyWriter{
+		q:      q,
+		logger: logger,
+	}
+}
+
+// WriteDependencies adds the given dependency links to the bucket containing ts.
+func (w *DependencyWriter) WriteDependencies(ts time.Time, dependencies []model.DependencyLink) error {
+	ctx := context.Background()
+
+	for _, dependency := range dependencies {
+		err := w.q.InsertDependencyLink(ctx, sql.InsertDependencyLinkParams{
+			Bucket:    EncodeTimestamp(ts),
+			Parent:    dependency.Parent,
+			Child:     dependency.Child,
+			CallCount: int64(dependency.CallCount),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to insert dependency link: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// AggregateDependencies recomputes the dependency links of every hourly bucket
+// between start and end from the spans table. It returns the number of links
+// that were written.
+func AggregateDependencies(ctx context.Context, q *sql.Queries, start, end time.Time) (int64, error) {
+	count, err := q.AggregateDependencyLinks(ctx, sql.AggregateDependencyLinksParams{
+		StartTime: EncodeTimestamp(start.Truncate(time.Hour)),
+		EndTime:   EncodeTimestamp(end),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to aggregate dependency links: %w", err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrInvalidQuery is returned when a trace query can never match any trace.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// validateTraceQuery returns an error wrapping ErrInvalidQuery when the query
+// is malformed.
+func validateTraceQuery(query *spanstore.TraceQueryParameters) error {
+	if query == nil {
+		return fmt.Errorf("%w: query is missing", ErrInvalidQuery)
+	}
+
+	if !query.StartTimeMin.IsZero() && !query.StartTimeMax.IsZero() && query.StartTimeMax.Before(query.StartTimeMin) {
+		return fmt.Errorf("%w: start time minimum is after the maximum", ErrInvalidQuery)
+	}
+
+	if query.DurationMin != time.Duration(0) && query.DurationMax != time.Duration(0) && query.DurationMax < query.DurationMin {
+		return fmt.Errorf("%w: duration minimum is above the maximum", ErrInvalidQuery)
+	}
+
+	if query.NumTraces < 0 {
+		return fmt.Errorf("%w: number of traces is negative", ErrInvalidQuery)
+	}
+
+	return nil
+}
+
+// ToGRPCError converts an error returned by the store into a gRPC status error
+// with the code that describes it best. Errors that already carry a gRPC
+// status are returned as is.
+func ToGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		return err
+	}
+
+	return status.Error(grpcCode(err), err.Error())
+}
+
+func grpcCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, spanstore.ErrTraceNotFound):
+		return codes.NotFound
+	case errors.Is(err, ErrInvalidQuery):
+		return codes.InvalidArgument
+	case errors.Is(err, context.DeadlineExceeded), pgconn.Timeout(err):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case isDatabaseUnavailable(err):
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// isDatabaseUnavailable reports whether the error was caused by the database
+// not being reachable, rather than by the query itself.
+func isDatabaseUnavailable(err error) bool {
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case len(pgErr.Code) == 5 && pgErr.Code[:2] == "08": // connection_exception
+			return true
+		case pgErr.Code == "53300": // too_many_connections
+			return true
+		case pgErr.Code == "57P01", pgErr.Code == "57P02", pgErr.Code == "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnaryServerInterceptor returns a grpc.UnaryServerInterceptor that converts
+// the errors returned by the store into gRPC status errors.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		return resp, ToGRPCError(err)
+	}
+}
+
+// StreamServerInterceptor returns a grpc.StreamServerInterceptor that converts
+// the errors returned by the store into gRPC status errors.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return ToGRPCError(handler(srv, ss))
+	}
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToGRPCError(t *testing.T) {
+	require.Nil(t, ToGRPCError(nil))
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{name: "not found", err: spanstore.ErrTraceNotFound, code: codes.NotFound},
+		{name: "invalid argument", err: validateTraceQuery(nil), code: codes.InvalidArgument},
+		{name: "deadline exceeded", err: fmt.Errorf("failed to get trace spans: %w", context.DeadlineExceeded), code: codes.DeadlineExceeded},
+		{name: "canceled", err: fmt.Errorf("failed to get trace spans: %w", context.Canceled), code: codes.Canceled},
+		{name: "connection failure", err: fmt.Errorf("failed to get trace spans: %w", &pgconn.PgError{Code: "08006"}), code: codes.Unavailable},
+		{name: "database shutting down", err: &pgconn.PgError{Code: "57P01"}, code: codes.Unavailable},
+		{name: "query failure", err: &pgconn.PgError{Code: "42P01"}, code: codes.Internal},
+		{name: "unknown failure", err: errors.New("boom"), code: codes.Internal},
+		{name: "existing status", err: status.Error(codes.Unimplemented, "not implemented"), code: codes.Unimplemented},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.code, status.Code(ToGRPCError(tc.err)))
+		})
+	}
+}
+
+func TestValidateTraceQuery(t *testing.T) {
+	now := time.Now()
+
+	require.Nil(t, validateTraceQuery(&spanstore.TraceQueryParameters{StartTimeMin: now.Add(-time.Hour), StartTimeMax: now}))
+	require.Nil(t, validateTraceQuery(&spanstore.TraceQueryParameters{DurationMin: time.Second}))
+
+	require.ErrorIs(t, validateTraceQuery(nil), ErrInvalidQuery)
+	require.ErrorIs(t, validateTraceQuery(&spanstore.TraceQueryParameters{StartTimeMin: now, StartTimeMax: now.Add(-time.Hour)}), ErrInvalidQuery)
+	require.ErrorIs(t, validateTraceQuery(&spanstore.TraceQueryParameters{DurationMin: time.Second, DurationMax: time.Millisecond}), ErrInvalidQuery)
+	require.ErrorIs(t, validateTraceQuery(&spanstore.TraceQueryParameters{NumTraces: -1}), ErrInvalidQuery)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	interceptor := UnaryServerInterceptor()
+
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+		return nil, spanstore.ErrTraceNotFound
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	resp, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+		return "ok", nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, "ok", resp)
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	interceptor := StreamServerInterceptor()
+
+	err := interceptor(nil, nil, &grpc.StreamServerInfo{}, func(srv any, stream grpc.ServerStream) error {
+		return fmt.Errorf("failed to query trace ids: %w", context.DeadlineExceeded)
+	})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"time"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// spansIndex is an index of the spans table that is built on each partition
+// concurrently, rather than on the whole table at once.
+type spansIndex struct {
+	// name is the name of the index of the spans table.
+	name string
+
+	// suffix is appended to the name of a partition to name its index.
+	suffix string
+
+	// definition is what follows the name of the table in CREATE INDEX.
+	definition string
+}
+
+var (
+	spansTagsIndex = spansIndex{
+		name:       "idx_spans_tags",
+		suffix:     "tags_idx",
+		definition: "USING GIN (tags jsonb_path_ops)",
+	}
+
+	spansProcessTagsIndex = spansIndex{
+		name:       "idx_spans_process_tags",
+		suffix:     "process_tags_idx",
+		definition: "USING GIN (process_tags jsonb_path_ops)",
+	}
+
+	spansLogsIndex = spansIndex{
+		name:       "idx_spans_logs",
+		suffix:     "logs_idx",
+		definition: "USING GIN (logs jsonb_path_ops)",
+	}
+
+	spansEncodingVersion1Index = spansIndex{
+		name:       "idx_spans_encoding_version_1",
+		suffix:     "encoding_version_1_idx",
+		definition: "(hack_id) WHERE encoding_version < 2",
+	}
+)
+
+// SpansIndexOptions configures BuildSpansIndexes.
+type SpansIndexOptions struct {
+	// Logs builds the GIN index of the logs, which the tag searches need to
+	// use the GIN indexes. It adds to the cost of every write.
+	Logs bool
+}
+
+// ErrSpansIndexesLocked is returned by BuildSpansIndexes when another
+// jaeger-postgresql is already building the indexes.
+var ErrSpansIndexesLocked = errors.New("the spans indexes are being built by another process")
+
+// spansIndexesLockKey returns the key of the advisory lock held while the
+// indexes of the spans table are built.
+func spansIndexesLockKey() int64 {
+	h := fnv.New64a()
+	h.Write([]byte("jaeger-postgresql:spans-indexes"))
+	return int64(h.Sum64())
+}
+
+// BuildSpansIndexes builds the indexes of the spans table that are missing on
+// some of its partitions. The index of each partition is built concurrently,
+// so that the writers are not blocked, and is then attached to the index of
+// the spans table, which becomes valid once every partition has its index. A
+// partition created afterwards gets its indexes when it is created, so this
+// only has work to do after the indexes are added to the spans table. An index
+// left invalid by a failed build is dropped and built again.
+//
+// The build holds an advisory lock on conn, so that two jaeger-postgresql
+// never drop the index the other one is building, and returns
+// ErrSpansIndexesLocked when another one holds it. CREATE INDEX CONCURRENTLY
+// cannot run in a transaction, so conn must not be in one. It returns the
+// names of the indexes that were built.
+func BuildSpansIndexes(ctx context.Context, conn *pgx.Conn, logger *slog.Logger, opts SpansIndexOptions) ([]string, error) {
+	q := sql.New(conn)
+	key := spansIndexesLockKey()
+
+	locked, err := q.TryAdvisoryLock(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take the spans indexes lock: %w", err)
+	}
+
+	if !locked {
+		return nil, ErrSpansIndexesLocked
+	}
+
+	defer func() {
+		// the lock is released even when the build was canceled.
+		ctx, cancelFn := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancelFn()
+
+		if _, err := q.AdvisoryUnlock(ctx, key); err != nil {
+			// the lock is released with the connection when it is closed.
+			logger.Error("failed to release the spans indexes lock", "err", err)
+			conn.Close(ctx)
+		}
+	}()
+
+	return buildSpansIndexes(ctx, conn, q, logger, opts)
+}
+
+// buildSpansIndexes builds the missing indexes of BuildSpansIndexes, once its
+// lock is held.
+func buildSpansIndexes(ctx context.Context, db sql.DBTX, q *sql.Queries, logger *slog.Logger, opts SpansIndexOptions) ([]string, error) {
+	indexes := []spansIndex{spansTagsIndex, spansProcessTagsIndex, spansEncodingVersion1Index}
+	if opts.Logs {
+		indexes = append(indexes, spansLogsIndex)
+	}
+
+	var built []string
+	for _, index := range indexes {
+		create := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON ONLY spans %s", pgx.Identifier{index.name}.Sanitize(), index.definition)
+		if _, err := db.Exec(ctx, create); err != nil {
+			return built, fmt.Errorf("failed to create index %s: %w", index.name, err)
+		}
+
+		partitions, err := q.GetSpansPartitionsWithoutIndex(ctx, index.name)
+		if err != nil {
+			return built, fmt.Errorf("failed to get the partitions without index %s: %w", index.name, err)
+		}
+
+		for _, partition := range partitions {
+			name := partition.PartitionName + "_" + index.suffix
+			table := pgx.Identifier{partition.SchemaName, partition.PartitionName}.Sanitize()
+			child := pgx.Identifier{partition.SchemaName, name}.Sanitize()
+
+			logger.Info("building index", "index", name, "partition", partition.PartitionName)
+
+			statements := []string{
+				fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", child),
+				fmt.Sprintf("CREATE INDEX CONCURRENTLY %s ON %s %s", pgx.Identifier{name}.Sanitize(), table, index.definition),
+				fmt.Sprintf("ALTER INDEX %s ATTACH PARTITION %s", pgx.Identifier{index.name}.Sanitize(), child),
+			}
+
+			for _, statement := range statements {
+				if _, err := db.Exec(ctx, statement); err != nil {
+					return built, fmt.Errorf("failed to build index %s: %w", name, err)
+				}
+			}
+
+			built = append(built, name)
+		}
+	}
+
+	return built, nil
+}
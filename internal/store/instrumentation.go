@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"time"
 
@@ -75,6 +76,13 @@ var (
 		Name:      "find_trace_ids_errors_total",
 		Help:      "The total number of errors for FindTraceIDs",
 	})
+
+	// decoding
+	promDecodeErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "decode_errors_total",
+		Help:      "The total number of span fields that could not be decoded",
+	}, []string{"field"})
 )
 
 // writer
@@ -98,6 +106,54 @@ var (
 		Name:      "write_span_errors_total",
 		Help:      "The total number of errors returned from WriteSpan",
 	})
+
+	// id caches
+	promIDCacheHitsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "id_cache_hits_total",
+		Help:      "The total number of service and operation ids found in the writer's cache",
+	}, []string{"cache"})
+
+	promIDCacheMissesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "id_cache_misses_total",
+		Help:      "The total number of service and operation ids missing from the writer's cache",
+	}, []string{"cache"})
+)
+
+// batch writer
+
+var (
+	promWriteBatchCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "write_batch_total",
+		Help:      "The total number of batches flushed by the batch writer",
+	})
+
+	promWriteBatchHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: promNamespace,
+		Name:      "write_batch_seconds",
+		Help:      "The time spent writing a batch",
+	})
+
+	promWriteBatchSpansHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: promNamespace,
+		Name:      "write_batch_spans",
+		Help:      "The number of spans in a batch",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	})
+
+	promWriteBatchErrorsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "write_batch_errors_total",
+		Help:      "The total number of batches that failed to be written",
+	})
+
+	promWriteBatchDroppedSpansCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "write_batch_dropped_spans_total",
+		Help:      "The total number of spans dropped by the batch writer because they could not be written",
+	})
 )
 
 // NewInstrumentedWriter returns a new spanstore.Writer that is instrumented.
@@ -162,6 +218,12 @@ func (r *InstrumentedReader) GetTrace(ctx context.Context, traceID model.TraceID
 	}
 
 	trace, err := r.Reader.GetTrace(ctx, traceID)
+	if errors.Is(err, spanstore.ErrTraceNotFound) {
+		// a trace that is not found is not a failure of the store.
+		r.logger.Debug("trace not found", "trace_id", traceID)
+		return nil, err
+	}
+
 	if err != nil {
 		promGetTraceErrorsCounter.Inc()
 		r.logger.Error("failed to get trace", "err", err)
@@ -3,13 +3,17 @@ package store
 import (
 	"context"
 	"log/slog"
+	"math"
 	"testing"
 	"time"
 
 	"github.com/robbert229/jaeger-postgresql/internal/sql"
 	"github.com/robbert229/jaeger-postgresql/internal/sqltest"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/jaegertracing/jaeger/model"
 	jaeger_integration_tests "github.com/jaegertracing/jaeger/plugin/storage/integration"
@@ -30,7 +34,8 @@ func TestJaegerStorageIntegration(t *testing.T) {
 	si := jaeger_integration_tests.StorageIntegration{
 		SpanReader:                   reader,
 		SpanWriter:                   writer,
-		DependencyReader:             reader,
+		DependencyReader:             NewDependencyReader(q, logger.With("component", "dependency-reader")),
+		DependencyWriter:             NewDependencyWriter(q, logger.With("component", "dependency-writer")),
 		GetDependenciesReturnsSource: false,
 		CleanUp:                      cleanup,
 		Refresh:                      func() error { return nil },
@@ -79,4 +84,726 @@ func TestSpans(t *testing.T) {
 
 	require.Len(t, trace, 1)
 	require.Equal(t, span, trace[0].Spans[0])
+
+	_, err = r.GetTrace(ctx, model.NewTraceID(0, 42))
+	require.ErrorIs(t, err, spanstore.ErrTraceNotFound)
+
+	_, err = r.FindTraces(ctx, &spanstore.TraceQueryParameters{
+		ServiceName:  "service",
+		StartTimeMin: ts,
+		StartTimeMax: ts.Add(-time.Hour),
+		NumTraces:    100,
+	})
+	require.ErrorIs(t, err, ErrInvalidQuery)
+
+	expired, cancelFn := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancelFn()
+
+	_, err = r.GetTrace(expired, span.TraceID)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(ToGRPCError(err)))
+}
+
+func TestArchive(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewArchiveWriter(q, logger)
+	r := NewArchiveReader(q, logger, DecodeErrorPolicyFail)
+
+	ts := TruncateTime(time.Now())
+
+	span := &model.Span{
+		TraceID:       model.NewTraceID(0, 1),
+		SpanID:        model.NewSpanID(1),
+		OperationName: "operation",
+		Process:       model.NewProcess("service", []model.KeyValue{model.Bool("foo", true)}),
+		Logs:          []model.Log{{Timestamp: ts, Fields: []model.KeyValue{model.Bool("foo", false)}}},
+		Tags:          []model.KeyValue{model.Bool("fizzbuzz", true)},
+		References:    []model.SpanRef{},
+	}
+
+	// archiving the same span twice must not duplicate it.
+	require.Nil(t, w.WriteSpan(ctx, span))
+	require.Nil(t, w.WriteSpan(ctx, span))
+
+	trace, err := r.GetTrace(ctx, span.TraceID)
+	require.Nil(t, err)
+
+	require.Len(t, trace.Spans, 1)
+	require.Equal(t, span, trace.Spans[0])
+
+	// archived spans are kept apart from the spans that are cleaned.
+	_, err = q.CleanSpans(ctx, EncodeTimestamp(time.Now().Add(time.Hour)))
+	require.Nil(t, err)
+
+	trace, err = r.GetTrace(ctx, span.TraceID)
+	require.Nil(t, err)
+	require.Len(t, trace.Spans, 1)
+
+	_, err = r.GetTrace(ctx, model.NewTraceID(0, 42))
+	require.ErrorIs(t, err, spanstore.ErrTraceNotFound)
+}
+
+func TestBatchWriter(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewBatchWriter(NewWriter(q, logger), logger, BatchWriterOptions{Size: 2, FlushInterval: time.Hour})
+	r := NewReader(q, logger)
+
+	ts := TruncateTime(time.Now())
+
+	var spans []*model.Span
+	for i := 0; i < 3; i++ {
+		span := &model.Span{
+			TraceID:       model.NewTraceID(0, 2),
+			SpanID:        model.NewSpanID(uint64(i)),
+			OperationName: "operation",
+			Process:       model.NewProcess("service", []model.KeyValue{}),
+			StartTime:     ts,
+			Logs:          []model.Log{},
+			Tags:          []model.KeyValue{},
+			References:    []model.SpanRef{},
+		}
+
+		require.Nil(t, w.WriteSpan(ctx, span))
+		spans = append(spans, span)
+	}
+
+	// a span that cannot be encoded is dropped without the rest of its batch,
+	// which is the span before it.
+	require.Nil(t, w.WriteSpan(ctx, &model.Span{
+		TraceID:       model.NewTraceID(0, 2),
+		SpanID:        model.NewSpanID(3),
+		OperationName: "operation",
+		Process:       model.NewProcess("service", []model.KeyValue{}),
+		StartTime:     ts,
+		Logs:          []model.Log{},
+		Tags:          []model.KeyValue{model.Float64("ratio", math.NaN())},
+		References:    []model.SpanRef{},
+	}))
+
+	// a last span is only flushed when the writer is closed.
+	span := &model.Span{
+		TraceID:       model.NewTraceID(0, 2),
+		SpanID:        model.NewSpanID(4),
+		OperationName: "operation",
+		Process:       model.NewProcess("service", []model.KeyValue{}),
+		StartTime:     ts,
+		Logs:          []model.Log{},
+		Tags:          []model.KeyValue{},
+		References:    []model.SpanRef{},
+	}
+	require.Nil(t, w.WriteSpan(ctx, span))
+	spans = append(spans, span)
+
+	require.Nil(t, w.Close())
+	require.ErrorIs(t, w.WriteSpan(ctx, spans[0]), ErrBatchWriterClosed)
+
+	trace, err := r.GetTrace(ctx, model.NewTraceID(0, 2))
+	require.Nil(t, err)
+
+	require.ElementsMatch(t, spans, trace.Spans)
+}
+
+func TestPartitions(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	// the partitions covering the next couple of days overlap with the
+	// legacy partition, so partitions are created well after it.
+	now := time.Now().AddDate(0, 0, 7)
+
+	created, err := CreatePartitions(ctx, q, now, PartitionIntervalDay, 1)
+	require.Nil(t, err)
+	require.Len(t, created, 2)
+
+	// creating the partitions again is a no-op.
+	created, err = CreatePartitions(ctx, q, now, PartitionIntervalDay, 1)
+	require.Nil(t, err)
+	require.Empty(t, created)
+
+	dropped, err := DropPartitions(ctx, q, PartitionIntervalDay.Next(PartitionIntervalDay.Truncate(now)))
+	require.Nil(t, err)
+	require.Equal(t, []string{"spans_legacy", "spans_" + PartitionIntervalDay.Truncate(now).Format("2006010215")}, dropped)
+}
+
+func TestDefaultPartition(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewBatchWriter(NewWriter(q, logger), logger, BatchWriterOptions{Size: 2, FlushInterval: time.Hour})
+	r := NewReader(q, logger)
+
+	// a span a year ahead is not covered by any partition, and must not fail
+	// the batch it is copied with.
+	ts := TruncateTime(time.Now())
+	ahead := ts.AddDate(1, 0, 0)
+
+	var spans []*model.Span
+	for i, startTime := range []time.Time{ts, ahead} {
+		span := &model.Span{
+			TraceID:       model.NewTraceID(0, 9),
+			SpanID:        model.NewSpanID(uint64(i + 1)),
+			OperationName: "operation",
+			Process:       model.NewProcess("service", []model.KeyValue{}),
+			StartTime:     startTime,
+			Logs:          []model.Log{},
+			Tags:          []model.KeyValue{},
+			References:    []model.SpanRef{},
+		}
+
+		require.Nil(t, w.WriteSpan(ctx, span))
+		spans = append(spans, span)
+	}
+	require.Nil(t, w.Close())
+
+	trace, err := r.GetTrace(ctx, model.NewTraceID(0, 9))
+	require.Nil(t, err)
+	require.ElementsMatch(t, spans, trace.Spans)
+
+	var count int64
+	require.Nil(t, conn.QueryRow(ctx, "SELECT COUNT(*) FROM spans_default").Scan(&count))
+	require.Equal(t, int64(1), count)
+
+	// creating the partition of the span moves it out of the default
+	// partition.
+	created, err := CreatePartitions(ctx, q, ahead, PartitionIntervalDay, 0)
+	require.Nil(t, err)
+	require.Len(t, created, 1)
+
+	require.Nil(t, conn.QueryRow(ctx, "SELECT COUNT(*) FROM spans_default").Scan(&count))
+	require.Zero(t, count)
+
+	require.Nil(t, conn.QueryRow(ctx, "SELECT COUNT(*) FROM "+created[0]).Scan(&count))
+	require.Equal(t, int64(1), count)
+
+	trace, err = r.GetTrace(ctx, model.NewTraceID(0, 9))
+	require.Nil(t, err)
+	require.ElementsMatch(t, spans, trace.Spans)
+}
+
+func TestBuildSpansIndexes(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewWriter(q, logger)
+	r := NewReaderWithOptions(q, logger, ReaderOptions{IndexedLogs: true})
+
+	_, err := CreatePartitions(ctx, q, time.Now().AddDate(0, 0, 7), PartitionIntervalDay, 0)
+	require.Nil(t, err)
+
+	// the indexes are not built while another process holds the lock.
+	other, err := pgx.ConnectConfig(ctx, conn.Config())
+	require.Nil(t, err)
+	defer other.Close(ctx)
+
+	locked, err := sql.New(other).TryAdvisoryLock(ctx, spansIndexesLockKey())
+	require.Nil(t, err)
+	require.True(t, locked)
+
+	_, err = BuildSpansIndexes(ctx, conn, logger, SpansIndexOptions{Logs: true})
+	require.ErrorIs(t, err, ErrSpansIndexesLocked)
+
+	_, err = sql.New(other).AdvisoryUnlock(ctx, spansIndexesLockKey())
+	require.Nil(t, err)
+
+	built, err := BuildSpansIndexes(ctx, conn, logger, SpansIndexOptions{Logs: true})
+	require.Nil(t, err)
+	require.NotEmpty(t, built)
+
+	// every partition has its indexes, so building them again is a no-op.
+	built, err = BuildSpansIndexes(ctx, conn, logger, SpansIndexOptions{Logs: true})
+	require.Nil(t, err)
+	require.Empty(t, built)
+
+	var invalid int64
+	require.Nil(t, conn.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM pg_index
+		WHERE indrelid = 'spans'::regclass AND NOT indisvalid
+	`).Scan(&invalid))
+	require.Zero(t, invalid)
+
+	span := &model.Span{
+		TraceID:       model.NewTraceID(0, 11),
+		SpanID:        model.NewSpanID(1),
+		OperationName: "operation",
+		Process:       model.NewProcess("service", []model.KeyValue{}),
+		StartTime:     TruncateTime(time.Now()),
+		Logs: []model.Log{
+			{Timestamp: TruncateTime(time.Now()), Fields: []model.KeyValue{model.String("event", "retry")}},
+		},
+		Tags:       []model.KeyValue{model.Int64("http.status_code", 500)},
+		References: []model.SpanRef{},
+	}
+	require.Nil(t, w.WriteSpan(ctx, span))
+
+	// the tag searches find the span both by its tags and by its logs.
+	for _, tags := range []map[string]string{{"http.status_code": "500"}, {"event": "retry"}} {
+		ids, err := r.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+			ServiceName: "service",
+			Tags:        tags,
+			NumTraces:   10,
+		})
+		require.Nil(t, err)
+		require.Equal(t, []model.TraceID{span.TraceID}, ids)
+	}
+}
+
+func TestCleanSpans(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewWriter(q, logger)
+	r := NewReader(q, logger)
+
+	ts := TruncateTime(time.Now())
+
+	for i := 0; i < 6; i++ {
+		// the first five spans are expired, the last one is kept.
+		startTime := ts.Add(-time.Hour * time.Duration(6-i))
+		if i == 5 {
+			startTime = ts
+		}
+
+		span := &model.Span{
+			TraceID:       model.NewTraceID(0, 3),
+			SpanID:        model.NewSpanID(uint64(i)),
+			OperationName: "operation",
+			Process:       model.NewProcess("service", []model.KeyValue{}),
+			StartTime:     startTime,
+			Logs:          []model.Log{},
+			Tags:          []model.KeyValue{},
+			References:    []model.SpanRef{},
+		}
+
+		require.Nil(t, w.WriteSpan(ctx, span))
+	}
+
+	count, err := CleanSpans(ctx, q, logger, ts.Add(-time.Minute), CleanOptions{BatchSize: 2})
+	require.Nil(t, err)
+	require.Equal(t, int64(5), count)
+
+	trace, err := r.GetTrace(ctx, model.NewTraceID(0, 3))
+	require.Nil(t, err)
+	require.Len(t, trace.Spans, 1)
+	require.Equal(t, model.NewSpanID(5), trace.Spans[0].SpanID)
+
+	// cleaning again resumes with nothing left to delete.
+	count, err = CleanSpans(ctx, q, logger, ts.Add(-time.Minute), CleanOptions{BatchSize: 2})
+	require.Nil(t, err)
+	require.Equal(t, int64(0), count)
+}
+
+func TestCleanSpansByRetention(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewWriter(q, logger)
+	r := NewReader(q, logger)
+
+	ts := TruncateTime(time.Now())
+
+	spans := []*model.Span{
+		{
+			TraceID:       model.NewTraceID(0, 4),
+			SpanID:        model.NewSpanID(1),
+			OperationName: "charge",
+			Process:       model.NewProcess("payments", []model.KeyValue{}),
+			StartTime:     ts.Add(-time.Hour * 48),
+		},
+		{
+			TraceID:       model.NewTraceID(0, 4),
+			SpanID:        model.NewSpanID(2),
+			OperationName: "get",
+			Process:       model.NewProcess("internal", []model.KeyValue{}),
+			StartTime:     ts.Add(-time.Hour * 48),
+		},
+		{
+			TraceID:       model.NewTraceID(0, 4),
+			SpanID:        model.NewSpanID(3),
+			OperationName: "get",
+			Process:       model.NewProcess("internal", []model.KeyValue{model.String("env", "dev")}),
+			StartTime:     ts.Add(-time.Hour * 2),
+		},
+		{
+			TraceID:       model.NewTraceID(0, 4),
+			SpanID:        model.NewSpanID(4),
+			OperationName: "get",
+			Process:       model.NewProcess("internal", []model.KeyValue{}),
+			StartTime:     ts.Add(-time.Hour * 2),
+		},
+	}
+
+	for _, span := range spans {
+		span.Logs = []model.Log{}
+		span.Tags = []model.KeyValue{}
+		span.References = []model.SpanRef{}
+		require.Nil(t, w.WriteSpan(ctx, span))
+	}
+
+	policy := RetentionPolicy{
+		Default: time.Hour * 24,
+		Rules: []RetentionRule{
+			{Service: "payments", MaxAge: time.Hour * 24 * 30},
+			{Tag: "env=dev", MaxAge: time.Hour},
+		},
+	}
+
+	// the report lists what would be deleted without deleting anything.
+	reports, total, err := ReportSpansByRetention(ctx, q, ts, policy)
+	require.Nil(t, err)
+	require.Len(t, reports, 1)
+	require.Equal(t, "internal", reports[0].Service)
+	require.Equal(t, int64(2), reports[0].Spans)
+	require.Equal(t, int64(1), reports[0].Traces)
+	require.Greater(t, reports[0].Bytes, int64(0))
+	require.Equal(t, RetentionReport{Spans: 2, Traces: 1, Bytes: reports[0].Bytes}, total)
+
+	// a trace spanning several services is counted once by the total.
+	reports, total, err = ReportSpansByRetention(ctx, q, ts, RetentionPolicy{Default: time.Hour})
+	require.Nil(t, err)
+	require.Len(t, reports, 2)
+	require.Equal(t, "internal", reports[0].Service)
+	require.Equal(t, int64(1), reports[0].Traces)
+	require.Equal(t, "payments", reports[1].Service)
+	require.Equal(t, int64(1), reports[1].Traces)
+	require.Equal(t, int64(4), total.Spans)
+	require.Equal(t, int64(1), total.Traces)
+	require.Equal(t, reports[0].Bytes+reports[1].Bytes, total.Bytes)
+
+	count, err := CleanSpansByRetention(ctx, q, logger, ts, policy, CleanOptions{BatchSize: 1})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), count)
+
+	trace, err := r.GetTrace(ctx, model.NewTraceID(0, 4))
+	require.Nil(t, err)
+	require.ElementsMatch(t, []*model.Span{spans[0], spans[3]}, trace.Spans)
+}
+
+func TestCleanSpansToBudget(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewWriter(q, logger)
+	r := NewReader(q, logger)
+
+	ts := TruncateTime(time.Now())
+
+	for i := 0; i < 4; i++ {
+		// the last span is younger than the minimum retention.
+		startTime := ts.Add(-time.Hour * time.Duration(8-i))
+		if i == 3 {
+			startTime = ts
+		}
+
+		span := &model.Span{
+			TraceID:       model.NewTraceID(0, 5),
+			SpanID:        model.NewSpanID(uint64(i)),
+			OperationName: "operation",
+			Process:       model.NewProcess("service", []model.KeyValue{}),
+			StartTime:     startTime,
+			Logs:          []model.Log{},
+			Tags:          []model.KeyValue{},
+			References:    []model.SpanRef{},
+		}
+
+		require.Nil(t, w.WriteSpan(ctx, span))
+	}
+
+	// the number of spans is estimated from the table statistics.
+	_, err := conn.Exec(ctx, "ANALYZE spans")
+	require.Nil(t, err)
+
+	size, err := q.GetSpansDiskSize(ctx)
+	require.Nil(t, err)
+
+	// a target above the budget is rejected.
+	_, err = CleanSpansToBudget(ctx, q, logger, ts, DiskBudget{MaxBytes: size, TargetBytes: size + 1}, CleanOptions{})
+	require.NotNil(t, err)
+
+	// the table fits in the budget, so nothing is deleted.
+	report, err := CleanSpansToBudget(ctx, q, logger, ts, DiskBudget{MaxBytes: size, MinAge: time.Hour}, CleanOptions{})
+	require.Nil(t, err)
+	require.Equal(t, size, report.SizeBytes)
+	require.Equal(t, int64(0), report.Spans)
+
+	// the target leaves room for two spans of the average size, so the two
+	// oldest spans are deleted.
+	spanSize := (size + 3) / 4
+	budget := DiskBudget{MaxBytes: size - 1, TargetBytes: size - 2*spanSize, MinAge: time.Hour}
+
+	report, err = CleanSpansToBudget(ctx, q, logger, ts, budget, CleanOptions{BatchSize: 1})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), report.Spans)
+	require.Equal(t, 2*spanSize, report.EstimatedBytes)
+	require.Equal(t, ts.Add(-6*time.Hour).UTC(), report.OldestSpan.UTC())
+
+	// a budget smaller than a span deletes every span older than the minimum
+	// retention.
+	report, err = CleanSpansToBudget(ctx, q, logger, ts, DiskBudget{MaxBytes: 1, MinAge: time.Hour}, CleanOptions{BatchSize: 2})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), report.Spans)
+	require.Equal(t, ts.UTC(), report.OldestSpan.UTC())
+
+	trace, err := r.GetTrace(ctx, model.NewTraceID(0, 5))
+	require.Nil(t, err)
+	require.Len(t, trace.Spans, 1)
+}
+
+func TestPruneUnused(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewWriter(q, logger)
+	r := NewReader(q, logger)
+
+	ts := TruncateTime(time.Now())
+
+	newSpan := func(service string, startTime time.Time) *model.Span {
+		return &model.Span{
+			TraceID:       model.NewTraceID(0, 6),
+			SpanID:        model.NewSpanID(uint64(startTime.UnixNano())),
+			OperationName: "operation",
+			Process:       model.NewProcess(service, []model.KeyValue{}),
+			StartTime:     startTime,
+			Logs:          []model.Log{},
+			Tags:          []model.KeyValue{},
+			References:    []model.SpanRef{},
+		}
+	}
+
+	require.Nil(t, w.WriteSpan(ctx, newSpan("decommissioned", ts.Add(-time.Hour*48))))
+	require.Nil(t, w.WriteSpan(ctx, newSpan("active", ts)))
+
+	_, err := CleanSpans(ctx, q, logger, ts.Add(-time.Hour), CleanOptions{})
+	require.Nil(t, err)
+
+	report, err := PruneUnused(ctx, q, logger)
+	require.Nil(t, err)
+	require.Equal(t, PruneReport{Services: 1, Operations: 1}, report)
+
+	services, err := r.GetServices(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"active"}, services)
+
+	// the writer still caches the ids of the pruned service and operation.
+	span := newSpan("decommissioned", ts.Add(time.Second))
+	require.Nil(t, w.WriteSpan(ctx, span))
+	require.Nil(t, w.WriteSpans(ctx, []*model.Span{newSpan("decommissioned", ts.Add(time.Second*2))}))
+
+	services, err = r.GetServices(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"active", "decommissioned"}, services)
+}
+
+func TestVerifySpans(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewWriter(q, logger)
+	r := NewReader(q, logger)
+
+	ts := TruncateTime(time.Now())
+	traceID := model.NewTraceID(0, 7)
+
+	for i := 1; i <= 3; i++ {
+		require.Nil(t, w.WriteSpan(ctx, &model.Span{
+			TraceID:       traceID,
+			SpanID:        model.NewSpanID(uint64(i)),
+			OperationName: "operation",
+			Process:       model.NewProcess("service", []model.KeyValue{}),
+			StartTime:     ts.Add(time.Duration(i) * time.Second),
+			Logs:          []model.Log{},
+			Tags:          []model.KeyValue{},
+			References:    []model.SpanRef{},
+		}))
+	}
+
+	_, err := conn.Exec(ctx, "UPDATE spans SET logs = '[1]' WHERE span_id = $1", EncodeSpanID(model.NewSpanID(2)))
+	require.Nil(t, err)
+
+	_, err = r.GetTrace(ctx, traceID)
+	require.ErrorContains(t, err, "failed to decode logs")
+
+	report, err := VerifySpans(ctx, q, logger, VerifyOptions{Service: "service", BatchSize: 2})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), report.Spans)
+	require.Len(t, report.Corrupt, 1)
+	require.Equal(t, "0000000000000002", report.Corrupt[0].SpanID)
+	require.False(t, report.Corrupt[0].Quarantined)
+
+	report, err = VerifySpans(ctx, q, logger, VerifyOptions{StartTimeMin: ts.Add(time.Second * 3)})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), report.Spans)
+	require.Empty(t, report.Corrupt)
+
+	report, err = VerifySpans(ctx, q, logger, VerifyOptions{Quarantine: true})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), report.Quarantined())
+
+	trace, err := r.GetTrace(ctx, traceID)
+	require.Nil(t, err)
+	require.Len(t, trace.Spans, 2)
+
+	var quarantined int64
+	require.Nil(t, conn.QueryRow(ctx, "SELECT COUNT(*) FROM quarantined_spans").Scan(&quarantined))
+	require.Equal(t, int64(1), quarantined)
+}
+
+func TestReencodeSpans(t *testing.T) {
+	conn, cleanup, closer := sqltest.Harness(t)
+	defer closer.Close()
+
+	require.Nil(t, cleanup())
+
+	ctx := context.Background()
+
+	q := sql.New(conn)
+
+	logger := slog.Default()
+	w := NewWriter(q, logger)
+	r := NewReader(q, logger)
+
+	ts := TruncateTime(time.Now())
+	traceID := model.NewTraceID(0, 8)
+
+	for i := 1; i <= 3; i++ {
+		require.Nil(t, w.WriteSpan(ctx, &model.Span{
+			TraceID:       traceID,
+			SpanID:        model.NewSpanID(uint64(i)),
+			OperationName: "operation",
+			Process:       model.NewProcess("service", []model.KeyValue{}),
+			StartTime:     ts.Add(time.Duration(i) * time.Second),
+			Logs:          []model.Log{},
+			Tags:          []model.KeyValue{model.String("key", "value")},
+			References:    []model.SpanRef{},
+		}))
+	}
+
+	// the spans written by the writer are in the current version already.
+	count, err := ReencodeSpans(ctx, q, logger, ReencodeOptions{BatchSize: 2})
+	require.Nil(t, err)
+	require.Zero(t, count)
+
+	// a span in a version that cannot be decoded is skipped rather than
+	// stopping the job.
+	_, err = conn.Exec(ctx, "UPDATE spans SET encoding_version = 0 WHERE span_id = $1", EncodeSpanID(model.NewSpanID(2)))
+	require.Nil(t, err)
+
+	count, err = ReencodeSpans(ctx, q, logger, ReencodeOptions{BatchSize: 2})
+	require.Nil(t, err)
+	require.Zero(t, count)
+
+	// a span in the first version is re-encoded, and its tags become
+	// searchable by containment.
+	tags, err := encodeTagsV1([]model.KeyValue{model.String("key", "value")})
+	require.Nil(t, err)
+
+	_, err = conn.Exec(ctx, "UPDATE spans SET tags = $1, encoding_version = 1 WHERE span_id = $2", tags, EncodeSpanID(model.NewSpanID(3)))
+	require.Nil(t, err)
+
+	count, err = ReencodeSpans(ctx, q, logger, ReencodeOptions{BatchSize: 2})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), count)
+
+	var matched int64
+	require.Nil(t, conn.QueryRow(ctx, `SELECT COUNT(*) FROM spans WHERE tags @> '{"key": "value"}'`).Scan(&matched))
+	require.Equal(t, int64(2), matched)
+
+	// the archived spans are re-encoded as well.
+	archived := &model.Span{
+		TraceID:       model.NewTraceID(0, 10),
+		SpanID:        model.NewSpanID(1),
+		OperationName: "operation",
+		Process:       model.NewProcess("service", []model.KeyValue{}),
+		StartTime:     ts,
+		Logs:          []model.Log{},
+		Tags:          []model.KeyValue{model.String("key", "value")},
+		References:    []model.SpanRef{},
+	}
+	require.Nil(t, NewArchiveWriter(q, logger).WriteSpan(ctx, archived))
+
+	_, err = conn.Exec(ctx, "UPDATE archived_spans SET tags = $1, encoding_version = 1", tags)
+	require.Nil(t, err)
+
+	count, err = ReencodeSpans(ctx, q, logger, ReencodeOptions{BatchSize: 2})
+	require.Nil(t, err)
+	require.Equal(t, int64(1), count)
+
+	require.Nil(t, conn.QueryRow(ctx, `SELECT COUNT(*) FROM archived_spans WHERE tags @> '{"key": "value"}'`).Scan(&matched))
+	require.Equal(t, int64(1), matched)
+
+	_, err = r.GetTrace(ctx, traceID)
+	require.ErrorContains(t, err, "unknown encoding version 0")
 }
@@ -1,11 +1,17 @@
 package store
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/robbert229/jaeger-postgresql/internal/sql"
@@ -15,29 +21,153 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
-// DecodeTraceID converts a slice of raw bytes into a trace id.
-func DecodeTraceID(raw []byte) model.TraceID {
-	low := binary.LittleEndian.Uint64(raw[0:8])
-	high := binary.LittleEndian.Uint64(raw[8:16])
-	return model.NewTraceID(low, high)
+// DecodeTraceID converts a slice of raw bytes into a trace id. The trace id is
+// stored in the 16 byte big-endian layout of W3C trace context, so that the hex
+// encoding of the stored bytes matches the trace id shown by jaeger.
+func DecodeTraceID(raw []byte) (model.TraceID, error) {
+	if len(raw) != 16 {
+		return model.TraceID{}, fmt.Errorf("invalid trace id: expected 16 bytes, got %d", len(raw))
+	}
+
+	high := binary.BigEndian.Uint64(raw[0:8])
+	low := binary.BigEndian.Uint64(raw[8:16])
+	return model.NewTraceID(high, low), nil
 }
 
 // EncodeTraceID converts a trace id to a slice of raw bytes.
 func EncodeTraceID(traceID model.TraceID) []byte {
-	raw := []byte{}
-	raw = binary.LittleEndian.AppendUint64(raw, traceID.High)
-	raw = binary.LittleEndian.AppendUint64(raw, traceID.Low)
+	raw := make([]byte, 0, 16)
+	raw = binary.BigEndian.AppendUint64(raw, traceID.High)
+	raw = binary.BigEndian.AppendUint64(raw, traceID.Low)
 	return raw
 }
 
-// EncodeSpanID encodes a span id into a slice of bytes.
+// EncodeSpanID encodes a span id into the 8 byte big-endian layout of W3C trace
+// context.
 func EncodeSpanID(spanID model.SpanID) []byte {
-	return binary.LittleEndian.AppendUint64(nil, uint64(spanID))
+	return binary.BigEndian.AppendUint64(nil, uint64(spanID))
 }
 
 // DecodeSpanID decodes a span id form a byte slice.
-func DecodeSpanID(raw []byte) model.SpanID {
-	return model.NewSpanID(binary.LittleEndian.Uint64(raw))
+func DecodeSpanID(raw []byte) (model.SpanID, error) {
+	if len(raw) != 8 {
+		return 0, fmt.Errorf("invalid span id: expected 8 bytes, got %d", len(raw))
+	}
+
+	return model.NewSpanID(binary.BigEndian.Uint64(raw)), nil
+}
+
+// EncodingVersion identifies the layout of the jsonb encoded tags, logs and
+// references of a span. It is stored alongside every span, so that the layout
+// can evolve while the spans written in an older layout stay readable.
+type EncodingVersion int16
+
+const (
+	// EncodingVersion1 encodes tags as [key, type, value] arrays, logs as
+	// [timestamp, fields] arrays and references as [trace_id, span_id,
+	// ref_type] arrays.
+	EncodingVersion1 EncodingVersion = 1
+
+	// EncodingVersion2 encodes tags as an object of their keys to their
+	// values, so that they can be filtered with the jsonb containment operator
+	// and indexed by GIN indexes. Strings and bools are stored as json strings
+	// and bools, int64s as json integers, float64s as json numbers with a
+	// fraction, and binaries as {"binary": base64} objects. The values of a
+	// key set by several tags are stored in an array. Tags are decoded in the
+	// order of their keys. Logs are [timestamp, fields] arrays whose fields
+	// are encoded as tags, and references are encoded as in EncodingVersion1.
+	EncodingVersion2 EncodingVersion = 2
+
+	// CurrentEncodingVersion is the layout spans are written in. The spans
+	// in an older layout are found by the encoding version hard-coded in the
+	// queries of the re-encoding job and in idx_spans_encoding_version_1,
+	// which must be raised along with it.
+	CurrentEncodingVersion = EncodingVersion2
+)
+
+// errUnknownEncodingVersion returns the error of a span stored in a layout that
+// is unknown to this version of jaeger-postgresql.
+func errUnknownEncodingVersion(version EncodingVersion) error {
+	return fmt.Errorf("unknown encoding version %d", version)
+}
+
+// decodeErrorHandler is called with the error of an element of a field that
+// cannot be decoded, such as a single tag or log. The element is dropped when
+// it returns nil, and decoding fails with the error it returns otherwise.
+type decodeErrorHandler func(err error) error
+
+// failOnDecodeError fails decoding on the first element that cannot be
+// decoded.
+func failOnDecodeError(err error) error {
+	return err
+}
+
+// EncodeTags encodes tags in the current encoding version.
+func EncodeTags(input []model.KeyValue) ([]byte, error) {
+	return encodeTagsV2(input)
+}
+
+// DecodeTags decodes tags encoded in the given encoding version.
+func DecodeTags(version EncodingVersion, input []byte) ([]model.KeyValue, error) {
+	return decodeTags(version, input, failOnDecodeError)
+}
+
+// decodeTags decodes tags encoded in the given encoding version, the tags that
+// cannot be decoded being handled by onError.
+func decodeTags(version EncodingVersion, input []byte, onError decodeErrorHandler) ([]model.KeyValue, error) {
+	switch version {
+	case EncodingVersion1:
+		return decodeTagsV1(input, onError)
+	case EncodingVersion2:
+		return decodeTagsV2(input, onError)
+	default:
+		return nil, errUnknownEncodingVersion(version)
+	}
+}
+
+// EncodeLogs encodes logs in the current encoding version.
+func EncodeLogs(logs []model.Log) ([]byte, error) {
+	return encodeLogsV2(logs)
+}
+
+// DecodeLogs decodes logs encoded in the given encoding version.
+func DecodeLogs(version EncodingVersion, raw []byte) ([]model.Log, error) {
+	return decodeLogs(version, raw, failOnDecodeError)
+}
+
+// decodeLogs decodes logs encoded in the given encoding version, the logs and
+// the fields of the logs that cannot be decoded being handled by onError.
+func decodeLogs(version EncodingVersion, raw []byte, onError decodeErrorHandler) ([]model.Log, error) {
+	switch version {
+	case EncodingVersion1:
+		return decodeLogsV1(raw, onError)
+	case EncodingVersion2:
+		return decodeLogsV2(raw, onError)
+	default:
+		return nil, errUnknownEncodingVersion(version)
+	}
+}
+
+// EncodeSpanRefs encodes span references in the current encoding version.
+func EncodeSpanRefs(spanrefs []model.SpanRef) ([]byte, error) {
+	return encodeSpanRefsV1(spanrefs)
+}
+
+// DecodeSpanRefs decodes span references encoded in the given encoding
+// version.
+func DecodeSpanRefs(version EncodingVersion, data []byte) ([]model.SpanRef, error) {
+	return decodeSpanRefs(version, data, failOnDecodeError)
+}
+
+// decodeSpanRefs decodes span references encoded in the given encoding
+// version, the references that cannot be decoded being handled by onError.
+func decodeSpanRefs(version EncodingVersion, data []byte, onError decodeErrorHandler) ([]model.SpanRef, error) {
+	switch version {
+	case EncodingVersion1, EncodingVersion2:
+		return decodeSpanRefsV1(data, onError)
+	default:
+		return nil, errUnknownEncodingVersion(version)
+	}
 }
 
 func EncodeInterval(duration time.Duration) pgtype.Interval {
@@ -75,7 +205,7 @@ func encodeTagsToSlice(input []model.KeyValue) [][]any {
 	return slice
 }
 
-func EncodeTags(input []model.KeyValue) ([]byte, error) {
+func encodeTagsV1(input []model.KeyValue) ([]byte, error) {
 	slice := encodeTagsToSlice(input)
 
 	bytes, err := json.Marshal(slice)
@@ -86,37 +216,16 @@ func EncodeTags(input []model.KeyValue) ([]byte, error) {
 	return bytes, nil
 }
 
-func decodeTagsFromSlice(slice []any) ([]model.KeyValue, error) {
+func decodeTagsFromSlice(slice []any, onError decodeErrorHandler) ([]model.KeyValue, error) {
 	var tags []model.KeyValue
-	for _, subslice := range slice {
-		cast := subslice.([]any)
-
-		key := cast[0].(string)
-		vType := model.ValueType(int(cast[1].(float64)))
-		value := cast[2]
-
-		kv := model.KeyValue{Key: key, VType: vType}
-		switch vType {
-		case model.StringType:
-			kv.VStr = value.(string)
-		case model.BoolType:
-			kv.VBool = value.(bool)
-		case model.Int64Type:
-			parsed, err := strconv.ParseInt(value.(string), 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse int: %w", err)
-			}
-
-			kv.VInt64 = parsed
-		case model.Float64Type:
-			kv.VFloat64 = value.(float64)
-		case model.BinaryType:
-			bytes, err := base64.RawStdEncoding.DecodeString(value.(string))
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse: %w", err)
+	for i, subslice := range slice {
+		kv, err := decodeTag(subslice)
+		if err != nil {
+			if err := onError(fmt.Errorf("invalid tag %d: %w", i, err)); err != nil {
+				return nil, err
 			}
 
-			kv.VBinary = bytes
+			continue
 		}
 
 		tags = append(tags, kv)
@@ -131,19 +240,285 @@ func decodeTagsFromSlice(slice []any) ([]model.KeyValue, error) {
 	return tags, nil
 }
 
-func DecodeTags(input []byte) ([]model.KeyValue, error) {
+// decodeTag decodes a tag encoded as a [key, type, value] array.
+func decodeTag(raw any) (model.KeyValue, error) {
+	cast, ok := raw.([]any)
+	if !ok || len(cast) != 3 {
+		return model.KeyValue{}, fmt.Errorf("expected a [key, type, value] array, got %s", describeJSON(raw))
+	}
+
+	key, ok := cast[0].(string)
+	if !ok {
+		return model.KeyValue{}, fmt.Errorf("expected a string key, got %s", describeJSON(cast[0]))
+	}
+
+	rawType, ok := cast[1].(float64)
+	if !ok {
+		return model.KeyValue{}, fmt.Errorf("expected a numeric type for %q, got %s", key, describeJSON(cast[1]))
+	}
+
+	vType := model.ValueType(int32(rawType))
+	value := cast[2]
+
+	kv := model.KeyValue{Key: key, VType: vType}
+	switch vType {
+	case model.StringType:
+		str, ok := value.(string)
+		if !ok {
+			return kv, fmt.Errorf("expected a string value for %q, got %s", key, describeJSON(value))
+		}
+
+		kv.VStr = str
+	case model.BoolType:
+		b, ok := value.(bool)
+		if !ok {
+			return kv, fmt.Errorf("expected a bool value for %q, got %s", key, describeJSON(value))
+		}
+
+		kv.VBool = b
+	case model.Int64Type:
+		str, ok := value.(string)
+		if !ok {
+			return kv, fmt.Errorf("expected a string encoded int value for %q, got %s", key, describeJSON(value))
+		}
+
+		parsed, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return kv, fmt.Errorf("failed to parse int value for %q: %w", key, err)
+		}
+
+		kv.VInt64 = parsed
+	case model.Float64Type:
+		f, ok := value.(float64)
+		if !ok {
+			return kv, fmt.Errorf("expected a float value for %q, got %s", key, describeJSON(value))
+		}
+
+		kv.VFloat64 = f
+	case model.BinaryType:
+		str, ok := value.(string)
+		if !ok {
+			return kv, fmt.Errorf("expected a base64 encoded binary value for %q, got %s", key, describeJSON(value))
+		}
+
+		bytes, err := base64.RawStdEncoding.DecodeString(str)
+		if err != nil {
+			return kv, fmt.Errorf("failed to parse binary value for %q: %w", key, err)
+		}
+
+		kv.VBinary = bytes
+	default:
+		return kv, fmt.Errorf("unknown value type %v for %q", rawType, key)
+	}
+
+	return kv, nil
+}
+
+// describeJSON describes a decoded json value in error messages.
+func describeJSON(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case float64, json.Number:
+		return "a number"
+	case bool:
+		return "a bool"
+	case []any:
+		return fmt.Sprintf("an array of length %d", len(value))
+	case map[string]any:
+		return "an object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func decodeTagsV1(input []byte, onError decodeErrorHandler) ([]model.KeyValue, error) {
 	slice := []any{}
 	if err := json.Unmarshal(input, &slice); err != nil {
 		return nil, fmt.Errorf("failed to decode tag json: %w", err)
 	}
 
-	tags, err := decodeTagsFromSlice(slice)
+	tags, err := decodeTagsFromSlice(slice, onError)
 	if err != nil {
 		return nil, err
 	}
 
 	return tags, nil
+}
+
+// encodeTagsToObject encodes tags as an object of their keys to their values,
+// in the layout of EncodingVersion2.
+func encodeTagsToObject(input []model.KeyValue) (map[string]any, error) {
+	object := make(map[string]any, len(input))
+	for _, kv := range input {
+		value, err := encodeTagValueV2(kv)
+		if err != nil {
+			return nil, err
+		}
+
+		// values are never arrays themselves, so an array holds the values
+		// of a key set by several tags.
+		existing, ok := object[kv.Key]
+		if !ok {
+			object[kv.Key] = value
+			continue
+		}
+
+		if values, ok := existing.([]any); ok {
+			object[kv.Key] = append(values, value)
+		} else {
+			object[kv.Key] = []any{existing, value}
+		}
+	}
+
+	return object, nil
+}
+
+// encodeTagValueV2 encodes the value of a tag as a json value whose type is
+// the type of the tag.
+func encodeTagValueV2(kv model.KeyValue) (any, error) {
+	switch kv.VType {
+	case model.StringType:
+		return kv.VStr, nil
+	case model.BoolType:
+		return kv.VBool, nil
+	case model.Int64Type:
+		return json.Number(strconv.FormatInt(kv.VInt64, 10)), nil
+	case model.Float64Type:
+		if math.IsNaN(kv.VFloat64) || math.IsInf(kv.VFloat64, 0) {
+			return nil, fmt.Errorf("unsupported float value %v for %q", kv.VFloat64, kv.Key)
+		}
+
+		// floats always have a fraction, which jsonb preserves, so that they
+		// are told apart from ints when they are decoded. The exponent
+		// notation is avoided since jsonb does not preserve it.
+		str := strconv.FormatFloat(kv.VFloat64, 'f', -1, 64)
+		if !strings.Contains(str, ".") {
+			str += ".0"
+		}
+
+		return json.Number(str), nil
+	case model.BinaryType:
+		return map[string]any{"binary": base64.RawStdEncoding.EncodeToString(kv.VBinary)}, nil
+	default:
+		return nil, fmt.Errorf("unknown value type %v for %q", kv.VType, kv.Key)
+	}
+}
+
+func encodeTagsV2(input []model.KeyValue) ([]byte, error) {
+	object, err := encodeTagsToObject(input)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode to json: %w", err)
+	}
+
+	return bytes, nil
+}
+
+func decodeTagsV2(input []byte, onError decodeErrorHandler) ([]model.KeyValue, error) {
+	object := map[string]any{}
+	if err := decodeJSONNumbers(input, &object); err != nil {
+		return nil, fmt.Errorf("failed to decode tag json: %w", err)
+	}
+
+	return decodeTagsFromObject(object, onError)
+}
+
+// decodeTagsFromObject decodes tags encoded as an object of their keys to
+// their values. The tags are returned in the order of their keys.
+func decodeTagsFromObject(object map[string]any, onError decodeErrorHandler) ([]model.KeyValue, error) {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tags := []model.KeyValue{}
+	for _, key := range keys {
+		values, ok := object[key].([]any)
+		if !ok {
+			values = []any{object[key]}
+		}
+
+		for _, value := range values {
+			kv, err := decodeTagValueV2(key, value)
+			if err != nil {
+				if err := onError(fmt.Errorf("invalid tag %q: %w", key, err)); err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			tags = append(tags, kv)
+		}
+	}
+
+	return tags, nil
+}
+
+// decodeTagValueV2 decodes the value of a tag, its type being given by the
+// type of the json value.
+func decodeTagValueV2(key string, value any) (model.KeyValue, error) {
+	switch value := value.(type) {
+	case string:
+		return model.String(key, value), nil
+	case bool:
+		return model.Bool(key, value), nil
+	case json.Number:
+		if strings.ContainsAny(value.String(), ".eE") {
+			f, err := value.Float64()
+			if err != nil {
+				return model.KeyValue{}, fmt.Errorf("failed to parse float value: %w", err)
+			}
+
+			return model.Float64(key, f), nil
+		}
+
+		i, err := value.Int64()
+		if err != nil {
+			return model.KeyValue{}, fmt.Errorf("failed to parse int value: %w", err)
+		}
+
+		return model.Int64(key, i), nil
+	case map[string]any:
+		str, ok := value["binary"].(string)
+		if !ok || len(value) != 1 {
+			return model.KeyValue{}, errors.New(`expected a {"binary": base64} object`)
+		}
+
+		bytes, err := base64.RawStdEncoding.DecodeString(str)
+		if err != nil {
+			return model.KeyValue{}, fmt.Errorf("failed to parse binary value: %w", err)
+		}
+
+		return model.Binary(key, bytes), nil
+	default:
+		return model.KeyValue{}, fmt.Errorf("unexpected value, got %s", describeJSON(value))
+	}
+}
+
+// decodeJSONNumbers decodes json like json.Unmarshal, except that numbers are
+// decoded as json.Number so that int64s keep their precision.
+func decodeJSONNumbers(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("invalid data after top-level value")
+	}
 
+	return nil
 }
 
 func EncodeSpanKind(modelKind trace.SpanKind) sql.Spankind {
@@ -165,7 +540,7 @@ func EncodeSpanKind(modelKind trace.SpanKind) sql.Spankind {
 	}
 }
 
-func EncodeLogs(logs []model.Log) ([]byte, error) {
+func encodeLogsV1(logs []model.Log) ([]byte, error) {
 	slice := make([][]any, len(logs))
 	for i, log := range logs {
 
@@ -192,36 +567,130 @@ func TruncateTime(ts time.Time) time.Time {
 	return ts
 }
 
-func DecodeLogs(raw []byte) ([]model.Log, error) {
-	slice := [][]any{}
+func decodeLogsV1(raw []byte, onError decodeErrorHandler) ([]model.Log, error) {
+	slice := []any{}
 	if err := json.Unmarshal(raw, &slice); err != nil {
 		return nil, fmt.Errorf("failed to decode logs json: %w", err)
 	}
 
-	logs := make([]model.Log, len(slice))
+	return decodeLogsFromSlice(slice, decodeLogFieldsV1, onError)
+}
+
+// decodeLogsFromSlice decodes logs encoded as [timestamp, fields] arrays, the
+// fields being decoded by decodeFields. The errors given to onError name the
+// log they come from.
+func decodeLogsFromSlice(slice []any, decodeFields func(any, decodeErrorHandler) ([]model.KeyValue, error), onError decodeErrorHandler) ([]model.Log, error) {
+	logs := make([]model.Log, 0, len(slice))
 	for i, subslice := range slice {
-		cast := subslice[1].([]any)
-		fields, err := decodeTagsFromSlice(cast)
+		onLogError := func(err error) error {
+			return onError(fmt.Errorf("invalid log %d: %w", i, err))
+		}
+
+		timestamp, rawFields, err := decodeLog(subslice)
 		if err != nil {
-			return nil, err
+			if err := onLogError(err); err != nil {
+				return nil, err
+			}
+
+			continue
 		}
 
-		layout := time.RFC3339Nano
-		t, err := time.Parse(layout, subslice[0].(string))
+		fields, err := decodeFields(rawFields, onLogError)
 		if err != nil {
 			return nil, err
 		}
 
-		logs[i] = model.Log{
-			Timestamp: t,
-			Fields:    fields,
+		// the log was dropped by onLogError.
+		if fields == nil {
+			continue
 		}
+
+		logs = append(logs, model.Log{
+			Timestamp: timestamp,
+			Fields:    fields,
+		})
 	}
 
 	return logs, nil
 }
 
-func EncodeSpanRefs(spanrefs []model.SpanRef) ([]byte, error) {
+// decodeLog decodes the timestamp of a log encoded as a [timestamp, fields]
+// array, and returns its fields as they are.
+func decodeLog(raw any) (time.Time, any, error) {
+	cast, ok := raw.([]any)
+	if !ok || len(cast) != 2 {
+		return time.Time{}, nil, fmt.Errorf("expected a [timestamp, fields] array, got %s", describeJSON(raw))
+	}
+
+	timestamp, ok := cast[0].(string)
+	if !ok {
+		return time.Time{}, nil, fmt.Errorf("expected a string timestamp, got %s", describeJSON(cast[0]))
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return time.Time{}, nil, fmt.Errorf("failed to parse timestamp: %w", err)
+	}
+
+	return t, cast[1], nil
+}
+
+// decodeLogFieldsV1 decodes the fields of a log encoded as an array of
+// [key, type, value] arrays. The fields are nil when they are not an array
+// and onError dropped them.
+func decodeLogFieldsV1(raw any, onError decodeErrorHandler) ([]model.KeyValue, error) {
+	rawFields, ok := raw.([]any)
+	if !ok {
+		return nil, onError(fmt.Errorf("expected an array of fields, got %s", describeJSON(raw)))
+	}
+
+	return decodeTagsFromSlice(rawFields, onError)
+}
+
+func encodeLogsV2(logs []model.Log) ([]byte, error) {
+	slice := make([][]any, len(logs))
+	for i, log := range logs {
+		fields, err := encodeTagsToObject(log.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log %d: %w", i, err)
+		}
+
+		slice[i] = []any{
+			pgtype.Timestamp{Time: log.Timestamp, Valid: true},
+			fields,
+		}
+	}
+
+	bytes, err := json.Marshal(slice)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+func decodeLogsV2(raw []byte, onError decodeErrorHandler) ([]model.Log, error) {
+	slice := []any{}
+	if err := decodeJSONNumbers(raw, &slice); err != nil {
+		return nil, fmt.Errorf("failed to decode logs json: %w", err)
+	}
+
+	return decodeLogsFromSlice(slice, decodeLogFieldsV2, onError)
+}
+
+// decodeLogFieldsV2 decodes the fields of a log encoded as an object of their
+// keys to their values. The fields are nil when they are not an object and
+// onError dropped them.
+func decodeLogFieldsV2(raw any, onError decodeErrorHandler) ([]model.KeyValue, error) {
+	object, ok := raw.(map[string]any)
+	if !ok {
+		return nil, onError(fmt.Errorf("expected an object of fields, got %s", describeJSON(raw)))
+	}
+
+	return decodeTagsFromObject(object, onError)
+}
+
+func encodeSpanRefsV1(spanrefs []model.SpanRef) ([]byte, error) {
 	if len(spanrefs) == 0 {
 		return []byte("[]"), nil
 	}
@@ -242,32 +711,208 @@ func EncodeSpanRefs(spanrefs []model.SpanRef) ([]byte, error) {
 	return bytes, nil
 }
 
-func DecodeSpanRefs(data []byte) ([]model.SpanRef, error) {
-	var slice [][]any
+func decodeSpanRefsV1(data []byte, onError decodeErrorHandler) ([]model.SpanRef, error) {
+	var slice []any
 	err := json.Unmarshal(data, &slice)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to decode spanrefs json: %w", err)
 	}
 
-	results := make([]model.SpanRef, len(slice))
-
+	results := make([]model.SpanRef, 0, len(slice))
 	for i, subslice := range slice {
-		traceID, err := base64.StdEncoding.DecodeString(subslice[0].(string))
+		ref, err := decodeSpanRef(subslice)
 		if err != nil {
-			return nil, err
+			if err := onError(fmt.Errorf("invalid spanref %d: %w", i, err)); err != nil {
+				return nil, err
+			}
+
+			continue
 		}
 
-		spanID, err := base64.StdEncoding.DecodeString(subslice[1].(string))
+		results = append(results, ref)
+	}
+
+	return results, nil
+}
+
+// decodeSpanRef decodes a span reference encoded as a [trace_id, span_id,
+// ref_type] array.
+func decodeSpanRef(raw any) (model.SpanRef, error) {
+	cast, ok := raw.([]any)
+	if !ok || len(cast) != 3 {
+		return model.SpanRef{}, fmt.Errorf("expected a [trace_id, span_id, ref_type] array, got %s", describeJSON(raw))
+	}
+
+	rawTraceID, ok := cast[0].(string)
+	if !ok {
+		return model.SpanRef{}, fmt.Errorf("expected a base64 encoded trace id, got %s", describeJSON(cast[0]))
+	}
+
+	rawSpanID, ok := cast[1].(string)
+	if !ok {
+		return model.SpanRef{}, fmt.Errorf("expected a base64 encoded span id, got %s", describeJSON(cast[1]))
+	}
+
+	refType, ok := cast[2].(float64)
+	if !ok {
+		return model.SpanRef{}, fmt.Errorf("expected a numeric ref type, got %s", describeJSON(cast[2]))
+	}
+
+	traceID, err := base64.StdEncoding.DecodeString(rawTraceID)
+	if err != nil {
+		return model.SpanRef{}, fmt.Errorf("failed to parse trace id: %w", err)
+	}
+
+	spanID, err := base64.StdEncoding.DecodeString(rawSpanID)
+	if err != nil {
+		return model.SpanRef{}, fmt.Errorf("failed to parse span id: %w", err)
+	}
+
+	ref := model.SpanRef{RefType: model.SpanRefType(int32(refType))}
+
+	ref.TraceID, err = DecodeTraceID(traceID)
+	if err != nil {
+		return model.SpanRef{}, err
+	}
+
+	ref.SpanID, err = DecodeSpanID(spanID)
+	if err != nil {
+		return model.SpanRef{}, err
+	}
+
+	return ref, nil
+}
+
+// EncodeTagQuery flattens the tags of a trace query into parallel key and
+// value slices. The keys are sorted so that the generated query parameters are
+// stable for a given set of tags.
+func EncodeTagQuery(tags map[string]string) ([]string, []string) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = tags[key]
+	}
+
+	return keys, values
+}
+
+// EncodeTagCandidates returns, for every tag of a trace query, a json array of
+// the objects contained by the tags of the spans having that tag in
+// EncodingVersion2.
+func EncodeTagCandidates(keys, values []string) ([]string, error) {
+	candidates := make([]string, len(keys))
+	for i, key := range keys {
+		bytes, err := json.Marshal(tagCandidates(key, values[i]))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to encode tag %q: %w", key, err)
 		}
 
-		results[i] = model.SpanRef{
-			TraceID: DecodeTraceID(traceID),
-			SpanID:  DecodeSpanID(spanID),
-			RefType: model.SpanRefType(int32(subslice[2].(float64))),
+		candidates[i] = string(bytes)
+	}
+
+	return candidates, nil
+}
+
+// EncodeTagIndexCandidates returns the json values contained by the tags, and
+// the json arrays contained by the logs, of the spans having the tag in either
+// encoding version. Comparing them with the columns of the spans directly lets
+// the GIN indexes find the spans.
+func EncodeTagIndexCandidates(key, value string) ([]string, []string, error) {
+	var candidates []any
+	for _, candidate := range tagCandidates(key, value) {
+		candidates = append(candidates, candidate)
+	}
+	for _, candidate := range tagCandidatesV1(key, value) {
+		candidates = append(candidates, candidate)
+	}
+
+	var tags, logs []string
+	for _, candidate := range candidates {
+		tag, err := json.Marshal(candidate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode tag %q: %w", key, err)
 		}
+
+		// logs are [timestamp, fields] arrays, and an array contains another
+		// array when it contains each of its elements.
+		log, err := json.Marshal([][]any{{candidate}})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode tag %q: %w", key, err)
+		}
+
+		tags = append(tags, string(tag))
+		logs = append(logs, string(log))
 	}
 
-	return results, nil
+	return tags, logs, nil
+}
+
+// tagValues returns the json values a tag value of a trace query may have been
+// stored as. The value of a trace query is a string, so it is looked up as
+// every type it may have been stored as.
+func tagValues(value string) []any {
+	values := []any{value}
+
+	if value == "true" || value == "false" {
+		values = append(values, value == "true")
+	}
+
+	// jsonb compares numbers by value, so an integer also finds the floats
+	// equal to it.
+	if isJSONNumber(value) {
+		values = append(values, json.Number(value))
+	}
+
+	return values
+}
+
+// tagCandidatesV1 returns the arrays contained by the tags of the spans having
+// the tag in EncodingVersion1, which are arrays of [key, type, value] arrays.
+// An array contains another array when it contains each of its elements, in
+// any order, so these also find tags whose type is the value, which are then
+// left out by the exact comparison of the key and the value.
+func tagCandidatesV1(key, value string) [][][]any {
+	values := tagValues(value)
+
+	candidates := make([][][]any, 0, len(values))
+	for _, value := range values {
+		candidates = append(candidates, [][]any{{key, value}})
+	}
+
+	return candidates
+}
+
+// tagCandidates returns the objects contained by the tags of the spans having
+// the tag in EncodingVersion2. The value is looked up both alone and in the
+// array of the values of a key set by several tags.
+func tagCandidates(key, value string) []map[string]any {
+	values := tagValues(value)
+
+	if _, err := base64.RawStdEncoding.DecodeString(value); err == nil {
+		values = append(values, map[string]any{"binary": value})
+	}
+
+	candidates := make([]map[string]any, 0, 2*len(values))
+	for _, value := range values {
+		candidates = append(candidates,
+			map[string]any{key: value},
+			map[string]any{key: []any{value}},
+		)
+	}
+
+	return candidates
+}
+
+// isJSONNumber returns true when the string is a json number.
+func isJSONNumber(value string) bool {
+	if len(value) == 0 || (value[0] != '-' && (value[0] < '0' || value[0] > '9')) {
+		return false
+	}
+
+	return strings.TrimSpace(value) == value && json.Valid([]byte(value))
 }
@@ -1,7 +1,13 @@
 package store
 
 import (
+	"encoding/hex"
+	"math"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
 
 	"github.com/jaegertracing/jaeger/model"
 
@@ -12,7 +18,393 @@ func TestToDomainTraceID(t *testing.T) {
 	traceID := model.NewTraceID(127318, 12489421)
 
 	encoded := EncodeTraceID(traceID)
-	decoded := DecodeTraceID(encoded)
+	decoded, err := DecodeTraceID(encoded)
+	require.Nil(t, err)
 
 	require.Equal(t, decoded, traceID)
 }
+
+func TestEncodeTraceID(t *testing.T) {
+	traceID, err := model.TraceIDFromString("0af7651916cd43dd8448eb211c80319c")
+	require.Nil(t, err)
+
+	encoded := EncodeTraceID(traceID)
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", hex.EncodeToString(encoded))
+
+	decoded, err := DecodeTraceID(encoded)
+	require.Nil(t, err)
+	require.Equal(t, traceID, decoded)
+
+	// trace ids of 64 bits are padded with zeros in the high bytes.
+	encoded = EncodeTraceID(model.NewTraceID(0, 0xb7ad6b7169203331))
+	require.Equal(t, "0000000000000000b7ad6b7169203331", hex.EncodeToString(encoded))
+}
+
+func TestEncodeSpanID(t *testing.T) {
+	spanID, err := model.SpanIDFromString("b7ad6b7169203331")
+	require.Nil(t, err)
+
+	encoded := EncodeSpanID(spanID)
+	require.Equal(t, "b7ad6b7169203331", hex.EncodeToString(encoded))
+
+	decoded, err := DecodeSpanID(encoded)
+	require.Nil(t, err)
+	require.Equal(t, spanID, decoded)
+}
+
+func TestEncodeSpanRefs(t *testing.T) {
+	refs := []model.SpanRef{
+		model.NewChildOfRef(model.NewTraceID(0x0af7651916cd43dd, 0x8448eb211c80319c), model.NewSpanID(0xb7ad6b7169203331)),
+		model.NewFollowsFromRef(model.NewTraceID(0, 1), model.NewSpanID(2)),
+	}
+
+	encoded, err := EncodeSpanRefs(refs)
+	require.Nil(t, err)
+
+	require.JSONEq(t, `[
+		["CvdlGRbNQ92ESOshHIAxnA==", "t61rcWkgMzE=", 0],
+		["AAAAAAAAAAAAAAAAAAAAAQ==", "AAAAAAAAAAI=", 1]
+	]`, string(encoded))
+
+	decoded, err := DecodeSpanRefs(CurrentEncodingVersion, encoded)
+	require.Nil(t, err)
+	require.Equal(t, refs, decoded)
+}
+
+func TestEncodeTags(t *testing.T) {
+	tags := []model.KeyValue{
+		model.String("string", "value"),
+		model.Bool("bool", true),
+		model.Int64("int64", math.MaxInt64),
+		model.Float64("float64", 1.5),
+		model.Float64("integral", 2),
+		model.Binary("binary", []byte{1, 2, 3}),
+		model.String("duplicate", "first"),
+		model.Int64("duplicate", 2),
+	}
+
+	encoded, err := EncodeTags(tags)
+	require.Nil(t, err)
+
+	require.JSONEq(t, `{
+		"string": "value",
+		"bool": true,
+		"int64": 9223372036854775807,
+		"float64": 1.5,
+		"integral": 2.0,
+		"binary": {"binary": "AQID"},
+		"duplicate": ["first", 2]
+	}`, string(encoded))
+
+	// floats keep their fraction so that they are not decoded as ints.
+	require.Contains(t, string(encoded), `"integral":2.0`)
+
+	decoded, err := DecodeTags(EncodingVersion2, encoded)
+	require.Nil(t, err)
+
+	// the tags are decoded in the order of their keys.
+	require.Equal(t, []model.KeyValue{
+		model.Binary("binary", []byte{1, 2, 3}),
+		model.Bool("bool", true),
+		model.String("duplicate", "first"),
+		model.Int64("duplicate", 2),
+		model.Float64("float64", 1.5),
+		model.Int64("int64", math.MaxInt64),
+		model.Float64("integral", 2),
+		model.String("string", "value"),
+	}, decoded)
+
+	_, err = EncodeTags([]model.KeyValue{model.Float64("nan", math.NaN())})
+	require.ErrorContains(t, err, `unsupported float value NaN for "nan"`)
+}
+
+func TestEncodeLogs(t *testing.T) {
+	logs := []model.Log{{
+		Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Fields:    []model.KeyValue{model.String("event", "retry"), model.Int64("attempt", 3)},
+	}}
+
+	encoded, err := EncodeLogs(logs)
+	require.Nil(t, err)
+	require.JSONEq(t, `[["2024-01-01T00:00:00Z", {"event": "retry", "attempt": 3}]]`, string(encoded))
+
+	decoded, err := DecodeLogs(EncodingVersion2, encoded)
+	require.Nil(t, err)
+	require.Equal(t, []model.Log{{
+		Timestamp: logs[0].Timestamp,
+		Fields:    []model.KeyValue{model.Int64("attempt", 3), model.String("event", "retry")},
+	}}, decoded)
+}
+
+func TestEncodeTagQuery(t *testing.T) {
+	keys, values := EncodeTagQuery(map[string]string{
+		"http.status_code": "500",
+		"error":            "true",
+	})
+
+	require.Equal(t, []string{"error", "http.status_code"}, keys)
+	require.Equal(t, []string{"true", "500"}, values)
+}
+
+func TestEncodeTagCandidates(t *testing.T) {
+	candidates, err := EncodeTagCandidates([]string{"http.status_code", "peer.service"}, []string{"500", "billing service"})
+	require.Nil(t, err)
+	require.Len(t, candidates, 2)
+
+	// an int may have been stored as a string, a number or a binary.
+	require.JSONEq(t, `[
+		{"http.status_code": "500"},
+		{"http.status_code": ["500"]},
+		{"http.status_code": 500},
+		{"http.status_code": [500]},
+		{"http.status_code": {"binary": "500"}},
+		{"http.status_code": [{"binary": "500"}]}
+	]`, candidates[0])
+
+	require.JSONEq(t, `[
+		{"peer.service": "billing service"},
+		{"peer.service": ["billing service"]}
+	]`, candidates[1])
+
+	tags, logs, err := EncodeTagIndexCandidates("error", "true")
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		`{"error":"true"}`,
+		`{"error":["true"]}`,
+		`{"error":true}`,
+		`{"error":[true]}`,
+		`{"error":{"binary":"true"}}`,
+		`{"error":[{"binary":"true"}]}`,
+		`[["error","true"]]`,
+		`[["error",true]]`,
+	}, tags)
+	require.Equal(t, []string{
+		`[[{"error":"true"}]]`,
+		`[[{"error":["true"]}]]`,
+		`[[{"error":true}]]`,
+		`[[{"error":[true]}]]`,
+		`[[{"error":{"binary":"true"}}]]`,
+		`[[{"error":[{"binary":"true"}]}]]`,
+		`[[[["error","true"]]]]`,
+		`[[[["error",true]]]]`,
+	}, logs)
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	_, err := DecodeTraceID([]byte{0, 0, 0, 1})
+	require.ErrorContains(t, err, "expected 16 bytes, got 4")
+
+	_, err = DecodeSpanID(nil)
+	require.ErrorContains(t, err, "expected 8 bytes, got 0")
+
+	_, err = DecodeTags(EncodingVersion1, []byte(`[["key", 0, "value"], "oops"]`))
+	require.ErrorContains(t, err, "invalid tag 1: expected a [key, type, value] array, got a string")
+
+	_, err = DecodeTags(EncodingVersion1, []byte(`[["key", 0, 12]]`))
+	require.ErrorContains(t, err, `expected a string value for "key", got a number`)
+
+	_, err = DecodeTags(EncodingVersion1, []byte(`[["key", 2, "twelve"]]`))
+	require.ErrorContains(t, err, `failed to parse int value for "key"`)
+
+	_, err = DecodeLogs(EncodingVersion1, []byte(`[["2024-01-01T00:00:00Z"]]`))
+	require.ErrorContains(t, err, "invalid log 0: expected a [timestamp, fields] array, got an array of length 1")
+
+	_, err = DecodeLogs(EncodingVersion1, []byte(`[["2024-01-01T00:00:00Z", [[null, 0, "value"]]]]`))
+	require.ErrorContains(t, err, "invalid log 0: invalid tag 0: expected a string key, got null")
+
+	_, err = DecodeSpanRefs(EncodingVersion1, []byte(`[["AAAAAAAAAAAAAAAAAAAAAQ==", "AAAA", 0]]`))
+	require.ErrorContains(t, err, "invalid spanref 0: invalid span id: expected 8 bytes, got 3")
+
+	_, err = DecodeSpanRefs(EncodingVersion1, []byte(`{}`))
+	require.ErrorContains(t, err, "failed to decode spanrefs json")
+
+	_, err = DecodeTags(EncodingVersion2, []byte(`[["key", 0, "value"]]`))
+	require.ErrorContains(t, err, "failed to decode tag json")
+
+	_, err = DecodeTags(EncodingVersion2, []byte(`{"key": 1.5e400}`))
+	require.ErrorContains(t, err, `invalid tag "key": failed to parse float value`)
+
+	_, err = DecodeTags(EncodingVersion2, []byte(`{"key": 9223372036854775808}`))
+	require.ErrorContains(t, err, `invalid tag "key": failed to parse int value`)
+
+	_, err = DecodeTags(EncodingVersion2, []byte(`{"key": [null]}`))
+	require.ErrorContains(t, err, `invalid tag "key": unexpected value, got null`)
+
+	_, err = DecodeTags(EncodingVersion2, []byte(`{"key": {"bytes": "AQID"}}`))
+	require.ErrorContains(t, err, `invalid tag "key": expected a {"binary": base64} object`)
+
+	_, err = DecodeTags(EncodingVersion2, []byte(`{} {}`))
+	require.ErrorContains(t, err, "invalid data after top-level value")
+
+	_, err = DecodeLogs(EncodingVersion2, []byte(`[["2024-01-01T00:00:00Z", [["key", 0, "value"]]]]`))
+	require.ErrorContains(t, err, "invalid log 0: expected an object of fields, got an array of length 1")
+}
+
+func TestDecodeUnknownEncodingVersion(t *testing.T) {
+	_, err := DecodeTags(0, []byte(`[]`))
+	require.ErrorContains(t, err, "unknown encoding version 0")
+
+	_, err = DecodeLogs(CurrentEncodingVersion+1, []byte(`[]`))
+	require.ErrorContains(t, err, "unknown encoding version")
+
+	_, err = DecodeSpanRefs(-1, []byte(`[]`))
+	require.ErrorContains(t, err, "unknown encoding version -1")
+}
+
+func TestDecodeSpan(t *testing.T) {
+	row := sql.GetTraceSpansRow{
+		SpanID:          EncodeSpanID(model.NewSpanID(2)),
+		TraceID:         EncodeTraceID(model.NewTraceID(0, 1)),
+		Tags:            []byte(`[["key", 0, "value"]]`),
+		ProcessTags:     []byte(`[["hostname", 0], ["ip", 0, "10.0.0.1"]]`),
+		Logs:            []byte(`[["2024-01-01T00:00:00Z", [["event", 0, "retry"], ["attempt", 2]]], ["oops"]]`),
+		Refs:            []byte(`[]`),
+		Warnings:        []string{"existing"},
+		EncodingVersion: int16(EncodingVersion1),
+	}
+
+	t.Run("should fail the span with the fail policy", func(t *testing.T) {
+		_, err := decodeSpan(row, DecodeErrorPolicyFail)
+		require.ErrorContains(t, err, "failed to decode process tags of span 0000000000000002: invalid tag 0: expected a [key, type, value] array, got an array of length 2")
+	})
+
+	t.Run("should drop the elements with the drop policy", func(t *testing.T) {
+		span, err := decodeSpan(row, DecodeErrorPolicyDrop)
+		require.Nil(t, err)
+
+		require.Equal(t, []model.KeyValue{model.String("key", "value")}, span.Tags)
+		require.Equal(t, []model.KeyValue{model.String("ip", "10.0.0.1")}, span.Process.Tags)
+		require.Equal(t, []model.Log{{
+			Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Fields:    []model.KeyValue{model.String("event", "retry")},
+		}}, span.Logs)
+
+		require.Len(t, span.Warnings, 4)
+		require.Equal(t, "existing", span.Warnings[0])
+		require.Contains(t, span.Warnings[1], "dropped an element of the process tags of the span that could not be decoded: invalid tag 0")
+		require.Contains(t, span.Warnings[2], "dropped an element of the logs of the span that could not be decoded: invalid log 0: invalid tag 1")
+		require.Contains(t, span.Warnings[3], "dropped an element of the logs of the span that could not be decoded: invalid log 1")
+	})
+
+	t.Run("should drop the field that is not valid json with the drop policy", func(t *testing.T) {
+		row := row
+		row.Tags = []byte(`{`)
+
+		span, err := decodeSpan(row, DecodeErrorPolicyDrop)
+		require.Nil(t, err)
+
+		require.Empty(t, span.Tags)
+		require.Contains(t, span.Warnings[1], "dropped the tags of the span that could not be decoded")
+	})
+
+	t.Run("should fail the span with invalid ids with any policy", func(t *testing.T) {
+		row := row
+		row.SpanID = []byte{1}
+
+		_, err := decodeSpan(row, DecodeErrorPolicyDrop)
+		require.ErrorContains(t, err, "invalid span id")
+	})
+}
+
+func FuzzDecodeTags(f *testing.F) {
+	tags := []model.KeyValue{
+		model.String("string", "value"),
+		model.Bool("bool", true),
+		model.Int64("int64", -42),
+		model.Float64("float64", 1.5),
+		model.Binary("binary", []byte{1, 2, 3}),
+	}
+
+	for _, encode := range []func([]model.KeyValue) ([]byte, error){encodeTagsV1, encodeTagsV2} {
+		seed, err := encode(tags)
+		require.Nil(f, err)
+
+		f.Add(seed)
+	}
+
+	f.Add([]byte(`[["key", 2, 12]]`))
+	f.Add([]byte(`[null]`))
+	f.Add([]byte(`{"key": [1, 2.0, {"binary": "AQID"}]}`))
+	f.Add([]byte(`{"key": 1e5}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, version := range []EncodingVersion{EncodingVersion1, EncodingVersion2} {
+			tags, err := DecodeTags(version, data)
+			if err != nil {
+				continue
+			}
+
+			// whatever is decoded must survive another round trip, in the
+			// order of the keys of the tags.
+			encoded, err := EncodeTags(tags)
+			if err != nil {
+				// NaN and infinite floats cannot be encoded in json.
+				continue
+			}
+
+			decoded, err := DecodeTags(CurrentEncodingVersion, encoded)
+			require.Nil(t, err)
+
+			sort.SliceStable(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+			require.Equal(t, tags, decoded)
+		}
+	})
+}
+
+func FuzzDecodeLogs(f *testing.F) {
+	seed, err := EncodeLogs([]model.Log{{
+		Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Fields:    []model.KeyValue{model.String("event", "error")},
+	}})
+	require.Nil(f, err)
+
+	f.Add(seed)
+	f.Add([]byte(`[["2024-01-01T00:00:00Z"]]`))
+	f.Add([]byte(`[[1, []]]`))
+
+	f.Add([]byte(`[["2024-01-01T00:00:00Z", [["event", 0, "error"]]]]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = DecodeLogs(EncodingVersion1, data)
+		_, _ = DecodeLogs(EncodingVersion2, data)
+	})
+}
+
+func FuzzDecodeSpanRefs(f *testing.F) {
+	seed, err := EncodeSpanRefs([]model.SpanRef{
+		model.NewChildOfRef(model.NewTraceID(1, 2), model.NewSpanID(3)),
+	})
+	require.Nil(f, err)
+
+	f.Add(seed)
+	f.Add([]byte(`[["AAAA", "AAAA", 0]]`))
+	f.Add([]byte(`[[]]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		refs, err := DecodeSpanRefs(EncodingVersion1, data)
+		if err != nil {
+			return
+		}
+
+		encoded, err := EncodeSpanRefs(refs)
+		require.Nil(t, err)
+
+		decoded, err := DecodeSpanRefs(CurrentEncodingVersion, encoded)
+		require.Nil(t, err)
+		require.Equal(t, len(refs), len(decoded))
+	})
+}
+
+func FuzzDecodeTraceID(f *testing.F) {
+	f.Add(EncodeTraceID(model.NewTraceID(1, 2)))
+	f.Add([]byte{1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		traceID, err := DecodeTraceID(data)
+		if err != nil {
+			return
+		}
+
+		require.Equal(t, data, EncodeTraceID(traceID))
+	})
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+)
+
+// PartitionInterval is the range of time covered by each partition of the
+// spans table.
+type PartitionInterval string
+
+const (
+	// PartitionIntervalHour creates a partition for every hour.
+	PartitionIntervalHour PartitionInterval = "hour"
+
+	// PartitionIntervalDay creates a partition for every day.
+	PartitionIntervalDay PartitionInterval = "day"
+)
+
+// ParsePartitionInterval parses a partition interval.
+func ParsePartitionInterval(raw string) (PartitionInterval, error) {
+	switch interval := PartitionInterval(raw); interval {
+	case PartitionIntervalHour, PartitionIntervalDay:
+		return interval, nil
+	default:
+		return "", fmt.Errorf("invalid partition interval: %s", raw)
+	}
+}
+
+// Truncate returns the start of the partition containing t.
+func (i PartitionInterval) Truncate(t time.Time) time.Time {
+	t = t.UTC()
+	if i == PartitionIntervalDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.UTC)
+}
+
+// Next returns the start of the partition following the one starting at t.
+func (i PartitionInterval) Next(t time.Time) time.Time {
+	if i == PartitionIntervalDay {
+		return t.AddDate(0, 0, 1)
+	}
+
+	return t.Add(time.Hour)
+}
+
+// CreatePartitions creates the partitions of the spans table covering now and
+// the given number of following intervals. Partitions that already exist are
+// left untouched. It returns the names of the partitions that were created.
+func CreatePartitions(ctx context.Context, q *sql.Queries, now time.Time, interval PartitionInterval, lookahead int) ([]string, error) {
+	var created []string
+
+	start := interval.Truncate(now)
+	for i := 0; i <= lookahead; i++ {
+		end := interval.Next(start)
+
+		name, err := q.CreateSpansPartition(ctx, sql.CreateSpansPartitionParams{
+			PartitionStart: EncodeTimestamp(start),
+			PartitionEnd:   EncodeTimestamp(end),
+		})
+		if err != nil {
+			return created, fmt.Errorf("failed to create partition starting at %s: %w", start, err)
+		}
+
+		if name != "" {
+			created = append(created, name)
+		}
+
+		start = end
+	}
+
+	return created, nil
+}
+
+// DropPartitions detaches and drops the partitions of the spans table that
+// only hold spans started before pruneBefore. It returns the names of the
+// partitions that were dropped.
+func DropPartitions(ctx context.Context, q *sql.Queries, pruneBefore time.Time) ([]string, error) {
+	dropped, err := q.DropSpansPartitions(ctx, EncodeTimestamp(pruneBefore.UTC()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to drop partitions: %w", err)
+	}
+
+	return dropped, nil
+}
@@ -0,0 +1,25 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionInterval(t *testing.T) {
+	ts := time.Date(2024, time.February, 29, 23, 42, 12, 0, time.UTC)
+
+	hour, err := ParsePartitionInterval("hour")
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2024, time.February, 29, 23, 0, 0, 0, time.UTC), hour.Truncate(ts))
+	require.Equal(t, time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), hour.Next(hour.Truncate(ts)))
+
+	day, err := ParsePartitionInterval("day")
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC), day.Truncate(ts))
+	require.Equal(t, time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC), day.Next(day.Truncate(ts)))
+
+	_, err = ParsePartitionInterval("week")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+)
+
+// PruneReport describes the services and operations that were pruned.
+type PruneReport struct {
+	Services   int64
+	Operations int64
+}
+
+// PruneUnused deletes the operations, and then the services, that are no
+// longer referenced by any span.
+//
+// The writer may reference a service or operation again while it is pruned.
+// Each one is deleted by its own statement, and one that is referenced by a
+// span in the meantime fails with a foreign key violation and is skipped. The
+// writer in turn resolves the ids of the services and operations it has
+// cached again when they turn out to have been pruned.
+func PruneUnused(ctx context.Context, q *sql.Queries, logger *slog.Logger) (PruneReport, error) {
+	var report PruneReport
+
+	operationIDs, err := q.GetUnusedOperationIDs(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to get unused operations: %w", err)
+	}
+
+	for _, id := range operationIDs {
+		count, err := q.DeleteUnusedOperation(ctx, id)
+		if isForeignKeyViolation(err) {
+			logger.Debug("skipped pruning operation in use", "operation_id", id)
+			continue
+		} else if err != nil {
+			return report, fmt.Errorf("failed to delete unused operation: %w", err)
+		}
+
+		report.Operations += count
+	}
+
+	serviceIDs, err := q.GetUnusedServiceIDs(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to get unused services: %w", err)
+	}
+
+	for _, id := range serviceIDs {
+		count, err := q.DeleteUnusedService(ctx, id)
+		if isForeignKeyViolation(err) {
+			logger.Debug("skipped pruning service in use", "service_id", id)
+			continue
+		} else if err != nil {
+			return report, fmt.Errorf("failed to delete unused service: %w", err)
+		}
+
+		report.Services += count
+	}
+
+	return report, nil
+}
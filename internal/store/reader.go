@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"math"
 	"time"
 
 	"github.com/robbert229/jaeger-postgresql/internal/sql"
@@ -14,23 +15,77 @@ import (
 
 var _ spanstore.Reader = (*Reader)(nil)
 
+// DecodeErrorPolicy decides what a Reader does with a stored span that cannot
+// be decoded.
+type DecodeErrorPolicy string
+
+const (
+	// DecodeErrorPolicyFail fails the whole trace of the span.
+	DecodeErrorPolicyFail DecodeErrorPolicy = "fail"
+
+	// DecodeErrorPolicyDrop drops the tags, logs, fields of logs or references
+	// of the span that cannot be decoded, and adds a warning to the span naming
+	// each of them. A whole field is dropped when it is not valid json of the
+	// expected shape. A span whose ids cannot be decoded still fails the trace.
+	DecodeErrorPolicyDrop DecodeErrorPolicy = "drop"
+)
+
+// Validate returns an error if the policy is unknown.
+func (p DecodeErrorPolicy) Validate() error {
+	switch p {
+	case "", DecodeErrorPolicyFail, DecodeErrorPolicyDrop:
+		return nil
+	default:
+		return fmt.Errorf("invalid decode error policy: %s", p)
+	}
+}
+
+// ReaderOptions configures a Reader.
+type ReaderOptions struct {
+	// Lookback hides the services and operations that have not been seen by
+	// the writer within it. Every service and operation is returned when it
+	// is zero.
+	Lookback time.Duration
+
+	// DecodeErrors is the policy applied to the spans that cannot be decoded,
+	// it defaults to DecodeErrorPolicyFail.
+	DecodeErrors DecodeErrorPolicy
+
+	// IndexedLogs tells that the logs of the spans have a GIN index, see
+	// SpansIndexOptions. The tag searches only narrow the spans down with the
+	// GIN indexes when it is set, as the spans matching a tag in their logs
+	// would otherwise be read in full.
+	IndexedLogs bool
+}
+
 // Reader can query for and load traces from PostgreSQL v2.x.
 type Reader struct {
 	logger *slog.Logger
 	q      *sql.Queries
+	opts   ReaderOptions
 }
 
 // NewReader returns a new SpanReader for PostgreSQL v2.x.
 func NewReader(q *sql.Queries, logger *slog.Logger) *Reader {
+	return NewReaderWithOptions(q, logger, ReaderOptions{})
+}
+
+// NewReaderWithOptions returns a new SpanReader for PostgreSQL v2.x configured
+// with the given options.
+func NewReaderWithOptions(q *sql.Queries, logger *slog.Logger, opts ReaderOptions) *Reader {
 	return &Reader{
 		q:      q,
 		logger: logger,
+		opts:   opts,
 	}
 }
 
 // GetServices returns all services traced by Jaeger
 func (r *Reader) GetServices(ctx context.Context) ([]string, error) {
-	services, err := r.q.GetServices(ctx)
+	services, err := r.q.GetServices(ctx, sql.GetServicesParams{
+		Lookback:             EncodeInterval(r.opts.Lookback),
+		LookbackEnableFilter: r.opts.Lookback > 0,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +95,13 @@ func (r *Reader) GetServices(ctx context.Context) ([]string, error) {
 
 // GetOperations returns all operations for a specific service traced by Jaeger
 func (r *Reader) GetOperations(ctx context.Context, param spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
-	response, err := r.q.GetOperations(ctx, param.ServiceName)
+	response, err := r.q.GetOperations(ctx, sql.GetOperationsParams{
+		ServiceName:          param.ServiceName,
+		Kind:                 param.SpanKind,
+		KindEnableFilter:     len(param.SpanKind) > 0,
+		Lookback:             EncodeInterval(r.opts.Lookback),
+		LookbackEnableFilter: r.opts.Lookback > 0,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -70,50 +131,17 @@ func (r *Reader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Tr
 	}
 
 	if len(dbSpans) == 0 {
-		return nil, fmt.Errorf("trace not found")
+		return nil, spanstore.ErrTraceNotFound
 	}
 
 	var spans []*model.Span = make([]*model.Span, len(dbSpans))
 	for i, dbSpan := range dbSpans {
-		tags, err := DecodeTags(dbSpan.Tags)
+		span, err := decodeSpan(dbSpan, r.opts.DecodeErrors)
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode span tags: %w", err)
-		}
-
-		processTags, err := DecodeTags(dbSpan.ProcessTags)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode process tags: %w", err)
-		}
-
-		duration := time.Duration(dbSpan.Duration.Microseconds * 1000)
-
-		logs, err := DecodeLogs(dbSpan.Logs)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode logs: %w", err)
-		}
-
-		decodedSpanRefs, err := DecodeSpanRefs(dbSpan.Refs)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode spanrefs: %w", err)
+			return nil, err
 		}
 
-		spans[i] = &model.Span{
-			TraceID:       DecodeTraceID(dbSpan.TraceID),
-			SpanID:        DecodeSpanID(dbSpan.SpanID),
-			OperationName: dbSpan.OperationName,
-			Tags:          tags,
-			References:    decodedSpanRefs,
-			Flags:         model.Flags(int32(dbSpan.Flags)),
-			StartTime:     dbSpan.StartTime.Time,
-			Duration:      duration,
-			Logs:          logs,
-			Process: &model.Process{
-				ServiceName: dbSpan.ProcessName,
-				Tags:        processTags,
-			},
-			ProcessID: dbSpan.ProcessID,
-			Warnings:  dbSpan.Warnings,
-		}
+		spans[i] = span
 	}
 
 	return &model.Trace{
@@ -132,7 +160,11 @@ func (r *Reader) FindTraces(ctx context.Context, query *spanstore.TraceQueryPara
 		}()
 	}
 
-	response, err := r.q.FindTraceIDs(ctx, sql.FindTraceIDsParams{
+	if err := validateTraceQuery(query); err != nil {
+		return nil, err
+	}
+
+	params := sql.FindTraceIDsParams{
 		ServiceName:                  query.ServiceName,
 		ServiceNameEnableFilter:      len(query.ServiceName) > 0,
 		OperationName:                query.OperationName,
@@ -145,26 +177,133 @@ func (r *Reader) FindTraces(ctx context.Context, query *spanstore.TraceQueryPara
 		DurationMinimumEnableFilter:  query.DurationMin != time.Duration(0),
 		DurationMaximum:              EncodeInterval(query.DurationMax),
 		DurationMaximumEnableFilter:  query.DurationMax != time.Duration(0),
-		NumTraces:                    int32(query.NumTraces),
-		// Tags
-	})
+	}
+
+	if err := encodeTagSearch(&params, query.Tags, r.opts.IndexedLogs); err != nil {
+		return nil, err
+	}
+
+	response, err := r.findTraceIDs(ctx, params, query.NumTraces)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query trace ids: %w", err)
+		return nil, err
 	}
 
-	var traces []*model.Trace
-	for _, id := range response {
-		trace, err := r.GetTrace(ctx, DecodeTraceID(id))
+	if len(response) == 0 {
+		return nil, nil
+	}
+
+	dbSpans, err := r.q.GetTracesSpans(ctx, response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get traces spans: %w", err)
+	}
+
+	// the spans of every matched trace are loaded at once, and then grouped
+	// by trace so that the traces keep the order of the matched ids.
+	var spansByTraceID = make(map[string][]*model.Span, len(response))
+	for _, dbSpan := range dbSpans {
+		span, err := decodeSpan(sql.GetTraceSpansRow(dbSpan), r.opts.DecodeErrors)
 		if err != nil {
 			return nil, err
 		}
 
-		traces = append(traces, trace)
+		key := string(dbSpan.TraceID)
+		spansByTraceID[key] = append(spansByTraceID[key], span)
+	}
+
+	var traces = make([]*model.Trace, 0, len(response))
+	for _, id := range response {
+		spans, ok := spansByTraceID[string(id)]
+		if !ok {
+			continue
+		}
+
+		traces = append(traces, &model.Trace{
+			Spans: spans,
+		})
 	}
 
 	return traces, nil
 }
 
+// encodeTagSearch sets the parameters of FindTraceIDs looking up the tags of a
+// trace query, in every encoding version. When indexedLogs is set, the spans in
+// EncodingVersion2 are narrowed down with the GIN indexes by looking up the
+// first tag, before every tag is looked up.
+func encodeTagSearch(params *sql.FindTraceIDsParams, tags map[string]string, indexedLogs bool) error {
+	params.TagKeys, params.TagValues = EncodeTagQuery(tags)
+	if len(params.TagKeys) == 0 {
+		return nil
+	}
+
+	var err error
+	params.TagCandidates, err = EncodeTagCandidates(params.TagKeys, params.TagValues)
+	if err != nil {
+		return err
+	}
+
+	if !indexedLogs {
+		return nil
+	}
+
+	params.TagIndexCandidates, params.TagIndexLogCandidates, err = EncodeTagIndexCandidates(params.TagKeys[0], params.TagValues[0])
+	if err != nil {
+		return err
+	}
+
+	params.TagIndexEnableFilter = true
+	return nil
+}
+
+// findTraceIDsSpansPerTrace is the number of matching spans read for each
+// requested trace by each page of findTraceIDs.
+const findTraceIDsSpansPerTrace = 20
+
+// findTraceIDs returns the ids of the numTraces most recent traces matching
+// params. The matching spans are read from the most recent one, a page at a
+// time, each page starting after the last span of the previous one, until
+// enough distinct traces are found or every matching span has been read.
+func (r *Reader) findTraceIDs(ctx context.Context, params sql.FindTraceIDsParams, numTraces int) ([][]byte, error) {
+	if numTraces <= 0 {
+		return nil, nil
+	}
+
+	// the page is not limited when its size would overflow.
+	params.SpanLimit = 0
+	if limit := int64(numTraces) * findTraceIDsSpansPerTrace; limit <= math.MaxInt32 {
+		params.SpanLimit = int32(limit)
+	}
+
+	seen := make(map[string]struct{}, numTraces)
+	traceIDs := make([][]byte, 0, numTraces)
+	for {
+		rows, err := r.q.FindTraceIDs(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query trace ids: %w", err)
+		}
+
+		for _, row := range rows {
+			if _, ok := seen[string(row.TraceID)]; ok {
+				continue
+			}
+
+			seen[string(row.TraceID)] = struct{}{}
+			traceIDs = append(traceIDs, row.TraceID)
+			if len(traceIDs) == numTraces {
+				return traceIDs, nil
+			}
+		}
+
+		if params.SpanLimit == 0 || len(rows) < int(params.SpanLimit) {
+			return traceIDs, nil
+		}
+
+		last := rows[len(rows)-1]
+		params.CursorEnableFilter = true
+		params.CursorStartTime = last.StartTime
+		params.CursorHackID = last.HackID
+	}
+}
+
 // FindTraceIDs retrieve traceIDs that match the traceQuery
 func (r *Reader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
 	{
@@ -176,7 +315,11 @@ func (r *Reader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryPa
 		}()
 	}
 
-	response, err := r.q.FindTraceIDs(ctx, sql.FindTraceIDsParams{
+	if err := validateTraceQuery(query); err != nil {
+		return nil, err
+	}
+
+	params := sql.FindTraceIDsParams{
 		ServiceName:                  query.ServiceName,
 		ServiceNameEnableFilter:      len(query.ServiceName) > 0,
 		OperationName:                query.OperationName,
@@ -189,16 +332,25 @@ func (r *Reader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryPa
 		DurationMinimumEnableFilter:  query.DurationMin > 0*time.Second,
 		DurationMaximum:              EncodeInterval(query.DurationMax),
 		DurationMaximumEnableFilter:  query.DurationMax > 0*time.Second,
-		// TODO(johnrowl) add tags
-		NumTraces: int32(query.NumTraces),
-	})
+	}
+
+	if err := encodeTagSearch(&params, query.Tags, r.opts.IndexedLogs); err != nil {
+		return nil, err
+	}
+
+	response, err := r.findTraceIDs(ctx, params, query.NumTraces)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query trace ids: %w", err)
+		return nil, err
 	}
 
 	var traceIDs = make([]model.TraceID, len(response))
 	for i, iter := range response {
-		traceIDs[i] = DecodeTraceID(iter)
+		traceID, err := DecodeTraceID(iter)
+		if err != nil {
+			return nil, err
+		}
+
+		traceIDs[i] = traceID
 	}
 
 	return traceIDs, nil
@@ -206,5 +358,121 @@ func (r *Reader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryPa
 
 // GetDependencies returns all inter-service dependencies
 func (r *Reader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
-	return []model.DependencyLink{}, nil
+	response, err := r.q.GetDependencies(ctx, sql.GetDependenciesParams{
+		StartTime: EncodeTimestamp(endTs.Add(-1 * lookback)),
+		EndTime:   EncodeTimestamp(endTs),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dependencies: %w", err)
+	}
+
+	var dependencies = make([]model.DependencyLink, len(response))
+	for i, iter := range response {
+		dependencies[i] = model.DependencyLink{
+			Parent:    iter.Parent,
+			Child:     iter.Child,
+			CallCount: uint64(iter.CallCount),
+		}
+	}
+
+	return dependencies, nil
+}
+
+// decodeSpan converts a span loaded from the database into its model. The
+// policy decides whether a field that cannot be decoded fails the span, or is
+// dropped with a warning.
+func decodeSpan(dbSpan sql.GetTraceSpansRow, policy DecodeErrorPolicy) (*model.Span, error) {
+	traceID, err := DecodeTraceID(dbSpan.TraceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode span: %w", err)
+	}
+
+	spanID, err := DecodeSpanID(dbSpan.SpanID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode span of trace %s: %w", traceID, err)
+	}
+
+	version := EncodingVersion(dbSpan.EncodingVersion)
+	warnings := dbSpan.Warnings
+
+	// decodeField applies the policy to the error of a field, it returns true
+	// when the field was decoded.
+	decodeField := func(field string, err error) (bool, error) {
+		if err == nil {
+			return true, nil
+		}
+
+		promDecodeErrorsCounter.WithLabelValues(field).Inc()
+
+		if policy != DecodeErrorPolicyDrop {
+			return false, fmt.Errorf("failed to decode %s of span %s: %w", field, spanID, err)
+		}
+
+		warnings = append(warnings, fmt.Sprintf("jaeger-postgresql dropped the %s of the span that could not be decoded: %s", field, err))
+		return false, nil
+	}
+
+	// dropElement returns the handler of the elements of a field that cannot
+	// be decoded, which drops them with a warning naming them under the drop
+	// policy.
+	dropElement := func(field string) decodeErrorHandler {
+		if policy != DecodeErrorPolicyDrop {
+			return failOnDecodeError
+		}
+
+		return func(err error) error {
+			promDecodeErrorsCounter.WithLabelValues(field).Inc()
+
+			warnings = append(warnings, fmt.Sprintf("jaeger-postgresql dropped an element of the %s of the span that could not be decoded: %s", field, err))
+			return nil
+		}
+	}
+
+	tags, err := decodeTags(version, dbSpan.Tags, dropElement("tags"))
+	if ok, err := decodeField("tags", err); err != nil {
+		return nil, err
+	} else if !ok {
+		tags = []model.KeyValue{}
+	}
+
+	processTags, err := decodeTags(version, dbSpan.ProcessTags, dropElement("process tags"))
+	if ok, err := decodeField("process tags", err); err != nil {
+		return nil, err
+	} else if !ok {
+		processTags = []model.KeyValue{}
+	}
+
+	logs, err := decodeLogs(version, dbSpan.Logs, dropElement("logs"))
+	if ok, err := decodeField("logs", err); err != nil {
+		return nil, err
+	} else if !ok {
+		logs = []model.Log{}
+	}
+
+	decodedSpanRefs, err := decodeSpanRefs(version, dbSpan.Refs, dropElement("spanrefs"))
+	if ok, err := decodeField("spanrefs", err); err != nil {
+		return nil, err
+	} else if !ok {
+		decodedSpanRefs = []model.SpanRef{}
+	}
+
+	duration := time.Duration(dbSpan.Duration.Microseconds * 1000)
+
+	return &model.Span{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: dbSpan.OperationName,
+		Tags:          tags,
+		References:    decodedSpanRefs,
+		Flags:         model.Flags(int32(dbSpan.Flags)),
+		StartTime:     dbSpan.StartTime.Time,
+		Duration:      duration,
+		Logs:          logs,
+		Process: &model.Process{
+			ServiceName: dbSpan.ProcessName,
+			Tags:        processTags,
+		},
+		ProcessID: dbSpan.ProcessID,
+		Warnings:  warnings,
+	}, nil
 }
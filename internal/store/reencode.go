@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+)
+
+// ReencodeOptions configures ReencodeSpans.
+type ReencodeOptions struct {
+	// BatchSize is the number of spans loaded by a single query.
+	BatchSize int
+
+	// Pause is the amount of time waited between two batches, leaving room
+	// for the writers.
+	Pause time.Duration
+}
+
+// ReencodeSpans rewrites the tags, logs and references of the spans and the
+// archived spans stored in an older encoding version in the current one. The
+// spans are read in the order of their hack_id, and the spans that cannot be
+// decoded are skipped, so that a run always ends. Each span is updated only if
+// it is still in the version it was read in, so several jaeger-postgresql
+// instances may re-encode the spans at the same time. It returns the number of
+// spans that were re-encoded, including when it fails part way through.
+func ReencodeSpans(ctx context.Context, q *sql.Queries, logger *slog.Logger, opts ReencodeOptions) (int64, error) {
+	total, err := reencodeTable(ctx, logger, "spans", opts,
+		func(afterHackID int64, batchSize int32) ([]sql.GetSpansToReencodeRow, error) {
+			return q.GetSpansToReencode(ctx, sql.GetSpansToReencodeParams{
+				AfterHackID: afterHackID,
+				BatchSize:   batchSize,
+			})
+		},
+		func(params sql.ReencodeSpanParams) (int64, error) {
+			return q.ReencodeSpan(ctx, params)
+		},
+	)
+	if err != nil {
+		return total, err
+	}
+
+	archived, err := reencodeTable(ctx, logger, "archived_spans", opts,
+		func(afterHackID int64, batchSize int32) ([]sql.GetSpansToReencodeRow, error) {
+			rows, err := q.GetArchivedSpansToReencode(ctx, sql.GetArchivedSpansToReencodeParams{
+				AfterHackID: afterHackID,
+				BatchSize:   batchSize,
+			})
+
+			spans := make([]sql.GetSpansToReencodeRow, len(rows))
+			for i, row := range rows {
+				spans[i] = sql.GetSpansToReencodeRow(row)
+			}
+
+			return spans, err
+		},
+		func(params sql.ReencodeSpanParams) (int64, error) {
+			return q.ReencodeArchivedSpan(ctx, sql.ReencodeArchivedSpanParams{
+				Tags:                    params.Tags,
+				ProcessTags:             params.ProcessTags,
+				Logs:                    params.Logs,
+				Refs:                    params.Refs,
+				EncodingVersion:         params.EncodingVersion,
+				HackID:                  params.HackID,
+				PreviousEncodingVersion: params.PreviousEncodingVersion,
+			})
+		},
+	)
+
+	return total + archived, err
+}
+
+// reencodeTable re-encodes the spans of a table returned by get in batches,
+// and updates each of them with update.
+func reencodeTable(
+	ctx context.Context,
+	logger *slog.Logger,
+	table string,
+	opts ReencodeOptions,
+	get func(afterHackID int64, batchSize int32) ([]sql.GetSpansToReencodeRow, error),
+	update func(params sql.ReencodeSpanParams) (int64, error),
+) (int64, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	var total int64
+	var afterHackID int64
+	for {
+		rows, err := get(afterHackID, int32(opts.BatchSize))
+		if err != nil {
+			return total, fmt.Errorf("failed to get %s to re-encode after hack_id %d: %w", table, afterHackID, err)
+		}
+
+		for _, row := range rows {
+			afterHackID = row.HackID
+
+			params, err := reencodeSpan(row)
+			if err != nil {
+				logger.Warn("skipped re-encoding span", "table", table, "hack_id", row.HackID, "encoding_version", row.EncodingVersion, "err", err)
+				continue
+			}
+
+			count, err := update(params)
+			if err != nil {
+				return total, fmt.Errorf("failed to re-encode %s %d: %w", table, row.HackID, err)
+			}
+
+			total += count
+		}
+
+		if len(rows) > 0 {
+			logger.Info("re-encoded batch of spans", "table", table, "spans", len(rows), "total", total, "encoding_version", CurrentEncodingVersion)
+		}
+
+		if len(rows) < opts.BatchSize {
+			return total, nil
+		}
+
+		if err := pause(ctx, opts.Pause); err != nil {
+			return total, fmt.Errorf("stopped re-encoding %s: %w", table, err)
+		}
+	}
+}
+
+// reencodeSpan decodes the fields of a span in its encoding version, and
+// returns the parameters updating them to the current one.
+func reencodeSpan(row sql.GetSpansToReencodeRow) (sql.ReencodeSpanParams, error) {
+	version := EncodingVersion(row.EncodingVersion)
+
+	tags, err := DecodeTags(version, row.Tags)
+	if err != nil {
+		return sql.ReencodeSpanParams{}, fmt.Errorf("failed to decode span tags: %w", err)
+	}
+
+	processTags, err := DecodeTags(version, row.ProcessTags)
+	if err != nil {
+		return sql.ReencodeSpanParams{}, fmt.Errorf("failed to decode process tags: %w", err)
+	}
+
+	logs, err := DecodeLogs(version, row.Logs)
+	if err != nil {
+		return sql.ReencodeSpanParams{}, fmt.Errorf("failed to decode logs: %w", err)
+	}
+
+	refs, err := DecodeSpanRefs(version, row.Refs)
+	if err != nil {
+		return sql.ReencodeSpanParams{}, fmt.Errorf("failed to decode spanrefs: %w", err)
+	}
+
+	params := sql.ReencodeSpanParams{
+		EncodingVersion:         int16(CurrentEncodingVersion),
+		HackID:                  row.HackID,
+		StartTime:               row.StartTime,
+		PreviousEncodingVersion: row.EncodingVersion,
+	}
+
+	if params.Tags, err = EncodeTags(tags); err != nil {
+		return params, fmt.Errorf("failed to encode tags: %w", err)
+	}
+
+	if params.ProcessTags, err = EncodeTags(processTags); err != nil {
+		return params, fmt.Errorf("failed to encode process tags: %w", err)
+	}
+
+	if params.Logs, err = EncodeLogs(logs); err != nil {
+		return params, fmt.Errorf("failed to encode logs: %w", err)
+	}
+
+	if params.Refs, err = EncodeSpanRefs(refs); err != nil {
+		return params, fmt.Errorf("failed to encode spanrefs: %w", err)
+	}
+
+	return params, nil
+}
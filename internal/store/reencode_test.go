@@ -0,0 +1,42 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReencodeSpan(t *testing.T) {
+	tags, err := encodeTagsV1([]model.KeyValue{model.String("key", "value")})
+	require.Nil(t, err)
+
+	refs, err := encodeSpanRefsV1([]model.SpanRef{model.NewChildOfRef(model.NewTraceID(0, 1), model.NewSpanID(2))})
+	require.Nil(t, err)
+
+	row := sql.GetSpansToReencodeRow{
+		HackID:          1,
+		EncodingVersion: int16(EncodingVersion1),
+		Tags:            tags,
+		ProcessTags:     []byte(`[]`),
+		Logs:            []byte(`[]`),
+		Refs:            refs,
+	}
+
+	params, err := reencodeSpan(row)
+	require.Nil(t, err)
+	require.Equal(t, int16(CurrentEncodingVersion), params.EncodingVersion)
+	require.Equal(t, int16(EncodingVersion1), params.PreviousEncodingVersion)
+
+	require.JSONEq(t, `{"key": "value"}`, string(params.Tags))
+
+	decoded, err := DecodeTags(CurrentEncodingVersion, params.Tags)
+	require.Nil(t, err)
+	require.Equal(t, []model.KeyValue{model.String("key", "value")}, decoded)
+
+	row.EncodingVersion = 0
+	_, err = reencodeSpan(row)
+	require.ErrorContains(t, err, "unknown encoding version 0")
+}
@@ -0,0 +1,290 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+)
+
+// retentionWindow is the range of start times scanned by the statements
+// applying a retention policy. Scanning the spans one window at a time avoids
+// scanning the spans that are kept by a longer retention over and over again.
+const retentionWindow = time.Hour
+
+// RetentionRule overrides the default retention of the spans it matches. A
+// rule matches a span when every criterion it sets matches the span.
+type RetentionRule struct {
+	// Service is the name of the service of the span.
+	Service string
+
+	// Operation is the name of the operation of the span.
+	Operation string
+
+	// Tag is a key=value pair matched against the tags and the process tags
+	// of the span.
+	Tag string
+
+	// MaxAge is the maximum age of the matched spans.
+	MaxAge time.Duration
+}
+
+// tag returns the key and the value of the tag matched by the rule.
+func (r RetentionRule) tag() (string, string) {
+	key, value, _ := strings.Cut(r.Tag, "=")
+	return key, value
+}
+
+// RetentionPolicy decides how long spans are kept. The first rule matching a
+// span decides its maximum age, and spans matched by no rule are kept for the
+// default maximum age.
+type RetentionPolicy struct {
+	Default time.Duration
+	Rules   []RetentionRule
+}
+
+// Validate returns an error when the policy is malformed.
+func (p RetentionPolicy) Validate() error {
+	if p.Default <= 0 {
+		return fmt.Errorf("invalid default retention: %s", p.Default)
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Service == "" && rule.Operation == "" && rule.Tag == "" {
+			return fmt.Errorf("retention rule %d matches every span", i)
+		}
+
+		if key, _, ok := strings.Cut(rule.Tag, "="); rule.Tag != "" && (!ok || key == "") {
+			return fmt.Errorf("retention rule %d has an invalid tag, expected key=value: %s", i, rule.Tag)
+		}
+
+		if rule.MaxAge <= 0 {
+			return fmt.Errorf("retention rule %d has an invalid max age: %s", i, rule.MaxAge)
+		}
+	}
+
+	return nil
+}
+
+// MinAge returns the shortest maximum age of the policy. No span younger than
+// it is ever deleted.
+func (p RetentionPolicy) MinAge() time.Duration {
+	age := p.Default
+	for _, rule := range p.Rules {
+		age = min(age, rule.MaxAge)
+	}
+
+	return age
+}
+
+// MaxAge returns the longest maximum age of the policy. Every span older than
+// it is deleted.
+func (p RetentionPolicy) MaxAge() time.Duration {
+	age := p.Default
+	for _, rule := range p.Rules {
+		age = max(age, rule.MaxAge)
+	}
+
+	return age
+}
+
+// encodedRetentionRules holds the rules of a retention policy as the parallel
+// arrays taken by the queries.
+type encodedRetentionRules struct {
+	serviceNames   []string
+	operationNames []string
+	tagKeys        []string
+	tagValues      []string
+	tagCandidates  []string
+	pruneBefores   []pgtype.Timestamp
+}
+
+// encodeRetentionRules encodes the rules of the policy, evaluated at now.
+func encodeRetentionRules(policy RetentionPolicy, now time.Time) (encodedRetentionRules, error) {
+	rules := encodedRetentionRules{
+		serviceNames:   make([]string, len(policy.Rules)),
+		operationNames: make([]string, len(policy.Rules)),
+		tagKeys:        make([]string, len(policy.Rules)),
+		tagValues:      make([]string, len(policy.Rules)),
+		pruneBefores:   make([]pgtype.Timestamp, len(policy.Rules)),
+	}
+
+	for i, rule := range policy.Rules {
+		rules.serviceNames[i] = rule.Service
+		rules.operationNames[i] = rule.Operation
+		rules.tagKeys[i], rules.tagValues[i] = rule.tag()
+		rules.pruneBefores[i] = EncodeTimestamp(now.Add(-1 * rule.MaxAge))
+	}
+
+	// the tags of the spans in EncodingVersion2 are looked up by containment.
+	var err error
+	rules.tagCandidates, err = EncodeTagCandidates(rules.tagKeys, rules.tagValues)
+	if err != nil {
+		return rules, err
+	}
+
+	return rules, nil
+}
+
+// CleanSpansByRetention deletes the spans that have outlived the retention
+// policy in batches, the oldest spans first. It returns the number of spans
+// that were deleted, including when it fails part way through.
+func CleanSpansByRetention(ctx context.Context, q *sql.Queries, logger *slog.Logger, now time.Time, policy RetentionPolicy, opts CleanOptions) (int64, error) {
+	if err := policy.Validate(); err != nil {
+		return 0, err
+	}
+
+	if len(policy.Rules) == 0 {
+		return CleanSpans(ctx, q, logger, now.Add(-1*policy.Default), opts)
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 10000
+	}
+
+	rules, err := encodeRetentionRules(policy, now)
+	if err != nil {
+		return 0, err
+	}
+
+	params := sql.CleanSpansByRetentionBatchParams{
+		RuleServiceNames:   rules.serviceNames,
+		RuleOperationNames: rules.operationNames,
+		RuleTagKeys:        rules.tagKeys,
+		RuleTagValues:      rules.tagValues,
+		RuleTagCandidates:  rules.tagCandidates,
+		RulePruneBefores:   rules.pruneBefores,
+		DefaultPruneBefore: EncodeTimestamp(now.Add(-1 * policy.Default)),
+		BatchSize:          int32(opts.BatchSize),
+	}
+
+	oldest, err := q.GetOldestSpanStartTime(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the start time of the oldest span: %w", err)
+	}
+
+	if !oldest.Valid {
+		return 0, nil
+	}
+
+	// spans started after the latest prune before are kept by every rule.
+	end := now.Add(-1 * policy.MinAge())
+
+	var total int64
+	for start := oldest.Time.Truncate(retentionWindow); start.Before(end); {
+		params.StartTimeMinimum = EncodeTimestamp(start)
+		params.StartTimeMaximum = EncodeTimestamp(start.Add(retentionWindow))
+
+		var windowTotal int64
+		for {
+			count, err := q.CleanSpansByRetentionBatch(ctx, params)
+			if err != nil {
+				return total, fmt.Errorf("failed to delete spans started at %s: %w", start, err)
+			}
+
+			windowTotal += count
+			total += count
+
+			// the pause only leaves room for the writers when spans were
+			// actually deleted, windows without expired spans are skipped
+			// quickly.
+			if count == 0 {
+				break
+			}
+
+			if err := pause(ctx, opts.Pause); err != nil {
+				return total, fmt.Errorf("stopped deleting spans started at %s: %w", start, err)
+			}
+
+			if count < int64(opts.BatchSize) {
+				break
+			}
+		}
+
+		if windowTotal > 0 {
+			logger.Info("deleted spans outliving the retention policy", "window", start, "spans", windowTotal, "total", total)
+		}
+
+		// the windows without spans are skipped, as a span with a skewed
+		// clock may be years older than the others.
+		next, err := q.GetOldestSpanStartTimeSince(ctx, params.StartTimeMaximum)
+		if err != nil {
+			return total, fmt.Errorf("failed to get the start time of the next span: %w", err)
+		}
+
+		if !next.Valid {
+			break
+		}
+
+		start = next.Time.Truncate(retentionWindow)
+	}
+
+	return total, nil
+}
+
+// RetentionReport describes the spans of a service that have outlived the
+// retention policy.
+type RetentionReport struct {
+	// Service is the name of the service, which is empty in the total of the
+	// services.
+	Service string `json:"service,omitempty"`
+	Spans   int64  `json:"spans"`
+	Traces  int64  `json:"traces"`
+
+	// Bytes is the estimated disk space used by the spans, excluding their
+	// indexes.
+	Bytes int64 `json:"bytes"`
+}
+
+// ReportSpansByRetention returns, per service, the spans that have outlived the
+// retention policy and would be deleted by CleanSpansByRetention, without
+// deleting them, along with their total. A trace spanning several services is
+// counted by each of them, but only once by the total.
+func ReportSpansByRetention(ctx context.Context, q *sql.Queries, now time.Time, policy RetentionPolicy) ([]RetentionReport, RetentionReport, error) {
+	var total RetentionReport
+	if err := policy.Validate(); err != nil {
+		return nil, total, err
+	}
+
+	rules, err := encodeRetentionRules(policy, now)
+	if err != nil {
+		return nil, total, err
+	}
+
+	response, err := q.GetExpiredSpansReport(ctx, sql.GetExpiredSpansReportParams{
+		StartTimeMaximum:   EncodeTimestamp(now.Add(-1 * policy.MinAge())),
+		RuleServiceNames:   rules.serviceNames,
+		RuleOperationNames: rules.operationNames,
+		RuleTagKeys:        rules.tagKeys,
+		RuleTagValues:      rules.tagValues,
+		RuleTagCandidates:  rules.tagCandidates,
+		RulePruneBefores:   rules.pruneBefores,
+		DefaultPruneBefore: EncodeTimestamp(now.Add(-1 * policy.Default)),
+	})
+	if err != nil {
+		return nil, total, fmt.Errorf("failed to report expired spans: %w", err)
+	}
+
+	var reports = make([]RetentionReport, 0, len(response))
+	for _, iter := range response {
+		report := RetentionReport{
+			Service: iter.ServiceName,
+			Spans:   iter.Spans,
+			Traces:  iter.Traces,
+			Bytes:   iter.Bytes,
+		}
+
+		if iter.Total {
+			total = report
+			continue
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, total, nil
+}
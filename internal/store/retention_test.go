@@ -0,0 +1,30 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	policy := RetentionPolicy{
+		Default: time.Hour * 24,
+		Rules: []RetentionRule{
+			{Service: "payments", MaxAge: time.Hour * 24 * 30},
+			{Tag: "env=dev", MaxAge: time.Hour},
+		},
+	}
+	require.Nil(t, policy.Validate())
+	require.Equal(t, time.Hour, policy.MinAge())
+	require.Equal(t, time.Hour*24*30, policy.MaxAge())
+
+	key, value := policy.Rules[1].tag()
+	require.Equal(t, "env", key)
+	require.Equal(t, "dev", value)
+
+	require.NotNil(t, RetentionPolicy{}.Validate())
+	require.NotNil(t, RetentionPolicy{Default: time.Hour, Rules: []RetentionRule{{MaxAge: time.Hour}}}.Validate())
+	require.NotNil(t, RetentionPolicy{Default: time.Hour, Rules: []RetentionRule{{Tag: "env", MaxAge: time.Hour}}}.Validate())
+	require.NotNil(t, RetentionPolicy{Default: time.Hour, Rules: []RetentionRule{{Service: "payments"}}}.Validate())
+}
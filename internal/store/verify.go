@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// VerifyOptions configures VerifySpans.
+type VerifyOptions struct {
+	// StartTimeMin and StartTimeMax restrict the verification to the spans
+	// started within them. They are ignored when zero.
+	StartTimeMin time.Time
+	StartTimeMax time.Time
+
+	// Service restricts the verification to the spans of a single service. It
+	// is ignored when empty.
+	Service string
+
+	// Quarantine moves the corrupt spans into the quarantined_spans table.
+	Quarantine bool
+
+	// BatchSize is the number of spans loaded by a single query.
+	BatchSize int
+}
+
+// CorruptSpan describes a span that failed verification.
+type CorruptSpan struct {
+	HackID    int64     `json:"hack_id"`
+	TraceID   string    `json:"trace_id"`
+	SpanID    string    `json:"span_id"`
+	Service   string    `json:"service"`
+	Operation string    `json:"operation"`
+	StartTime time.Time `json:"start_time"`
+	Reason    string    `json:"reason"`
+
+	// Quarantined is true when the span was moved to the quarantined_spans
+	// table.
+	Quarantined bool `json:"quarantined"`
+}
+
+// VerifyReport describes the outcome of VerifySpans.
+type VerifyReport struct {
+	// Spans is the number of spans that were verified.
+	Spans int64 `json:"spans"`
+
+	Corrupt []CorruptSpan `json:"corrupt"`
+}
+
+// Quarantined returns the number of corrupt spans that were quarantined.
+func (r VerifyReport) Quarantined() int64 {
+	var count int64
+	for _, span := range r.Corrupt {
+		if span.Quarantined {
+			count++
+		}
+	}
+
+	return count
+}
+
+// VerifySpans streams through the spans in batches, and checks that every one
+// of them can be decoded, that its references are well formed, and that its
+// operation belongs to its service and has its kind. The spans are read in the
+// order of their hack_id, so spans written while the verification is running
+// are verified as well.
+func VerifySpans(ctx context.Context, q *sql.Queries, logger *slog.Logger, opts VerifyOptions) (VerifyReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	report := VerifyReport{Corrupt: []CorruptSpan{}}
+
+	var afterHackID int64
+	for {
+		rows, err := q.GetSpansToVerify(ctx, sql.GetSpansToVerifyParams{
+			AfterHackID:                  afterHackID,
+			StartTimeMinimum:             EncodeTimestamp(opts.StartTimeMin),
+			StartTimeMinimumEnableFilter: !opts.StartTimeMin.IsZero(),
+			StartTimeMaximum:             EncodeTimestamp(opts.StartTimeMax),
+			StartTimeMaximumEnableFilter: !opts.StartTimeMax.IsZero(),
+			ServiceName:                  opts.Service,
+			ServiceNameEnableFilter:      len(opts.Service) > 0,
+			BatchSize:                    int32(opts.BatchSize),
+		})
+		if err != nil {
+			return report, fmt.Errorf("failed to get spans after hack_id %d: %w", afterHackID, err)
+		}
+
+		for _, row := range rows {
+			report.Spans++
+			afterHackID = row.HackID
+
+			problems := verifySpan(row)
+			if len(problems) == 0 {
+				continue
+			}
+
+			corrupt := CorruptSpan{
+				HackID:    row.HackID,
+				TraceID:   hex.EncodeToString(row.TraceID),
+				SpanID:    hex.EncodeToString(row.SpanID),
+				Service:   row.ProcessName,
+				Operation: row.OperationName,
+				StartTime: row.StartTime.Time,
+				Reason:    strings.Join(problems, "; "),
+			}
+
+			logger.Warn("found corrupt span", "hack_id", corrupt.HackID, "reason", corrupt.Reason)
+
+			if opts.Quarantine {
+				count, err := q.QuarantineSpan(ctx, sql.QuarantineSpanParams{
+					HackID:    row.HackID,
+					StartTime: row.StartTime,
+					Reason:    corrupt.Reason,
+				})
+				if err != nil {
+					return report, fmt.Errorf("failed to quarantine span %d: %w", row.HackID, err)
+				}
+
+				corrupt.Quarantined = count > 0
+			}
+
+			report.Corrupt = append(report.Corrupt, corrupt)
+		}
+
+		logger.Info("verified batch of spans", "spans", len(rows), "total", report.Spans, "corrupt", len(report.Corrupt))
+
+		if len(rows) < opts.BatchSize {
+			return report, nil
+		}
+	}
+}
+
+// verifySpan returns the problems found with a span, if any.
+func verifySpan(row sql.GetSpansToVerifyRow) []string {
+	var problems []string
+
+	span, err := decodeSpan(sql.GetTraceSpansRow{
+		SpanID:          row.SpanID,
+		TraceID:         row.TraceID,
+		OperationName:   row.OperationName,
+		Flags:           row.Flags,
+		StartTime:       row.StartTime,
+		Duration:        row.Duration,
+		Tags:            row.Tags,
+		ProcessID:       row.ProcessID,
+		Warnings:        row.Warnings,
+		Kind:            row.Kind,
+		ProcessName:     row.ProcessName,
+		ProcessTags:     row.ProcessTags,
+		Logs:            row.Logs,
+		Refs:            row.Refs,
+		EncodingVersion: row.EncodingVersion,
+	}, DecodeErrorPolicyFail)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		problems = append(problems, verifySpanRefs(span)...)
+	}
+
+	if row.OperationServiceID != row.ServiceID {
+		problems = append(problems, fmt.Sprintf("operation %d belongs to service %d, not to the service %d of the span", row.OperationID, row.OperationServiceID, row.ServiceID))
+	}
+
+	if row.OperationKind != row.Kind {
+		problems = append(problems, fmt.Sprintf("operation %d has kind %s, not the kind %s of the span", row.OperationID, row.OperationKind, row.Kind))
+	}
+
+	return problems
+}
+
+// verifySpanRefs returns the problems found with the references of a span.
+func verifySpanRefs(span *model.Span) []string {
+	var problems []string
+	for i, ref := range span.References {
+		switch {
+		case ref.RefType != model.ChildOf && ref.RefType != model.FollowsFrom:
+			problems = append(problems, fmt.Sprintf("spanref %d has unknown type %d", i, ref.RefType))
+		case ref.TraceID == (model.TraceID{}) || ref.SpanID == 0:
+			problems = append(problems, fmt.Sprintf("spanref %d references an empty id", i))
+		case ref.TraceID == span.TraceID && ref.SpanID == span.SpanID:
+			problems = append(problems, fmt.Sprintf("spanref %d references the span itself", i))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/robbert229/jaeger-postgresql/internal/sql"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySpan(t *testing.T) {
+	traceID := model.NewTraceID(0, 1)
+	spanID := model.NewSpanID(2)
+
+	refs, err := EncodeSpanRefs([]model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(1))})
+	require.Nil(t, err)
+
+	row := sql.GetSpansToVerifyRow{
+		HackID:             1,
+		SpanID:             EncodeSpanID(spanID),
+		TraceID:            EncodeTraceID(traceID),
+		OperationID:        3,
+		OperationServiceID: 4,
+		OperationKind:      sql.SpankindServer,
+		ServiceID:          4,
+		Kind:               sql.SpankindServer,
+		Tags:               []byte(`{}`),
+		ProcessTags:        []byte(`{}`),
+		Logs:               []byte(`[]`),
+		Refs:               refs,
+		EncodingVersion:    int16(CurrentEncodingVersion),
+	}
+
+	require.Empty(t, verifySpan(row))
+
+	t.Run("should report fields that cannot be decoded", func(t *testing.T) {
+		row := row
+		row.Logs = []byte(`[1]`)
+
+		problems := verifySpan(row)
+		require.Len(t, problems, 1)
+		require.Contains(t, problems[0], "failed to decode logs")
+	})
+
+	t.Run("should report an operation of another service or kind", func(t *testing.T) {
+		row := row
+		row.OperationServiceID = 5
+		row.OperationKind = sql.SpankindClient
+
+		require.Equal(t, []string{
+			"operation 3 belongs to service 5, not to the service 4 of the span",
+			"operation 3 has kind client, not the kind server of the span",
+		}, verifySpan(row))
+	})
+
+	t.Run("should report malformed references", func(t *testing.T) {
+		refs, err := EncodeSpanRefs([]model.SpanRef{
+			model.NewChildOfRef(traceID, spanID),
+			model.NewFollowsFromRef(model.TraceID{}, model.NewSpanID(1)),
+			{TraceID: traceID, SpanID: model.NewSpanID(1), RefType: 7},
+		})
+		require.Nil(t, err)
+
+		row := row
+		row.Refs = refs
+
+		require.Equal(t, []string{
+			"spanref 0 references the span itself",
+			"spanref 1 references an empty id",
+			"spanref 2 has unknown type 7",
+		}, verifySpan(row))
+	})
+}
@@ -2,12 +2,16 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"time"
 
 	"github.com/robbert229/jaeger-postgresql/internal/sql"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/jaegertracing/jaeger/model"
@@ -17,10 +21,29 @@ import (
 var _ spanstore.Writer = (*Writer)(nil)
 var _ io.Closer = (*Writer)(nil)
 
+const (
+	// serviceCacheSize is the maximum number of service ids cached by a Writer.
+	serviceCacheSize = 1000
+
+	// operationCacheSize is the maximum number of operation ids cached by a
+	// Writer.
+	operationCacheSize = 10000
+
+	// seenResolution is how often a Writer records that a service or
+	// operation was seen. The ids are cached for this long, and upserting
+	// them again once they expire bumps their last seen timestamp, so the
+	// timestamps cost a write per service and operation every interval rather
+	// than a write per span.
+	seenResolution = time.Minute
+)
+
 // Writer handles all writes to PostgreSQL 2.x for the Jaeger data model
 type Writer struct {
 	q      *sql.Queries
 	logger *slog.Logger
+
+	services   *idCache[string]
+	operations *idCache[sql.GetOperationIDParams]
 }
 
 // NewWriter returns a Writer.
@@ -28,6 +51,18 @@ func NewWriter(q *sql.Queries, logger *slog.Logger) *Writer {
 	w := &Writer{
 		q:      q,
 		logger: logger,
+		services: newIDCache[string](
+			serviceCacheSize,
+			seenResolution,
+			promIDCacheHitsCounter.WithLabelValues("service"),
+			promIDCacheMissesCounter.WithLabelValues("service"),
+		),
+		operations: newIDCache[sql.GetOperationIDParams](
+			operationCacheSize,
+			seenResolution,
+			promIDCacheHitsCounter.WithLabelValues("operation"),
+			promIDCacheMissesCounter.WithLabelValues("operation"),
+		),
 	}
 
 	return w
@@ -40,78 +75,275 @@ func (w *Writer) Close() error {
 
 // WriteSpan saves the span into PostgreSQL
 func (w *Writer) WriteSpan(ctx context.Context, span *model.Span) error {
-	err := w.q.UpsertService(ctx, span.Process.ServiceName)
+	err := w.writeSpan(ctx, span)
+	if isStaleReference(err) {
+		// the cached ids refer to a service or operation that has since been
+		// deleted, so they are resolved again.
+		w.purgeCaches()
+		err = w.writeSpan(ctx, span)
+	}
+
+	return err
+}
+
+func (w *Writer) writeSpan(ctx context.Context, span *model.Span) error {
+	params, err := w.prepareSpan(ctx, span)
 	if err != nil {
-		return fmt.Errorf("failed to upsert span service: %w", err)
+		return err
 	}
 
-	serviceID, err := w.q.GetServiceID(ctx, span.Process.ServiceName)
+	_, err = w.q.InsertSpan(ctx, sql.InsertSpanParams(params))
 	if err != nil {
-		return fmt.Errorf("failed to get service id: %w", err)
+		return fmt.Errorf("failed to insert span: %w", err)
 	}
 
-	modelKind, ok := span.GetSpanKind()
-	if !ok {
-		modelKind = trace.SpanKindUnspecified
+	return nil
+}
+
+// InvalidSpansError is returned by WriteSpans when some of the spans could not
+// be encoded. Those spans are left out of the batch, and the others are
+// written.
+type InvalidSpansError struct {
+	Errs []error
+}
+
+func (e *InvalidSpansError) Error() string {
+	return fmt.Sprintf("failed to encode %d spans: %s", len(e.Errs), errors.Join(e.Errs...))
+}
+
+func (e *InvalidSpansError) Unwrap() []error {
+	return e.Errs
+}
+
+// WriteSpans saves a batch of spans into PostgreSQL. The services and
+// operations are resolved once per batch, and the spans are then inserted with
+// a single COPY. The spans that cannot be encoded are left out, so that they
+// do not fail the whole batch, and are returned in an InvalidSpansError.
+func (w *Writer) WriteSpans(ctx context.Context, spans []*model.Span) error {
+	err := w.writeSpans(ctx, spans)
+	if isStaleReference(err) {
+		w.purgeCaches()
+		err = w.writeSpans(ctx, spans)
 	}
 
-	err = w.q.UpsertOperation(ctx, sql.UpsertOperationParams{
-		Name:      span.OperationName,
-		ServiceID: serviceID,
-		Kind:      EncodeSpanKind(modelKind),
-	})
+	return err
+}
+
+func (w *Writer) writeSpans(ctx context.Context, spans []*model.Span) error {
+	serviceIDs := map[string]int64{}
+	operationIDs := map[sql.GetOperationIDParams]int64{}
+
+	var invalid []error
+	params := make([]sql.CopySpansParams, 0, len(spans))
+	for _, span := range spans {
+		encoded, err := encodeSpan(span)
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("invalid span %s of trace %s: %w", span.SpanID, span.TraceID, err))
+			continue
+		}
+
+		serviceID, ok := serviceIDs[span.Process.ServiceName]
+		if !ok {
+			var err error
+			serviceID, err = w.getServiceID(ctx, span.Process.ServiceName)
+			if err != nil {
+				return err
+			}
+
+			serviceIDs[span.Process.ServiceName] = serviceID
+		}
+
+		operation := sql.GetOperationIDParams{
+			Name:      span.OperationName,
+			ServiceID: serviceID,
+			Kind:      encodeSpanKindOf(span),
+		}
+
+		operationID, ok := operationIDs[operation]
+		if !ok {
+			var err error
+			operationID, err = w.getOperationID(ctx, operation)
+			if err != nil {
+				return err
+			}
+
+			operationIDs[operation] = operationID
+		}
+
+		params = append(params, newCopySpansParams(span, serviceID, operationID, encoded))
+	}
+
+	if len(params) > 0 {
+		_, err := w.q.CopySpans(ctx, params)
+		if err != nil {
+			return fmt.Errorf("failed to copy spans: %w", err)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return &InvalidSpansError{Errs: invalid}
+	}
+
+	return nil
+}
+
+// prepareSpan resolves the service and operation of the span, and encodes it
+// into the parameters used to insert it.
+func (w *Writer) prepareSpan(ctx context.Context, span *model.Span) (sql.CopySpansParams, error) {
+	serviceID, err := w.getServiceID(ctx, span.Process.ServiceName)
 	if err != nil {
-		return fmt.Errorf("failed to upsert span operation: %w", err)
+		return sql.CopySpansParams{}, err
 	}
 
-	operationID, err := w.q.GetOperationID(ctx, sql.GetOperationIDParams{
+	operationID, err := w.getOperationID(ctx, sql.GetOperationIDParams{
 		Name:      span.OperationName,
 		ServiceID: serviceID,
-		Kind:      EncodeSpanKind(modelKind),
+		Kind:      encodeSpanKindOf(span),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to get operation id: %w", err)
+		return sql.CopySpansParams{}, err
+	}
+
+	encoded, err := encodeSpan(span)
+	if err != nil {
+		return sql.CopySpansParams{}, err
 	}
 
+	return newCopySpansParams(span, serviceID, operationID, encoded), nil
+}
+
+// purgeCaches forgets every cached service and operation id.
+func (w *Writer) purgeCaches() {
+	w.services.Purge()
+	w.operations.Purge()
+}
+
+// foreignKeyViolationCode is the postgres error code of foreign key violations.
+const foreignKeyViolationCode = "23503"
+
+// isForeignKeyViolation returns true if the error was caused by a row that
+// referenced a missing service or operation.
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == foreignKeyViolationCode
+}
+
+// isStaleReference returns true if the error was caused by a service or
+// operation that was deleted by the cleaner while the span was written, either
+// after its id was cached, or between its upsert and the lookup of its id.
+func isStaleReference(err error) bool {
+	return isForeignKeyViolation(err) || errors.Is(err, pgx.ErrNoRows)
+}
+
+// getServiceID returns the id of the service, creating it if necessary.
+func (w *Writer) getServiceID(ctx context.Context, name string) (int64, error) {
+	if serviceID, ok := w.services.Get(name); ok {
+		return serviceID, nil
+	}
+
+	err := w.q.UpsertService(ctx, name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to upsert span service: %w", err)
+	}
+
+	serviceID, err := w.q.GetServiceID(ctx, name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get service id: %w", err)
+	}
+
+	w.services.Put(name, serviceID)
+
+	return serviceID, nil
+}
+
+// getOperationID returns the id of the operation, creating it if necessary.
+func (w *Writer) getOperationID(ctx context.Context, operation sql.GetOperationIDParams) (int64, error) {
+	if operationID, ok := w.operations.Get(operation); ok {
+		return operationID, nil
+	}
+
+	err := w.q.UpsertOperation(ctx, sql.UpsertOperationParams(operation))
+	if err != nil {
+		return 0, fmt.Errorf("failed to upsert span operation: %w", err)
+	}
+
+	operationID, err := w.q.GetOperationID(ctx, operation)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get operation id: %w", err)
+	}
+
+	w.operations.Put(operation, operationID)
+
+	return operationID, nil
+}
+
+// encodeSpanKindOf returns the encoded span kind of the span.
+func encodeSpanKindOf(span *model.Span) sql.Spankind {
+	modelKind, ok := span.GetSpanKind()
+	if !ok {
+		modelKind = trace.SpanKindUnspecified
+	}
+
+	return EncodeSpanKind(modelKind)
+}
+
+// newCopySpansParams returns the parameters used to copy the span into the spans table.
+func newCopySpansParams(span *model.Span, serviceID, operationID int64, encoded encodedSpan) sql.CopySpansParams {
+	return sql.CopySpansParams{
+		SpanID:          EncodeSpanID(span.SpanID),
+		TraceID:         EncodeTraceID(span.TraceID),
+		OperationID:     operationID,
+		Flags:           int64(span.Flags),
+		StartTime:       EncodeTimestamp(span.StartTime),
+		Duration:        EncodeInterval(span.Duration),
+		Tags:            encoded.Tags,
+		ServiceID:       serviceID,
+		ProcessID:       span.ProcessID,
+		Warnings:        span.Warnings,
+		ProcessTags:     encoded.ProcessTags,
+		Kind:            encodeSpanKindOf(span),
+		Logs:            encoded.Logs,
+		Refs:            encoded.Refs,
+		EncodingVersion: int16(encoded.Version),
+	}
+}
+
+// encodedSpan holds the jsonb encoded fields of a span.
+type encodedSpan struct {
+	Version     EncodingVersion
+	Tags        []byte
+	ProcessTags []byte
+	Logs        []byte
+	Refs        []byte
+}
+
+// encodeSpan encodes the jsonb fields of a span.
+func encodeSpan(span *model.Span) (encodedSpan, error) {
 	logs, err := EncodeLogs(span.Logs)
 	if err != nil {
-		return fmt.Errorf("failed to encode logs: %w", err)
+		return encodedSpan{}, fmt.Errorf("failed to encode logs: %w", err)
 	}
 
 	tags, err := EncodeTags(span.Tags)
 	if err != nil {
-		return fmt.Errorf("failed to encode tags: %w", err)
+		return encodedSpan{}, fmt.Errorf("failed to encode tags: %w", err)
 	}
 
 	processTags, err := EncodeTags(span.Process.Tags)
 	if err != nil {
-		return fmt.Errorf("failed to encode process tags: %w", err)
+		return encodedSpan{}, fmt.Errorf("failed to encode process tags: %w", err)
 	}
 
-	encodedSpanRefs, err := EncodeSpanRefs(span.References)
+	refs, err := EncodeSpanRefs(span.References)
 	if err != nil {
-		return fmt.Errorf("failed to encode spanrefs: %w", err)
+		return encodedSpan{}, fmt.Errorf("failed to encode spanrefs: %w", err)
 	}
 
-	_, err = w.q.InsertSpan(ctx, sql.InsertSpanParams{
-		SpanID:      EncodeSpanID(span.SpanID),
-		TraceID:     EncodeTraceID(span.TraceID),
-		OperationID: operationID,
-		Flags:       int64(span.Flags),
-		StartTime:   EncodeTimestamp(span.StartTime),
-		Duration:    EncodeInterval(span.Duration),
+	return encodedSpan{
+		Version:     CurrentEncodingVersion,
 		Tags:        tags,
-		ServiceID:   serviceID,
-		ProcessID:   span.ProcessID,
-		Warnings:    span.Warnings,
 		ProcessTags: processTags,
-		Kind:        EncodeSpanKind(modelKind),
 		Logs:        logs,
-		Refs:        encodedSpanRefs,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to insert span: %w", err)
-	}
-
-	return nil
+		Refs:        refs,
+	}, nil
 }